@@ -0,0 +1,98 @@
+// Package api holds the requests and responses of the HTTP API. The
+// controllers and the client package share them, so both stay in sync.
+package api
+
+import "time"
+
+// Statuses of an expression
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	// StatusFailed expressions have a task which ran out of attempts
+	StatusFailed = "failed"
+	// StatusTimedOut expressions were not computed before their deadline
+	StatusTimedOut = "timed_out"
+)
+
+type UserRequest struct {
+	Email    string `json:"email" valid:"required,email"`
+	Password string `json:"password" valid:"required,minstringlength(3)~Password too short,type(string)"`
+}
+
+type TokenResponse struct {
+	Token     string     `json:"access_token"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ExpressionRequest struct {
+	Expression string `json:"expression"`
+	// Priority is lowered to the maximum allowed for the role of the user
+	Priority int `json:"priority,omitempty"`
+	// StrictOrder keeps the order of evaluation as written, sums and products are not regrouped
+	StrictOrder bool `json:"strict_order,omitempty"`
+	// NoCache computes every operation anew instead of reusing results of earlier expressions
+	NoCache bool `json:"no_cache,omitempty"`
+	// TimeoutMs and Deadline limit the time to compute the expression, the earlier one applies
+	TimeoutMs int64      `json:"timeout_ms,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+}
+
+type CalculateResponse struct {
+	Id string `json:"id"`
+	// Priority is the one actually applied
+	Priority int        `json:"priority"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type Expression struct {
+	Id            string     `json:"id"`
+	Expression    string     `json:"expression"`
+	Status        string     `json:"status"`
+	Result        *float64   `json:"result"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	Priority      int        `json:"priority"`
+	Deadline      *time.Time `json:"deadline,omitempty"`
+	CreatedAt     *time.Time `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at"`
+}
+
+// Done tells whether the expression is not calculated anymore.
+func (e *Expression) Done() bool {
+	return e.Status != StatusPending
+}
+
+type ExpressionsResponse struct {
+	Expressions []Expression `json:"expressions"`
+}
+
+// Statuses of a task
+const (
+	TaskWaiting    = "waiting"
+	TaskProcessing = "processing"
+	TaskCompleted  = "completed"
+	TaskDeadLetter = "dead_letter"
+)
+
+// Task is an operation of an expression computed by an agent.
+type Task struct {
+	Id        string `json:"id"`
+	Operation string `json:"operation"`
+	// Arg1 and Arg2 are nil until the tasks computing them complete
+	Arg1     *float64 `json:"arg1"`
+	Arg2     *float64 `json:"arg2"`
+	Result   *float64 `json:"result"`
+	Status   string   `json:"status"`
+	Attempts int      `json:"attempts"`
+}
+
+type TasksResponse struct {
+	Tasks []Task `json:"tasks"`
+}
+
+// ErrorResponse is the body of a rejected request. Some errors are sent as a
+// bare JSON string, which is the message.
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Limit names the exceeded expression limit or quota
+	Limit string `json:"limit,omitempty"`
+}
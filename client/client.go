@@ -0,0 +1,348 @@
+// Package client calls the HTTP API of the orchestrator. The API has no refresh
+// tokens: with credentials the client logs in again when its token is about to
+// expire or is rejected, a token given without credentials is used until it fails.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raikh/calc_micro_final/api"
+)
+
+const defaultPollInterval = 500 * time.Millisecond
+
+// tokenRenewal is how long before its expiration the client logs in again
+const tokenRenewal = time.Minute
+
+// ErrNoCredentials is returned by calls which need a token when the client has no way to get one.
+var ErrNoCredentials = errors.New("client: no credentials, token or API key")
+
+// Error is a request rejected by the API.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Limit names the exceeded expression limit or quota
+	Limit string
+	// RetryAfter is set when a quota allows the request later
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound tells whether the error is a 404 of the API.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	pollInterval time.Duration
+
+	email    string
+	password string
+	apiKey   string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	// onToken is called with every new token, e.g. to store it
+	onToken func(api.TokenResponse)
+}
+
+type Option func(*Client)
+
+// WithCredentials makes the client log in itself, on the first call and whenever its token expires.
+func WithCredentials(email string, password string) Option {
+	return func(c *Client) {
+		c.email = email
+		c.password = password
+	}
+}
+
+// WithToken starts with a token got earlier, a zero expiresAt means unknown.
+// Without WithCredentials the client cannot get another one and calls fail with
+// the 401 of the API once the token expires.
+func WithToken(token string, expiresAt time.Time) Option {
+	return func(c *Client) {
+		c.token = token
+		c.expiresAt = expiresAt
+	}
+}
+
+// WithAPIKey authenticates with the X-API-Key header instead of a token.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithPollInterval sets how often Wait checks the expression.
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.pollInterval = interval
+	}
+}
+
+// WithTokenCallback is called with every token got by logging in.
+func WithTokenCallback(onToken func(api.TokenResponse)) Option {
+	return func(c *Client) {
+		c.onToken = onToken
+	}
+}
+
+// New returns a client of the API at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		httpClient:   http.DefaultClient,
+		pollInterval: defaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Register creates a user, it does not log in.
+func (c *Client) Register(ctx context.Context, email string, password string) error {
+	return c.do(ctx, http.MethodPost, "/api/register", api.UserRequest{Email: email, Password: password}, nil, false)
+}
+
+// Login gets a new token with the credentials of the client.
+func (c *Client) Login(ctx context.Context) (api.TokenResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.login(ctx)
+}
+
+func (c *Client) login(ctx context.Context) (api.TokenResponse, error) {
+	if c.email == "" {
+		return api.TokenResponse{}, ErrNoCredentials
+	}
+
+	var token api.TokenResponse
+	err := c.do(ctx, http.MethodPost, "/api/login", api.UserRequest{Email: c.email, Password: c.password}, &token, false)
+	if err != nil {
+		return api.TokenResponse{}, err
+	}
+
+	c.token = token.Token
+	c.expiresAt = time.Time{}
+	if token.ExpiresAt != nil {
+		c.expiresAt = *token.ExpiresAt
+	}
+	if c.onToken != nil {
+		c.onToken(token)
+	}
+
+	return token, nil
+}
+
+// authorize sets the credentials of the request, logging in when the token
+// is missing or about to expire.
+func (c *Client) authorize(ctx context.Context, req *http.Request) error {
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiring := !c.expiresAt.IsZero() && time.Until(c.expiresAt) < tokenRenewal
+	if (c.token == "" || expiring) && c.email != "" {
+		if _, err := c.login(ctx); err != nil {
+			return err
+		}
+	}
+	if c.token == "" {
+		return ErrNoCredentials
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	return nil
+}
+
+// Submit sends the expression to be calculated.
+func (c *Client) Submit(ctx context.Context, req api.ExpressionRequest) (api.CalculateResponse, error) {
+	var response api.CalculateResponse
+	err := c.do(ctx, http.MethodPost, "/api/calculate", req, &response, true)
+
+	return response, err
+}
+
+// Calculate submits the expression and waits for its result.
+func (c *Client) Calculate(ctx context.Context, req api.ExpressionRequest) (api.Expression, error) {
+	submitted, err := c.Submit(ctx, req)
+	if err != nil {
+		return api.Expression{}, err
+	}
+
+	return c.Wait(ctx, submitted.Id)
+}
+
+func (c *Client) Get(ctx context.Context, id string) (api.Expression, error) {
+	var expression api.Expression
+	err := c.do(ctx, http.MethodGet, "/api/expressions/"+url.PathEscape(id), nil, &expression, true)
+
+	return expression, err
+}
+
+// Tasks returns the tasks of the expression with their progress.
+func (c *Client) Tasks(ctx context.Context, id string) ([]api.Task, error) {
+	var response api.TasksResponse
+	err := c.do(ctx, http.MethodGet, "/api/expressions/"+url.PathEscape(id)+"/tasks", nil, &response, true)
+
+	return response.Tasks, err
+}
+
+// List returns all the expressions of the user.
+func (c *Client) List(ctx context.Context) ([]api.Expression, error) {
+	var response api.ExpressionsResponse
+	err := c.do(ctx, http.MethodGet, "/api/expressions", nil, &response, true)
+
+	return response.Expressions, err
+}
+
+// Wait polls the expression until it is not pending anymore or ctx is done.
+func (c *Client) Wait(ctx context.Context, id string) (api.Expression, error) {
+	return c.WaitProgress(ctx, id, nil)
+}
+
+// WaitProgress is Wait calling progress with every polled state of the expression.
+func (c *Client) WaitProgress(ctx context.Context, id string, progress func(api.Expression)) (api.Expression, error) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		expression, err := c.Get(ctx, id)
+		if err != nil {
+			return api.Expression{}, err
+		}
+		if progress != nil {
+			progress(expression)
+		}
+		if expression.Done() {
+			return expression, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return expression, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// do sends the request with body encoded as JSON and decodes the response into out.
+func (c *Client) do(ctx context.Context, method string, path string, body any, out any, auth bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(ctx, method, path, payload, auth)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && auth && c.apiKey == "" && c.email != "" {
+		// the token was revoked or the server restarted with another secret
+		resp.Body.Close()
+		if _, err := c.Login(ctx); err != nil {
+			return err
+		}
+		if resp, err = c.send(ctx, method, path, payload, auth); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp, data)
+	}
+
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, payload []byte, auth bool) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth {
+		if err := c.authorize(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// responseError decodes the error body, which is either a JSON string or an object with a message.
+func responseError(resp *http.Response, data []byte) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+
+	var message string
+	var body api.ErrorResponse
+	switch {
+	case json.Unmarshal(data, &message) == nil:
+		apiErr.Message = message
+	case json.Unmarshal(data, &body) == nil && body.Message != "":
+		apiErr.Message = body.Message
+		apiErr.Limit = body.Limit
+	default:
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return apiErr
+}
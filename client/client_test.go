@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raikh/calc_micro_final/api"
+)
+
+// fakeAPI serves the calls of the client: a single expression which is
+// completed after the given number of polls.
+type fakeAPI struct {
+	mu sync.Mutex
+	// tokenTTL is the lifetime of the issued tokens
+	tokenTTL time.Duration
+	token    string
+	logins   int
+	// pendingPolls are the polls answered with a pending expression
+	pendingPolls int
+	polls        int
+	submitted    []api.ExpressionRequest
+}
+
+func newFakeAPI(t *testing.T, f *fakeAPI) *httptest.Server {
+	t.Helper()
+	if f.tokenTTL == 0 {
+		f.tokenTTL = time.Hour
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", f.login)
+	mux.HandleFunc("POST /api/calculate", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		var req api.ExpressionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, "invalid body")
+			return
+		}
+		f.submitted = append(f.submitted, req)
+		writeJSON(w, http.StatusCreated, api.CalculateResponse{Id: "expression"})
+	}))
+	mux.HandleFunc("GET /api/expressions/{id}", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "expression" {
+			writeJSON(w, http.StatusNotFound, "expression not found")
+			return
+		}
+		f.polls++
+		writeJSON(w, http.StatusOK, f.expression())
+	}))
+	mux.HandleFunc("GET /api/expressions", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, api.ExpressionsResponse{Expressions: []api.Expression{f.expression()}})
+	}))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (f *fakeAPI) login(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req api.UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password != "secret" {
+		writeJSON(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	f.logins++
+	f.token = fmt.Sprintf("token-%d", f.logins)
+	expiresAt := time.Now().Add(f.tokenTTL)
+	writeJSON(w, http.StatusOK, api.TokenResponse{Token: f.token, ExpiresAt: &expiresAt})
+}
+
+// authorized accepts only the last issued token.
+func (f *fakeAPI) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.token == "" || r.Header.Get("Authorization") != "Bearer "+f.token {
+			writeJSON(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// revoke rejects the current token, as a restarted server with another secret would.
+func (f *fakeAPI) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.token = "revoked"
+}
+
+// expression must be called with mu held.
+func (f *fakeAPI) expression() api.Expression {
+	if f.polls <= f.pendingPolls {
+		return api.Expression{Id: "expression", Expression: "2*(3+4)", Status: api.StatusPending}
+	}
+	result := 14.0
+	return api.Expression{Id: "expression", Expression: "2*(3+4)", Status: api.StatusCompleted, Result: &result}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestClientSubmitAndWait(t *testing.T) {
+	f := &fakeAPI{pendingPolls: 2}
+	server := newFakeAPI(t, f)
+	c := New(server.URL, WithCredentials("user@example.com", "secret"), WithPollInterval(time.Millisecond))
+	ctx := context.Background()
+
+	submitted, err := c.Submit(ctx, api.ExpressionRequest{Expression: "2*(3+4)", Priority: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submitted.Id != "expression" || len(f.submitted) != 1 || f.submitted[0].Priority != 1 {
+		t.Fatalf("Submit() = %+v, server got %+v", submitted, f.submitted)
+	}
+
+	var states []string
+	expression, err := c.WaitProgress(ctx, submitted.Id, func(e api.Expression) { states = append(states, e.Status) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expression.Status != api.StatusCompleted || expression.Result == nil || *expression.Result != 14 {
+		t.Errorf("Wait() = %s %v, want completed with 14", expression.Status, expression.Result)
+	}
+	if len(states) != 3 {
+		t.Errorf("Wait() polled %d times, want 3", len(states))
+	}
+	if f.logins != 1 {
+		t.Errorf("client logged in %d times, want once", f.logins)
+	}
+}
+
+func TestClientGetAndList(t *testing.T) {
+	server := newFakeAPI(t, &fakeAPI{})
+	c := New(server.URL, WithCredentials("user@example.com", "secret"))
+	ctx := context.Background()
+
+	expression, err := c.Get(ctx, "expression")
+	if err != nil || expression.Id != "expression" {
+		t.Fatalf("Get() = %+v, %v", expression, err)
+	}
+	if _, err := c.Get(ctx, "unknown"); !IsNotFound(err) {
+		t.Errorf("Get() of an unknown expression error = %v, want not found", err)
+	}
+
+	expressions, err := c.List(ctx)
+	if err != nil || len(expressions) != 1 || expressions[0].Id != "expression" {
+		t.Errorf("List() = %+v, %v", expressions, err)
+	}
+}
+
+func TestClientWaitStopsWithContext(t *testing.T) {
+	server := newFakeAPI(t, &fakeAPI{pendingPolls: 1000})
+	c := New(server.URL, WithCredentials("user@example.com", "secret"), WithPollInterval(time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// the deadline may pass while waiting for the next poll or during a request
+	if _, err := c.Wait(ctx, "expression"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, want the context error", err)
+	}
+}
+
+func TestClientLogsInAgain(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokenTTL time.Duration
+		// revoke rejects the token between the calls
+		revoke     bool
+		wantLogins int
+	}{
+		{name: "valid token", wantLogins: 1},
+		{name: "token rejected", revoke: true, wantLogins: 2},
+		{name: "token about to expire", tokenTTL: tokenRenewal / 2, wantLogins: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{tokenTTL: tt.tokenTTL}
+			server := newFakeAPI(t, f)
+			var tokens []string
+			c := New(server.URL, WithCredentials("user@example.com", "secret"),
+				WithTokenCallback(func(token api.TokenResponse) { tokens = append(tokens, token.Token) }))
+			ctx := context.Background()
+
+			if _, err := c.List(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoke {
+				f.revoke()
+			}
+			if _, err := c.List(ctx); err != nil {
+				t.Fatalf("List() after the first token error = %v", err)
+			}
+
+			if f.logins != tt.wantLogins || len(tokens) != tt.wantLogins {
+				t.Errorf("client logged in %d times with %d tokens reported, want %d", f.logins, len(tokens), tt.wantLogins)
+			}
+		})
+	}
+}
+
+func TestClientWithoutCredentials(t *testing.T) {
+	f := &fakeAPI{}
+	server := newFakeAPI(t, f)
+	ctx := context.Background()
+
+	if _, err := New(server.URL).List(ctx); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("List() without credentials error = %v, want ErrNoCredentials", err)
+	}
+
+	// a token alone is not renewed
+	c := New(server.URL, WithToken("expired", time.Time{}))
+	var apiErr *Error
+	if _, err := c.List(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("List() with a rejected token error = %v, want 401", err)
+	}
+	if f.logins != 0 {
+		t.Errorf("client logged in %d times without credentials", f.logins)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		writeJSON(w, http.StatusTooManyRequests, api.ErrorResponse{Message: "too many requests", Limit: "requests_per_minute"})
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, WithAPIKey("key")).Submit(context.Background(), api.ExpressionRequest{Expression: "1+2"})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Submit() error = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Message != "too many requests" ||
+		apiErr.Limit != "requests_per_minute" || apiErr.RetryAfter != 7*time.Second {
+		t.Errorf("Submit() error = %+v", apiErr)
+	}
+}
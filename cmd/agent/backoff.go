@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff doubles the delay from min up to max on every failure. The delay is
+// randomized between its half and its full value, so agents which lost the
+// orchestrator together do not reconnect at the same moment.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+func (b *backoff) Next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.min << b.attempt; d > 0 && d < b.max {
+			delay = d
+			b.attempt++
+		}
+	}
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
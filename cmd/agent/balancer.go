@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health" // client side health checking used by the service config
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	pb "github.com/raikh/calc_micro_final/proto"
+)
+
+// serviceConfig spreads calls over all orchestrators which report the task
+// service as serving, so an orchestrator being redeployed gets no calls.
+var serviceConfig = fmt.Sprintf(`{
+	"loadBalancingConfig": [{"round_robin": {}}],
+	"healthCheckConfig": {"serviceName": %q}
+}`, pb.TaskService_ServiceDesc.ServiceName)
+
+// orchestratorTarget returns the dial target of the orchestrators. A single
+// address goes through the DNS resolver, so a name with several records is
+// balanced as well; a list of addresses is given to a static resolver.
+func orchestratorTarget(cfg *config.AgentConfig) (string, []grpc.DialOption) {
+	options := []grpc.DialOption{grpc.WithDefaultServiceConfig(serviceConfig)}
+
+	addresses := cfg.Orchestrators
+	if len(addresses) == 0 {
+		addresses = []string{net.JoinHostPort(cfg.GRPCAddress, fmt.Sprint(cfg.GRPCPort))}
+	}
+	log.WithField("addresses", addresses).Info("Orchestrator addresses")
+	if len(addresses) == 1 {
+		return "dns:///" + addresses[0], options
+	}
+
+	state := resolver.State{}
+	for _, address := range addresses {
+		host, _, _ := net.SplitHostPort(address)
+		// ServerName keeps TLS verification against the name of every orchestrator
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address, ServerName: host})
+	}
+
+	r := manual.NewBuilderWithScheme("orchestrators")
+	r.InitialState(state)
+
+	return r.Scheme() + ":///orchestrators", append(options, grpc.WithResolvers(r))
+}
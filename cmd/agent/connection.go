@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+var connectionStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// watchConnection reports every state change of the orchestrator connection.
+func watchConnection(ctx context.Context, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for {
+		for _, s := range connectionStates {
+			value := 0.0
+			if s == state {
+				value = 1
+			}
+			agentMetrics.ConnectionState.WithLabelValues(s.String()).Set(value)
+		}
+
+		entry := log.WithField("state", state.String())
+		if state == connectivity.TransientFailure {
+			entry.Warn("Orchestrator connection state changed")
+		} else {
+			entry.Info("Orchestrator connection state changed")
+		}
+
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		state = conn.GetState()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/raikh/calc_micro_final/internal/operation"
+	"github.com/raikh/calc_micro_final/internal/operation/wasm"
+	pb "github.com/raikh/calc_micro_final/proto"
+)
+
+// customOperations keeps the registry in sync with the WASM operations stored
+// by the orchestrator.
+type customOperations struct {
+	client   pb.TaskServiceClient
+	registry *operation.Registry
+	limits   wasm.Limits
+	// loaded maps names of the registered custom operations to their module hash
+	loaded map[string]string
+	// failed maps names of operations which could not be loaded to the module
+	// hash, the same module is not tried again
+	failed map[string]string
+}
+
+func newCustomOperations(client pb.TaskServiceClient, registry *operation.Registry, limits wasm.Limits) *customOperations {
+	return &customOperations{
+		client:   client,
+		registry: registry,
+		limits:   limits,
+		loaded:   make(map[string]string),
+		failed:   make(map[string]string),
+	}
+}
+
+func (s *customOperations) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Sync(ctx); err != nil {
+			agentMetrics.Errors.WithLabelValues("sync_operations").Inc()
+			log.WithError(err).Warn("Error loading custom operations")
+		}
+	}
+}
+
+// Sync loads new and changed operations and removes deleted ones.
+func (s *customOperations) Sync(ctx context.Context) error {
+	list, err := s.client.ListCustomOperations(ctx, &pb.Empty{})
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(list.Operations))
+	for _, info := range list.Operations {
+		current[info.Name] = true
+		if s.loaded[info.Name] == info.Hash || s.failed[info.Name] == info.Hash {
+			continue
+		}
+		if _, ok := s.loaded[info.Name]; !ok {
+			if _, builtin := s.registry.Get(info.Name); builtin {
+				log.WithField("operation", info.Name).Warn("Custom operation has the name of a built-in one, ignoring it")
+				continue
+			}
+		}
+
+		if err := s.load(ctx, info.Name); err != nil {
+			// a broken module must not keep the other operations from loading
+			agentMetrics.Errors.WithLabelValues("sync_operations").Inc()
+			log.WithField("operation", info.Name).WithError(err).Warn("Error loading custom operation")
+		}
+	}
+
+	for name := range s.failed {
+		if !current[name] {
+			delete(s.failed, name)
+		}
+	}
+
+	for name := range s.loaded {
+		if !current[name] {
+			s.release(s.registry.Remove(name))
+			delete(s.loaded, name)
+			log.WithField("operation", name).Info("Custom operation removed")
+		}
+	}
+
+	return nil
+}
+
+func (s *customOperations) load(ctx context.Context, name string) error {
+	module, err := s.client.GetCustomOperation(ctx, &pb.OperationRequest{Name: name})
+	if err != nil {
+		return err
+	}
+
+	op, err := wasm.Compile(ctx, module.Name, module.Module, s.limits)
+	if err != nil {
+		s.failed[module.Name] = module.Hash
+		return err
+	}
+	delete(s.failed, module.Name)
+
+	s.release(s.registry.Replace(op))
+	s.loaded[module.Name] = module.Hash
+	log.WithFields(log.Fields{"operation": module.Name, "hash": module.Hash}).Info("Custom operation loaded")
+
+	return nil
+}
+
+// release closes a replaced operation once calls started before the
+// replacement had time to finish.
+func (s *customOperations) release(op operation.Operation) {
+	previous, ok := op.(*wasm.Operation)
+	if !ok {
+		return
+	}
+
+	time.AfterFunc(2*s.limits.Timeout, func() {
+		previous.Close(context.Background())
+	})
+}
@@ -2,83 +2,189 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/grpcauth"
+	"github.com/raikh/calc_micro_final/internal/logging"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/internal/operation"
+	"github.com/raikh/calc_micro_final/internal/operation/wasm"
+	// operations computed by the agent, add imports to support more of them
+	_ "github.com/raikh/calc_micro_final/internal/operation/arithmetic"
+	"github.com/raikh/calc_micro_final/internal/tracing"
 	pb "github.com/raikh/calc_micro_final/proto"
 )
 
-func getTask(ctx context.Context, client pb.TaskServiceClient) *pb.TaskResponse {
-	resp, err := client.Task(ctx, &pb.Empty{})
+// pollInterval is the pause after the orchestrator had no task for the worker
+const pollInterval = 1 * time.Second
+
+const healthCheckTimeout = 5 * time.Second
+
+var agentId string
+
+var agentMetrics = metrics.NewAgent(prometheus.DefaultRegisterer)
+
+// errQuarantined stops the agent, the orchestrator rejects its tasks and
+// results until an admin releases it.
+var errQuarantined = errors.New("agent is quarantined")
+
+// getTask returns the task together with response header carrying its trace.
+// Both are nil when there is no task ready.
+func getTask(ctx context.Context, client pb.TaskServiceClient, request *pb.TaskRequest) (*pb.TaskResponse, metadata.MD, error) {
+	var header metadata.MD
+	resp, err := client.Task(ctx, request, grpc.Header(&header))
 	if err != nil {
-		st, ok := status.FromError(err)
-		if !ok {
-			// Ошибка не является gRPC ошибкой
-			log.Fatalf("Unknown error: %v", err)
-		}
-		switch st.Code() {
-		case codes.NotFound:
-			return nil
-		default:
-			log.Printf("Error getting task: %v", err)
-			return nil
+		if status.Code(err) == codes.NotFound {
+			return nil, nil, nil
 		}
+		agentMetrics.Errors.WithLabelValues("get_task").Inc()
+		return nil, nil, err
 	}
 
-	return resp
+	return resp, header, nil
 }
 
-func computeTask(task *pb.TaskResponse) float64 {
-	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-
-	switch task.Operation {
-	case "+":
-		return task.Arg1 + task.Arg2
-	case "-":
-		return task.Arg1 - task.Arg2
-	case "*":
-		return task.Arg1 * task.Arg2
-	case "/":
-		return task.Arg1 / task.Arg2
-	default:
-		return 0
+// computeTask gives up with context.DeadlineExceeded once the deadline of the expression passes.
+func computeTask(ctx context.Context, operations *operation.Registry, task *pb.TaskResponse) (float64, error) {
+	if task.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(task.TimeoutMs)*time.Millisecond)
+		defer cancel()
 	}
+
+	delay := time.NewTimer(time.Duration(task.OperationTime) * time.Millisecond)
+	defer delay.Stop()
+	select {
+	case <-delay.C:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// custom operations may be removed meanwhile, so they are looked up right before the call
+	op, ok := operations.Get(task.Operation)
+	if !ok {
+		return 0, fmt.Errorf("unsupported operation %q", task.Operation)
+	}
+
+	return op.Compute(ctx, task.Arg1, task.Arg2)
 }
 
-func worker(ctx context.Context, client pb.TaskServiceClient) {
-	for {
-		task := getTask(ctx, client)
+func worker(ctx context.Context, stop context.CancelCauseFunc, client pb.TaskServiceClient, operations *operation.Registry, results *resultSender, retry *backoff) {
+	for ctx.Err() == nil {
+		// the operations change when custom ones are loaded
+		request := &pb.TaskRequest{Operations: operations.Names(), AgentId: agentId}
+		task, header, err := getTask(ctx, client, request)
+		if status.Code(err) == codes.PermissionDenied {
+			log.WithError(err).Error("Task refused, the agent is quarantined")
+			stop(errQuarantined)
+			return
+		}
+		if err != nil {
+			delay := retry.Next()
+			log.WithField("retry_in", delay.String()).WithError(err).Warn("Error getting task")
+			time.Sleep(delay)
+			continue
+		}
+		retry.Reset()
+
 		if task == nil {
-			time.Sleep(1 * time.Second)
+			time.Sleep(pollInterval)
 			continue
 		}
-		result := computeTask(task)
-		out := &pb.TaskResult{
-			Id:     task.Id,
-			Result: result,
+
+		taskCtx, span := tracing.Tracer().Start(tracing.Extract(ctx, header), "compute "+task.Operation,
+			trace.WithAttributes(attribute.String("task.id", task.Id)))
+
+		agentMetrics.BusyWorkers.Inc()
+		result, err := computeTask(taskCtx, operations, task)
+		agentMetrics.BusyWorkers.Dec()
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the expression timed out, nobody waits for the result
+			agentMetrics.Errors.WithLabelValues("deadline").Inc()
+			span.RecordError(err)
+			span.End()
+			log.WithField("task_id", task.Id).Info("Task abandoned after the deadline of its expression")
+			continue
 		}
-		_, err := client.CalculatedTask(ctx, out)
 		if err != nil {
-			log.Println("Error sending result:", err)
+			// the task is given to another agent after the redistribution delay
+			agentMetrics.Errors.WithLabelValues("compute").Inc()
+			span.RecordError(err)
+			span.End()
+			log.WithField("task_id", task.Id).WithError(err).Warn("Error computing task")
+			continue
 		}
+		agentMetrics.TasksComputed.WithLabelValues(task.Operation).Inc()
+
+		results.Add(pendingResult{
+			// the result is still sent while the agent shuts down
+			ctx:  context.WithoutCancel(taskCtx),
+			span: span,
+			result: &pb.TaskResult{
+				Id:     task.Id,
+				Result: result,
+			},
+		})
 	}
 }
 
 func main() {
-	ctx := context.Background()
-	cfg := config.InitConfig()
+	ctx, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	cfg := config.InitConfig(config.Agent)
+	logging.Setup(cfg)
+	if cfg.Agent.Id == "" {
+		cfg.Agent.Id = logging.DefaultAgentId()
+	}
+	agentId = cfg.Agent.Id
+	log.WithFields(log.Fields{
+		"agent_id":   agentId,
+		"operations": operation.Default.Names(),
+	}).Info("Starting agent")
+
+	shutdownTracing, err := tracing.Init(ctx, cfg, "calc-agent")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	grpcAddr := fmt.Sprintf("%s:%s", cfg.GetKey("CLIENT_GRPC_ARRT"), cfg.GetKey("CLIENT_GRPC_PORT"))
-	conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := grpcauth.ClientCredentials(cfg.Agent.TLS)
+	if err != nil {
+		log.Fatalf("Error loading TLS configuration: %v", err)
+	}
+
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor(), logging.UnaryClientInterceptor(cfg.Agent.Id)),
+		grpc.WithChainStreamInterceptor(logging.StreamClientInterceptor(cfg.Agent.Id)),
+	}
+	if cfg.Agent.Token != "" {
+		if !cfg.Agent.TLS.Enabled {
+			log.Warn("Sending the agent token without TLS")
+		}
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(grpcauth.TokenCredentials{Token: cfg.Agent.Token, Secure: cfg.Agent.TLS.Enabled}))
+	}
+
+	target, targetOptions := orchestratorTarget(&cfg.Agent)
+	conn, err := grpc.NewClient(target, append(dialOptions, targetOptions...)...)
 	if err != nil {
 		log.Println("could not connect to grpc server: ", err)
 		os.Exit(1)
@@ -86,15 +192,76 @@ func main() {
 	// закроем соединение, когда выйдем из функции
 	defer conn.Close()
 
+	if cfg.Agent.MetricsAddress != "" {
+		go startMetricsServer(cfg.Agent.MetricsAddress)
+	}
+
+	go watchConnection(ctx, conn)
+
+	newRetry := func() *backoff { return newBackoff(cfg.Agent.BackoffMin, cfg.Agent.BackoffMax) }
+	waitForOrchestrator(ctx, healthpb.NewHealthClient(conn), newRetry())
+
 	grpcClient := pb.NewTaskServiceClient(conn)
-	computingPower, _ := strconv.Atoi(cfg.GetKey("CLIENT_COMPUTING_POWER"))
-	if computingPower == 0 {
-		computingPower = 2
+	if interval := cfg.Agent.OperationsSyncInterval; interval > 0 {
+		limits := wasm.Limits{MemoryPages: uint32(cfg.Agent.WASMMemoryPages), Timeout: cfg.Agent.WASMTimeout}
+		custom := newCustomOperations(grpcClient, operation.Default, limits)
+		// workers advertise the custom operations from their first request
+		if err := custom.Sync(ctx); err != nil {
+			log.WithError(err).Warn("Error loading custom operations")
+		}
+		go custom.Run(ctx, interval)
+	}
+	results := newResultSender(grpcClient, cfg.Agent.ResultBuffer, newRetry(), stop)
+	go results.Run()
+	for i := 0; i < cfg.Agent.ComputingPower; i++ {
+		go worker(ctx, stop, grpcClient, operation.Default, results, newRetry())
 	}
 
-	for i := 0; i < computingPower; i++ {
-		go worker(ctx, grpcClient)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-quit:
+		log.Printf("Shutting down agent due to signal: %v", sig)
+	case <-ctx.Done():
+		log.WithError(context.Cause(ctx)).Error("Shutting down agent, an admin has to release it from quarantine")
 	}
+	// workers stop taking tasks, the computed results are still sent
+	stop(nil)
+	if pending := results.Drain(cfg.Agent.DrainTimeout); pending > 0 {
+		log.Warnf("%d computed results were not sent, their tasks will be given to another agent", pending)
+	}
+}
+
+// waitForOrchestrator blocks until the orchestrator reports the task service as serving.
+func waitForOrchestrator(ctx context.Context, client healthpb.HealthClient, retry *backoff) {
+	request := &healthpb.HealthCheckRequest{Service: pb.TaskService_ServiceDesc.ServiceName}
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		resp, err := client.Check(checkCtx, request)
+		cancel()
 
-	select {}
+		if err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING {
+			log.Println("Orchestrator is healthy, starting workers")
+			return
+		}
+
+		delay := retry.Next()
+		entry := log.WithField("retry_in", delay.String())
+		if err != nil {
+			entry.WithError(err).Info("Waiting for orchestrator")
+		} else {
+			entry.Infof("Waiting for orchestrator: status %s", resp.Status)
+		}
+		time.Sleep(delay)
+	}
+}
+
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("Metrics server listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Metrics server error: %v", err)
+	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/raikh/calc_micro_final/proto"
+)
+
+// pendingResult is a computed result together with the span of its computation.
+type pendingResult struct {
+	ctx    context.Context
+	span   trace.Span
+	result *pb.TaskResult
+}
+
+// resultSender submits results in the order they were computed and retries
+// every one of them until the orchestrator acknowledges it.
+type resultSender struct {
+	client  pb.TaskServiceClient
+	queue   chan pendingResult
+	backoff *backoff
+	// stop ends the agent once the orchestrator quarantines it
+	stop        context.CancelCauseFunc
+	quarantined atomic.Bool
+	// pending counts the buffered results and the one being sent
+	pending atomic.Int64
+}
+
+// drainPollInterval is how often Drain checks whether the buffer is empty.
+const drainPollInterval = 50 * time.Millisecond
+
+func newResultSender(client pb.TaskServiceClient, size int, retry *backoff, stop context.CancelCauseFunc) *resultSender {
+	return &resultSender{
+		client:  client,
+		queue:   make(chan pendingResult, size),
+		backoff: retry,
+		stop:    stop,
+	}
+}
+
+// Add blocks while the buffer is full, so workers stop taking new tasks.
+func (s *resultSender) Add(result pendingResult) {
+	agentMetrics.PendingResults.Inc()
+	s.pending.Add(1)
+	s.queue <- result
+}
+
+func (s *resultSender) Pending() int {
+	return int(s.pending.Load())
+}
+
+func (s *resultSender) Run() {
+	for result := range s.queue {
+		s.send(result)
+		s.pending.Add(-1)
+		agentMetrics.PendingResults.Dec()
+	}
+}
+
+// Drain waits until the buffered results are sent or the timeout passes and
+// returns how many of them are left.
+func (s *resultSender) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for s.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+
+	return s.Pending()
+}
+
+func (s *resultSender) send(pending pendingResult) {
+	defer pending.span.End()
+
+	for {
+		if s.quarantined.Load() {
+			// the orchestrator rejects every result of a quarantined agent
+			pending.span.SetStatus(codes.Error, errQuarantined.Error())
+			return
+		}
+
+		_, err := s.client.CalculatedTask(pending.ctx, pending.result)
+		switch status.Code(err) {
+		case grpcCodes.OK, grpcCodes.AlreadyExists:
+			// AlreadyExists means an earlier attempt was stored but its answer was lost
+			s.backoff.Reset()
+			return
+		case grpcCodes.NotFound, grpcCodes.InvalidArgument, grpcCodes.FailedPrecondition:
+			agentMetrics.Errors.WithLabelValues("send_result").Inc()
+			pending.span.SetStatus(codes.Error, err.Error())
+			log.WithField("task_id", pending.result.Id).WithError(err).Warn("Result rejected, dropping it")
+			return
+		case grpcCodes.PermissionDenied:
+			agentMetrics.Errors.WithLabelValues("send_result").Inc()
+			pending.span.SetStatus(codes.Error, err.Error())
+			log.WithField("task_id", pending.result.Id).WithError(err).Error("Result rejected, the agent is quarantined")
+			s.quarantined.Store(true)
+			s.stop(errQuarantined)
+			return
+		}
+
+		agentMetrics.Errors.WithLabelValues("send_result").Inc()
+		pending.span.RecordError(err)
+		delay := s.backoff.Next()
+		log.WithFields(log.Fields{
+			"task_id":  pending.result.Id,
+			"retry_in": delay.String(),
+		}).WithError(err).Warn("Error sending result")
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultServer = "http://localhost:1234"
+
+// settings are kept in the config file between runs.
+type settings struct {
+	Server    string     `json:"server"`
+	Email     string     `json:"email,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	APIKey    string     `json:"api_key,omitempty"`
+}
+
+// configPath returns the --config flag, $CALCCTL_CONFIG or the file in the user config directory.
+func configPath(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if path := os.Getenv("CALCCTL_CONFIG"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "calcctl", "config.json"), nil
+}
+
+// loadSettings returns empty settings when the file does not exist yet.
+func loadSettings(path string) (*settings, error) {
+	s := &settings{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// save writes the settings readable by the user only, they contain the token.
+func (s *settings) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// server returns the --server flag, $CALCCTL_SERVER, the stored server or the default one.
+func (s *settings) server(flagValue string) string {
+	switch {
+	case flagValue != "":
+		return flagValue
+	case os.Getenv("CALCCTL_SERVER") != "":
+		return os.Getenv("CALCCTL_SERVER")
+	case s.Server != "":
+		return s.Server
+	default:
+		return defaultServer
+	}
+}
@@ -0,0 +1,434 @@
+// Command calcctl calculates expressions with the orchestrator API from the
+// command line. Run calcctl help for the commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/raikh/calc_micro_final/api"
+	"github.com/raikh/calc_micro_final/client"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"login", "[--email EMAIL] [--password PASSWORD | --api-key KEY]", "log in and store the token in the config file", runLogin},
+		{"logout", "", "forget the stored token and API key", runLogout},
+		{"calc", "EXPRESSION [--wait] [--timeout 10s] [--priority N] [--strict-order] [--no-cache]", "submit an expression", runCalc},
+		{"ls", "[--status STATUS]", "list expressions", runList},
+		{"show", "ID [--tasks]", "show an expression and its tasks", runShow},
+		{"repl", "[--timeout 10s] [--priority N] [--strict-order] [--no-cache] [--history FILE]", "calculate expressions interactively", runREPL},
+	}
+}
+
+// statusError is returned when a waited expression is not completed.
+type statusError struct {
+	expression api.Expression
+}
+
+func (e *statusError) Error() string {
+	if e.expression.FailureReason != "" {
+		return fmt.Sprintf("expression %s is %s: %s", e.expression.Id, e.expression.Status, e.expression.FailureReason)
+	}
+	return fmt.Sprintf("expression %s is %s", e.expression.Id, e.expression.Status)
+}
+
+func main() {
+	c := &cli{stdin: bufio.NewReader(os.Stdin), stdout: os.Stdout, stderr: os.Stderr}
+
+	err := c.run(os.Args[1:])
+	if err == nil {
+		return
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+
+	fmt.Fprintln(os.Stderr, "calcctl:", describe(err))
+	var failed *statusError
+	if errors.As(err, &failed) {
+		os.Exit(3)
+	}
+	os.Exit(1)
+}
+
+// describe adds a hint to errors a user can fix.
+func describe(err error) string {
+	var apiErr *client.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized:
+		return err.Error() + " (run calcctl login)"
+	case errors.As(err, &apiErr) && apiErr.RetryAfter > 0:
+		return fmt.Sprintf("%v (retry in %s)", err, apiErr.RetryAfter)
+	case errors.Is(err, client.ErrNoCredentials):
+		return "not logged in (run calcctl login)"
+	}
+	return err.Error()
+}
+
+// cli holds what every command needs.
+type cli struct {
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	configFlag string
+	serverFlag string
+	output     string
+
+	configPath string
+	settings   *settings
+}
+
+func (c *cli) run(args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage()
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(c, args[1:])
+		}
+	}
+
+	c.usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func (c *cli) usage() {
+	fmt.Fprintln(c.stderr, "Usage: calcctl COMMAND [ARGS] [--server URL] [--config FILE] [-o table|json]")
+	fmt.Fprintln(c.stderr)
+	fmt.Fprintln(c.stderr, "Commands:")
+	rows := [][]string{}
+	for _, cmd := range commands {
+		rows = append(rows, []string{"  " + cmd.name, cmd.summary})
+	}
+	table(c.stderr, rows)
+	fmt.Fprintln(c.stderr)
+	fmt.Fprintln(c.stderr, "Run calcctl COMMAND --help for its flags.")
+}
+
+// flags returns the flag set of the command with the flags common to all commands.
+func (c *cli) flags(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(&c.configFlag, "config", "", "config file, $CALCCTL_CONFIG or calcctl/config.json in the user config directory by default")
+	fs.StringVar(&c.serverFlag, "server", "", "orchestrator URL, $CALCCTL_SERVER or the one used to log in by default")
+	fs.StringVar(&c.output, "o", outputTable, "output format: table or json")
+	fs.StringVar(&c.output, "output", outputTable, "output format: table or json")
+	fs.Usage = func() {
+		for _, command := range commands {
+			if command.name == cmd {
+				fmt.Fprintf(c.stderr, "Usage: calcctl %s %s\n\n%s\n\nFlags:\n", cmd, command.args, command.summary)
+			}
+		}
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// parse accepts flags before and after the positional arguments, which are
+// returned. Arguments after -- are never flags, e.g. calcctl calc -- -1+2.
+func (c *cli) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	if i := slices.Index(args, "--"); i >= 0 {
+		args, rest = args[:i], args[i+1:]
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if c.output != outputTable && c.output != outputJSON {
+		return nil, fmt.Errorf("unknown output format %q", c.output)
+	}
+
+	path, err := configPath(c.configFlag)
+	if err != nil {
+		return nil, err
+	}
+	c.configPath = path
+	if c.settings, err = loadSettings(path); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return append(positional, rest...), nil
+}
+
+func (c *cli) client(opts ...client.Option) *client.Client {
+	s := c.settings
+	switch {
+	case s.APIKey != "":
+		opts = append(opts, client.WithAPIKey(s.APIKey))
+	case s.Token != "":
+		var expiresAt time.Time
+		if s.ExpiresAt != nil {
+			expiresAt = *s.ExpiresAt
+		}
+		opts = append(opts, client.WithToken(s.Token, expiresAt))
+	}
+
+	return client.New(s.server(c.serverFlag), opts...)
+}
+
+// prompt reads a line from the standard input.
+func (c *cli) prompt(label string) (string, error) {
+	fmt.Fprint(c.stderr, label)
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// interruptible returns a context cancelled by Ctrl-C.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func runLogin(c *cli, args []string) error {
+	fs := c.flags("login")
+	email := fs.String("email", "", "email of the user, asked when not set")
+	password := fs.String("password", "", "password, $CALCCTL_PASSWORD or asked when not set")
+	apiKey := fs.String("api-key", "", "store an API key instead of logging in")
+	if _, err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	s := c.settings
+	s.Server = s.server(c.serverFlag)
+
+	if *apiKey != "" {
+		s.APIKey, s.Token, s.ExpiresAt = *apiKey, "", nil
+		if _, err := c.client().List(ctx); err != nil {
+			return err
+		}
+		if err := s.save(c.configPath); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "API key stored for %s\n", s.Server)
+		return nil
+	}
+
+	if _, err := c.login(ctx, *email, *password); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Logged in to %s as %s, the token expires at %s\n", s.Server, s.Email, formatTime(s.ExpiresAt))
+
+	return nil
+}
+
+// login asks the missing credentials and stores the token. The returned client
+// logs in again with the same credentials when the token expires.
+func (c *cli) login(ctx context.Context, email string, password string) (*client.Client, error) {
+	s := c.settings
+	s.Server = s.server(c.serverFlag)
+
+	var err error
+	if email == "" {
+		label := "Email: "
+		if s.Email != "" {
+			label = fmt.Sprintf("Email [%s]: ", s.Email)
+		}
+		if email, err = c.prompt(label); err != nil {
+			return nil, err
+		}
+		if email == "" {
+			email = s.Email
+		}
+	}
+	if password == "" {
+		password = os.Getenv("CALCCTL_PASSWORD")
+	}
+	if password == "" {
+		if password, err = c.prompt("Password: "); err != nil {
+			return nil, err
+		}
+	}
+
+	var saveErr error
+	cl := client.New(s.Server, client.WithCredentials(email, password), client.WithTokenCallback(func(token api.TokenResponse) {
+		s.Email, s.Token, s.ExpiresAt, s.APIKey = email, token.Token, token.ExpiresAt, ""
+		saveErr = s.save(c.configPath)
+	}))
+	if _, err := cl.Login(ctx); err != nil {
+		return nil, err
+	}
+
+	return cl, saveErr
+}
+
+func runLogout(c *cli, args []string) error {
+	if _, err := c.parse(c.flags("logout"), args); err != nil {
+		return err
+	}
+
+	c.settings.Token, c.settings.ExpiresAt, c.settings.APIKey = "", nil, ""
+	return c.settings.save(c.configPath)
+}
+
+func runCalc(c *cli, args []string) error {
+	fs := c.flags("calc")
+	wait := fs.Bool("wait", false, "wait for the result")
+	timeout := fs.Duration("timeout", 0, "time to compute the expression, it times out afterwards")
+	priority := fs.Int("priority", 0, "priority from 0 to 9, capped by the role of the user")
+	strictOrder := fs.Bool("strict-order", false, "keep the order of evaluation as written")
+	noCache := fs.Bool("no-cache", false, "compute every operation anew")
+	positional, err := c.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cl := c.client()
+	submitted, err := cl.Submit(ctx, api.ExpressionRequest{
+		Expression:  strings.Join(positional, " "),
+		Priority:    *priority,
+		StrictOrder: *strictOrder,
+		NoCache:     *noCache,
+		TimeoutMs:   timeout.Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if !*wait {
+		if c.output == outputJSON {
+			return writeJSON(c.stdout, submitted)
+		}
+		fmt.Fprintln(c.stdout, submitted.Id)
+		return nil
+	}
+
+	expression, err := cl.Wait(ctx, submitted.Id)
+	if err != nil {
+		return err
+	}
+
+	if c.output == outputJSON {
+		if err := writeJSON(c.stdout, expression); err != nil {
+			return err
+		}
+	} else if expression.Status == api.StatusCompleted {
+		fmt.Fprintln(c.stdout, formatNumber(expression.Result))
+	}
+	if expression.Status != api.StatusCompleted {
+		return &statusError{expression}
+	}
+
+	return nil
+}
+
+func runList(c *cli, args []string) error {
+	fs := c.flags("ls")
+	status := fs.String("status", "", "show only expressions with the status: pending, completed, failed or timed_out")
+	if _, err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	expressions, err := c.client().List(ctx)
+	if err != nil {
+		return err
+	}
+	if *status != "" {
+		expressions = slices.DeleteFunc(expressions, func(e api.Expression) bool {
+			return e.Status != *status
+		})
+	}
+
+	if c.output == outputJSON {
+		return writeJSON(c.stdout, api.ExpressionsResponse{Expressions: expressions})
+	}
+	return table(c.stdout, expressionRows(expressions))
+}
+
+func runShow(c *cli, args []string) error {
+	fs := c.flags("show")
+	withTasks := fs.Bool("tasks", false, "show the tasks of the expression")
+	positional, err := c.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cl := c.client()
+	expression, err := cl.Get(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+
+	var tasks []api.Task
+	if *withTasks {
+		if tasks, err = cl.Tasks(ctx, expression.Id); err != nil {
+			return err
+		}
+	}
+
+	if c.output == outputJSON {
+		if !*withTasks {
+			return writeJSON(c.stdout, expression)
+		}
+		return writeJSON(c.stdout, struct {
+			api.Expression
+			Tasks []api.Task `json:"tasks"`
+		}{expression, tasks})
+	}
+
+	if err := table(c.stdout, expressionDetails(expression)); err != nil {
+		return err
+	}
+	if *withTasks {
+		fmt.Fprintln(c.stdout)
+		return table(c.stdout, taskRows(tasks))
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/raikh/calc_micro_final/api"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func writeJSON(w io.Writer, value any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// table writes rows aligned in columns, the first row is the header.
+func table(w io.Writer, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func formatNumber(value *float64) string {
+	if value == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
+
+func formatTime(value *time.Time) string {
+	if value == nil {
+		return "-"
+	}
+	return value.Local().Format(time.DateTime)
+}
+
+func expressionRows(expressions []api.Expression) [][]string {
+	rows := [][]string{{"ID", "STATUS", "RESULT", "EXPRESSION", "CREATED"}}
+	for _, e := range expressions {
+		rows = append(rows, []string{e.Id, e.Status, formatNumber(e.Result), e.Expression, formatTime(e.CreatedAt)})
+	}
+	return rows
+}
+
+// expressionDetails lists the fields of a single expression one per line.
+func expressionDetails(e api.Expression) [][]string {
+	rows := [][]string{
+		{"ID:", e.Id},
+		{"Expression:", e.Expression},
+		{"Status:", e.Status},
+		{"Result:", formatNumber(e.Result)},
+		{"Priority:", strconv.Itoa(e.Priority)},
+		{"Created:", formatTime(e.CreatedAt)},
+		{"Updated:", formatTime(e.UpdatedAt)},
+	}
+	if e.Deadline != nil {
+		rows = append(rows, []string{"Deadline:", formatTime(e.Deadline)})
+	}
+	if e.FailureReason != "" {
+		rows = append(rows, []string{"Failure:", e.FailureReason})
+	}
+	return rows
+}
+
+func taskRows(tasks []api.Task) [][]string {
+	rows := [][]string{{"ID", "OPERATION", "ARG1", "ARG2", "RESULT", "STATUS", "ATTEMPTS"}}
+	for _, t := range tasks {
+		rows = append(rows, []string{t.Id, t.Operation, formatNumber(t.Arg1), formatNumber(t.Arg2),
+			formatNumber(t.Result), t.Status, strconv.Itoa(t.Attempts)})
+	}
+	return rows
+}
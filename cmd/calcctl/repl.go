@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raikh/calc_micro_final/api"
+	"github.com/raikh/calc_micro_final/client"
+)
+
+// maxHistory is how many evaluated expressions the history file keeps.
+const maxHistory = 1000
+
+// reference is a result of an earlier expression, e.g. $2.
+var reference = regexp.MustCompile(`\$(\d+)`)
+
+// historyEntry is an evaluated expression, later expressions refer to its result as $N.
+type historyEntry struct {
+	N          int    `json:"n"`
+	Expression string `json:"expression"`
+	// Submitted is the expression with the references replaced by results
+	Submitted string   `json:"submitted,omitempty"`
+	Id        string   `json:"id"`
+	Status    string   `json:"status"`
+	Result    *float64 `json:"result,omitempty"`
+}
+
+type repl struct {
+	c       *cli
+	client  *client.Client
+	request api.ExpressionRequest
+	// progress shows the tasks of the waited expression, only on a terminal
+	progress bool
+
+	historyPath string
+	history     []historyEntry
+}
+
+func runREPL(c *cli, args []string) error {
+	fs := c.flags("repl")
+	timeout := fs.Duration("timeout", 0, "time to compute every expression, it times out afterwards")
+	priority := fs.Int("priority", 0, "priority from 0 to 9, capped by the role of the user")
+	strictOrder := fs.Bool("strict-order", false, "keep the order of evaluation as written")
+	noCache := fs.Bool("no-cache", false, "compute every operation anew")
+	historyPath := fs.String("history", "", "history file, history.jsonl next to the config file by default")
+	if _, err := c.parse(fs, args); err != nil {
+		return err
+	}
+
+	r := &repl{
+		c: c,
+		request: api.ExpressionRequest{
+			Priority:    *priority,
+			StrictOrder: *strictOrder,
+			NoCache:     *noCache,
+			TimeoutMs:   timeout.Milliseconds(),
+		},
+		progress:    isTerminal(os.Stderr),
+		historyPath: *historyPath,
+	}
+	if r.historyPath == "" {
+		r.historyPath = filepath.Join(filepath.Dir(c.configPath), "history.jsonl")
+	}
+
+	var err error
+	if r.history, err = loadHistory(r.historyPath); err != nil {
+		return fmt.Errorf("reading %s: %w", r.historyPath, err)
+	}
+	if err := r.connect(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stderr, "Connected to %s. Refer to earlier results as $1, $2, type :help for the commands.\n", c.settings.server(c.serverFlag))
+	for {
+		line, err := c.prompt("calc> ")
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(c.stderr)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, ":"):
+			quit, err := r.command(line)
+			if err != nil {
+				fmt.Fprintln(c.stderr, "error:", r.describe(err))
+			}
+			if quit {
+				return nil
+			}
+		default:
+			if err := r.evaluate(line); err != nil {
+				fmt.Fprintln(c.stderr, "error:", r.describe(err))
+			}
+		}
+	}
+}
+
+// connect uses the stored token or API key and logs in when there is none.
+func (r *repl) connect() error {
+	s := r.c.settings
+	valid := s.ExpiresAt == nil || time.Until(*s.ExpiresAt) > time.Minute
+	if s.APIKey != "" || (s.Token != "" && valid) {
+		r.client = r.c.client()
+		return nil
+	}
+
+	return r.login()
+}
+
+func (r *repl) login() error {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	cl, err := r.c.login(ctx, "", "")
+	if err != nil {
+		return err
+	}
+	r.client = cl
+
+	return nil
+}
+
+// describe points to :login instead of calcctl login.
+func (r *repl) describe(err error) string {
+	return strings.ReplaceAll(describe(err), "run calcctl login", "type :login")
+}
+
+const replHelp = `Type an expression to calculate it, e.g. 2*(3+4) or $1/2 with the result of the first one.
+Ctrl-C stops waiting, the expression is still calculated and its result can be referred to later.
+
+Commands:
+  :history      list the expressions and their results
+  :tasks N      show the tasks of the expression $N
+  :login        log in again
+  :help         show this help
+  :quit         leave, Ctrl-D too
+`
+
+// command runs a line starting with a colon and tells whether to quit.
+func (r *repl) command(line string) (bool, error) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ":quit", ":q", ":exit":
+		return true, nil
+	case ":help", ":h":
+		fmt.Fprint(r.c.stderr, replHelp)
+	case ":history":
+		rows := [][]string{{"N", "STATUS", "RESULT", "EXPRESSION"}}
+		for _, entry := range r.history {
+			rows = append(rows, []string{"$" + strconv.Itoa(entry.N), entry.Status, formatNumber(entry.Result), entry.Expression})
+		}
+		return false, table(r.c.stdout, rows)
+	case ":tasks":
+		if len(fields) != 2 {
+			return false, errors.New("usage: :tasks N")
+		}
+		return false, r.showTasks(strings.TrimPrefix(fields[1], "$"))
+	case ":login":
+		return false, r.login()
+	default:
+		return false, fmt.Errorf("unknown command %s, type :help for the commands", fields[0])
+	}
+
+	return false, nil
+}
+
+func (r *repl) showTasks(n string) error {
+	entry, err := r.entry(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	tasks, err := r.client.Tasks(ctx, entry.Id)
+	if err != nil {
+		return err
+	}
+
+	if r.c.output == outputJSON {
+		return writeJSON(r.c.stdout, api.TasksResponse{Tasks: tasks})
+	}
+	return table(r.c.stdout, taskRows(tasks))
+}
+
+// evaluate submits the expression and waits for it showing the progress of its tasks.
+func (r *repl) evaluate(line string) error {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	expression, err := r.substitute(ctx, line)
+	if err != nil {
+		return err
+	}
+
+	req := r.request
+	req.Expression = expression
+	submitted, err := r.client.Submit(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	entry := historyEntry{N: r.next(), Expression: line, Id: submitted.Id, Status: api.StatusPending}
+	if expression != line {
+		entry.Submitted = expression
+	}
+
+	progress := &progressLine{w: r.c.stderr}
+	result, err := r.client.WaitProgress(ctx, submitted.Id, func(e api.Expression) {
+		if r.progress && !e.Done() {
+			r.showProgress(ctx, progress, e)
+		}
+	})
+	progress.clear()
+
+	interrupted := errors.Is(err, context.Canceled)
+	if result.Status != "" {
+		entry.Status, entry.Result = result.Status, result.Result
+	}
+	if err := r.add(entry); err != nil {
+		fmt.Fprintln(r.c.stderr, "error:", err)
+	}
+	if interrupted {
+		fmt.Fprintf(r.c.stderr, "$%d is still calculated, id %s\n", entry.N, entry.Id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.c.output == outputJSON {
+		return writeJSON(r.c.stdout, result)
+	}
+	switch result.Status {
+	case api.StatusCompleted:
+		fmt.Fprintf(r.c.stdout, "$%d = %s\n", entry.N, formatNumber(result.Result))
+	case api.StatusFailed:
+		fmt.Fprintf(r.c.stdout, "$%d failed: %s\n", entry.N, result.FailureReason)
+	default:
+		fmt.Fprintf(r.c.stdout, "$%d is %s\n", entry.N, result.Status)
+	}
+
+	return nil
+}
+
+func (r *repl) showProgress(ctx context.Context, progress *progressLine, e api.Expression) {
+	tasks, err := r.client.Tasks(ctx, e.Id)
+	if err != nil || len(tasks) == 0 {
+		return
+	}
+
+	counts := map[string]int{}
+	for _, task := range tasks {
+		counts[task.Status]++
+	}
+
+	const width = 20
+	done := counts[api.TaskCompleted] * width / len(tasks)
+	text := fmt.Sprintf("[%s%s] %d/%d tasks, %d processing", strings.Repeat("#", done), strings.Repeat(".", width-done),
+		counts[api.TaskCompleted], len(tasks), counts[api.TaskProcessing])
+	if counts[api.TaskDeadLetter] > 0 {
+		text += fmt.Sprintf(", %d dead-lettered", counts[api.TaskDeadLetter])
+	}
+	progress.show(text)
+}
+
+// substitute replaces the references to earlier results with the numbers.
+func (r *repl) substitute(ctx context.Context, line string) (string, error) {
+	var failed error
+	expression := reference.ReplaceAllStringFunc(line, func(ref string) string {
+		if failed != nil {
+			return ref
+		}
+		value, err := r.value(ctx, ref[1:])
+		if err != nil {
+			failed = err
+			return ref
+		}
+		return value
+	})
+
+	return expression, failed
+}
+
+// value returns the result of the expression $n as it can be written in an
+// expression: without an exponent and negative numbers subtracted from zero.
+func (r *repl) value(ctx context.Context, n string) (string, error) {
+	entry, err := r.entry(n)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.Status == api.StatusPending {
+		// interrupted earlier, it may be done by now
+		expression, err := r.client.Get(ctx, entry.Id)
+		if err != nil {
+			return "", err
+		}
+		entry.Status, entry.Result = expression.Status, expression.Result
+	}
+
+	switch {
+	case entry.Status == api.StatusPending:
+		return "", fmt.Errorf("$%d is still calculated", entry.N)
+	case entry.Result == nil:
+		return "", fmt.Errorf("$%d has no result, it is %s", entry.N, entry.Status)
+	case math.IsInf(*entry.Result, 0) || math.IsNaN(*entry.Result):
+		return "", fmt.Errorf("$%d is not a finite number", entry.N)
+	}
+
+	value := strconv.FormatFloat(math.Abs(*entry.Result), 'f', -1, 64)
+	if *entry.Result < 0 {
+		return "(0-" + value + ")", nil
+	}
+	return value, nil
+}
+
+func (r *repl) entry(n string) (*historyEntry, error) {
+	number, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference $%s", n)
+	}
+	for i := range r.history {
+		if r.history[i].N == number {
+			return &r.history[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("there is no $%d", number)
+}
+
+func (r *repl) next() int {
+	if len(r.history) == 0 {
+		return 1
+	}
+	return r.history[len(r.history)-1].N + 1
+}
+
+// add appends the entry to the history and its file.
+func (r *repl) add(entry historyEntry) error {
+	r.history = append(r.history, entry)
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// loadHistory reads the last entries of the file and drops the older ones from it.
+func loadHistory(path string) ([]historyEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var history []historyEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(history) <= maxHistory {
+		return history, nil
+	}
+	history = history[len(history)-maxHistory:]
+
+	var data []byte
+	for _, entry := range history {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	return history, os.WriteFile(path, data, 0o600)
+}
+
+// progressLine is a status line rewritten in place.
+type progressLine struct {
+	w     io.Writer
+	shown bool
+}
+
+func (p *progressLine) show(text string) {
+	fmt.Fprint(p.w, "\r\033[K"+text)
+	p.shown = true
+}
+
+func (p *progressLine) clear() {
+	if p.shown {
+		fmt.Fprint(p.w, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// isTerminal tells whether the file is a terminal rather than a pipe or a file.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
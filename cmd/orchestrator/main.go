@@ -2,41 +2,60 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/raikh/calc_micro_final/internal/app"
 	"github.com/raikh/calc_micro_final/internal/config"
 	"github.com/raikh/calc_micro_final/internal/database"
+	"github.com/raikh/calc_micro_final/internal/grpcauth"
+	"github.com/raikh/calc_micro_final/internal/logging"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/internal/operation"
+	// operations computed by the planner when constant folding is enabled
+	_ "github.com/raikh/calc_micro_final/internal/operation/arithmetic"
+	"github.com/raikh/calc_micro_final/internal/planner"
+	"github.com/raikh/calc_micro_final/internal/quota"
+	"github.com/raikh/calc_micro_final/internal/resultcache"
 	"github.com/raikh/calc_micro_final/internal/router"
+	"github.com/raikh/calc_micro_final/internal/tracing"
 	"github.com/raikh/calc_micro_final/model"
 	pb "github.com/raikh/calc_micro_final/proto"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-type TaskServer struct {
-	pb.UnimplementedTaskServiceServer
-	Config *config.Config
-}
+var taskServiceName = pb.TaskService_ServiceDesc.ServiceName
 
-func NewServer(cfg *config.Config) *TaskServer {
-	return &TaskServer{Config: cfg}
-}
+const databaseCheckInterval = 5 * time.Second
+
+// deadlineCheckInterval is how often pending expressions are checked against their deadlines
+const deadlineCheckInterval = time.Second
 
 func main() {
 	done := make(chan error, 2)
 
 	ctx := context.Background()
 	app := SetUp(ctx)
-	go startGRPCServer(app.Cfg, done)
-	go startHTTPServer(app.Cfg, done)
+
+	shutdownTracing, err := tracing.Init(ctx, app.Cfg, "calc-orchestrator")
+	if err != nil {
+		log.Fatalf("Error initializing tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	go timeOutExpressions(app.Expressions)
+	go startGRPCServer(app, done)
+	go startHTTPServer(app, done)
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -44,9 +63,12 @@ func main() {
 
 	select {
 	case err := <-done:
+		shutdownTracing(context.Background())
 		log.Fatalf("server error: %v", err)
 	case sig := <-quit:
 		log.Printf("Shutting down servers due to signal: %v", sig)
+		// agents stop taking tasks from this orchestrator
+		app.GRPCHealth.Shutdown()
 		// For graceful shutdown, you can add additional cleanup logic here if needed
 		// For example, you can close database connections, release resources, etc.
 		// Close the database connection
@@ -55,50 +77,103 @@ func main() {
 
 func SetUp(ctx context.Context) *app.App {
 	application := new(app.App)
-	application.Cfg = config.InitConfig()
-	application.DB = database.InitDB(ctx, application.Cfg)
-	return application
-}
+	application.Cfg = config.InitConfig(config.Orchestrator)
+	logging.Setup(application.Cfg)
+	application.Metrics = metrics.NewOrchestrator(prometheus.DefaultRegisterer)
+
+	// not serving until the gRPC listener is open
+	application.GRPCHealth = grpchealth.NewServer()
+	application.GRPCHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	application.GRPCHealth.SetServingStatus(taskServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
 
-func areDependenciesCompleted(task *model.Task) bool {
-	if task.Dependencies == nil {
-		return true
+	var repositories model.Repositories
+	if application.Cfg.DB.Type == "memory" {
+		log.Println("Using in-memory storage, data will be lost on restart")
+		repositories = model.NewMemoryRepositories()
+	} else {
+		application.DB = database.InitDB(ctx, application.Cfg)
+		repositories = model.NewSQLRepositories(application.DB, database.GetDialect())
 	}
 
-	dependentTasks, _ := model.GetTasksByIds(task.Dependencies)
-	for idx, depTask := range dependentTasks {
-		if !depTask.Completed {
-			return false
-		}
-		updateTaskByDependency(task, idx, depTask.Result)
+	application.Users = repositories.Users
+	application.Expressions = repositories.Expressions
+	application.Tasks = repositories.Tasks
+	application.OperationTimes = repositories.OperationTimes
+	application.CustomOperations = repositories.CustomOperations
+	application.APIKeys = repositories.APIKeys
+	application.UserQuotas = repositories.Quotas
+	application.Replicas = repositories.Replicas
+	application.Agents = repositories.Agents
+	if size := application.Cfg.ResultCache.Size; size > 0 {
+		application.ResultCache = resultcache.New(size, application.Cfg.ResultCache.TTL)
+	}
+	application.Planner = newPlanner(application)
+	application.Quotas = quota.NewService(application.Cfg.Quota, repositories.Quotas, repositories.Expressions)
+
+	if err := application.OperationTimes.SeedDefaults(defaultOperationTimes(application.Cfg)); err != nil {
+		log.Fatalf("Error seeding operation times: %v", err)
+	}
+	promoteAdmins(application.Users, application.Cfg.AdminEmails)
+	// results are passed to waiting tasks on completion, older tasks get them once here
+	if filled, err := application.Tasks.FillArguments(); err != nil {
+		log.Fatalf("Error filling task arguments: %v", err)
+	} else if filled > 0 {
+		log.Printf("Filled arguments of %d waiting tasks", filled)
 	}
 
-	return true
+	return application
 }
 
-func updateTaskByDependency(task *model.Task, index int, value *float64) {
-	depsCount := len(task.Dependencies)
-	if depsCount == 1 {
-		if task.Arg1 == nil && *task.Arg2 != 0 {
-			task.Arg1 = value
-		} else {
-			task.Arg2 = value
+// promoteAdmins gives the admin role to the registered users with the emails.
+// Registration never grants it, anyone could register the email first.
+func promoteAdmins(users model.UserRepository, emails []string) {
+	for _, email := range emails {
+		user, err := users.GetByEmail(email)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Id == 0) {
+			log.Warnf("Admin %s is not registered, restart after registering the email", email)
+			continue
 		}
-	} else if depsCount == 2 {
-		if index == 0 {
-			task.Arg1 = value
-		} else {
-			if task.Arg1 == nil && *task.Arg2 != 0 {
-				task.Arg1 = value
-			} else {
-				task.Arg2 = value
-			}
+		if err != nil {
+			log.Fatalf("Error loading admin %s: %v", email, err)
+		}
+		if user.IsAdmin() {
+			continue
+		}
+
+		if err := users.SetRole(user.Id, model.RoleAdmin); err != nil {
+			log.Fatalf("Error promoting admin %s: %v", email, err)
 		}
+		log.Printf("User %s is promoted to admin", email)
 	}
 }
 
-func startGRPCServer(cfg *config.Config, done chan<- error) {
-	grpcAddr := fmt.Sprintf("%s:%s", cfg.GetKey("APP_LISTENING_ADDRESS"), cfg.GetKey("APP_GRPC_LISTEN_PORT"))
+func newPlanner(application *app.App) *planner.Planner {
+	cfg := application.Cfg
+	taskPlanner := &planner.Planner{Share: cfg.Planner.ShareSubexpressions, Rebalance: cfg.Planner.Rebalance}
+	if cfg.Planner.FoldConstants {
+		// only the built-in operations, custom ones run in agents
+		taskPlanner.Fold = operation.Default
+	}
+	if application.ResultCache != nil {
+		taskPlanner.Cache = application.ResultCache
+	}
+
+	return taskPlanner
+}
+
+// defaultOperationTimes are used until an admin changes them through the API.
+func defaultOperationTimes(cfg *config.Config) map[string]int64 {
+	return map[string]int64{
+		"+": cfg.OperationTimes.Addition.Milliseconds(),
+		"-": cfg.OperationTimes.Subtraction.Milliseconds(),
+		"*": cfg.OperationTimes.Multiplication.Milliseconds(),
+		"/": cfg.OperationTimes.Division.Milliseconds(),
+	}
+}
+
+func startGRPCServer(application *app.App, done chan<- error) {
+	cfg := application.Cfg
+	grpcAddr := fmt.Sprintf("%s:%d", cfg.ListenAddress, cfg.GRPCPort)
 	grpcLis, err := net.Listen("tcp", grpcAddr)
 
 	if err != nil {
@@ -106,65 +181,95 @@ func startGRPCServer(cfg *config.Config, done chan<- error) {
 		os.Exit(1)
 	}
 
-	grpcServer := grpc.NewServer()
-	taskServer := NewServer(cfg)
+	unaryInterceptors := []grpc.UnaryServerInterceptor{tracing.UnaryServerInterceptor(), logging.UnaryServerInterceptor()}
+	streamInterceptors := []grpc.StreamServerInterceptor{logging.StreamServerInterceptor()}
+	if len(cfg.AgentTokens) > 0 {
+		authenticator := grpcauth.NewAuthenticator(cfg.AgentTokens)
+		unaryInterceptors = append(unaryInterceptors, authenticator.UnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, authenticator.StreamServerInterceptor())
+	} else {
+		log.Warn("APP_AGENT_TOKENS is empty, any client can take tasks and send results")
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	creds, err := grpcauth.ServerCredentials(cfg.GRPCTLS)
+	if err != nil {
+		done <- err
+		return
+	}
+	if creds != nil {
+		serverOptions = append(serverOptions, grpc.Creds(creds))
+	}
+
+	grpcServer := grpc.NewServer(serverOptions...)
+	taskServer := NewServer(application)
 	pb.RegisterTaskServiceServer(grpcServer, taskServer)
+	healthpb.RegisterHealthServer(grpcServer, application.GRPCHealth)
+	prometheus.MustRegister(metrics.NewStateCollector(application.Expressions.CountByStatus, taskServer.countReadyTasks))
+
+	setServing(application.GRPCHealth, true)
+	if application.DB != nil {
+		go watchDatabase(application)
+	}
 
 	log.Printf("gRPC server listening on %s", grpcAddr)
 
 	done <- grpcServer.Serve(grpcLis)
 }
 
-func startHTTPServer(cfg *config.Config, done chan<- error) {
-	done <- router.InitRouter(cfg)
-}
-
-func (ts *TaskServer) Task(ctx context.Context, req *pb.Empty) (*pb.TaskResponse, error) {
-	redistributionDelay := ts.Config.GetKey("TIME_TASK_IN_PROGRESS_REDISTRIBUTE")
-	delay, err := strconv.Atoi(redistributionDelay)
-	if err != nil {
-		delay = 60
-	}
-	tasks, _ := model.GetTasksForProcessing(delay)
-	for _, task := range tasks {
-		if !task.Completed && areDependenciesCompleted(&task) {
-			task.IsProcessing = true
-			task.Update()
-
-			w := &pb.TaskResponse{
-				Id:            task.Id,
-				Arg1:          *task.Arg1,
-				Arg2:          *task.Arg2,
-				Operation:     task.Operation,
-				OperationTime: task.OperationTime,
-			}
-			return w, nil
-		}
+func setServing(server *grpchealth.Server, serving bool) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if !serving {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
 	}
-	return nil, status.Error(codes.NotFound, "object not found")
+	server.SetServingStatus("", status)
+	server.SetServingStatus(taskServiceName, status)
 }
 
-func (ts *TaskServer) CalculatedTask(ctx context.Context, calculatedTask *pb.TaskResult) (*pb.Empty, error) {
+// watchDatabase reports the task service as not serving while the database is
+// unreachable, so agents do not take tasks which cannot be stored.
+func watchDatabase(application *app.App) {
+	ticker := time.NewTicker(databaseCheckInterval)
+	defer ticker.Stop()
 
-	task, err := model.GetTaskById(calculatedTask.Id)
-	if err != nil {
-		return &pb.Empty{}, status.Error(codes.NotFound, "Task not found")
-	}
+	healthy := true
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), databaseCheckInterval)
+		err := application.DB.PingContext(ctx)
+		cancel()
 
-	if task.Completed {
-		return &pb.Empty{}, status.Error(codes.AlreadyExists, "Task already completed")
+		if (err == nil) != healthy {
+			healthy = err == nil
+			if healthy {
+				log.Println("Database is reachable again")
+			} else {
+				log.Printf("Database is unreachable: %v", err)
+			}
+			setServing(application.GRPCHealth, healthy)
+		}
 	}
+}
 
-	task.Result = &calculatedTask.Result
-	task.Completed = true
-	task.Update()
+// timeOutExpressions marks expressions past their deadline, their tasks are not given to agents anymore.
+func timeOutExpressions(expressions model.ExpressionRepository) {
+	ticker := time.NewTicker(deadlineCheckInterval)
+	defer ticker.Stop()
 
-	if model.IsAllTasksCompleted(task.ExpressionId) {
-		expression, _ := model.GetExpressionById(task.ExpressionId)
-		expression.Result = task.Result
-		expression.Status = "completed"
-		expression.Update()
+	for range ticker.C {
+		count, err := expressions.TimeOutExpired()
+		if err != nil {
+			log.Printf("Error timing out expressions: %v", err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("%d expressions timed out", count)
+		}
 	}
+}
 
-	return &pb.Empty{}, nil
+func startHTTPServer(application *app.App, done chan<- error) {
+	done <- router.InitRouter(application)
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// candidate is a ready task with what the scheduler needs to know about its expression.
+type candidate struct {
+	task   model.Task
+	userId int64
+	// weight is the share of the agents of the user, by the role
+	weight   int
+	priority int
+	// remaining is the number of not completed tasks of the expression,
+	// including those waiting for arguments
+	remaining int
+}
+
+// before orders tasks of one user: higher priority first, then tasks of
+// expressions closest to completion, then the oldest.
+func (c *candidate) before(other *candidate) bool {
+	if c.priority != other.priority {
+		return c.priority > other.priority
+	}
+	if c.remaining != other.remaining {
+		return c.remaining < other.remaining
+	}
+	return createdBefore(c.task.CreatedAt, other.task.CreatedAt)
+}
+
+func createdBefore(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	return a.Before(*b)
+}
+
+// scheduler shares agents between users with stride scheduling: every
+// dispatched task advances the pass of its user by 1/weight, and the user with
+// the lowest pass gets the next task. A user submitting thousands of
+// expressions therefore waits for the others instead of starving them. The
+// weight comes from the role, priorities only order the tasks of one user.
+type scheduler struct {
+	cfg  config.SchedulerConfig
+	mu   sync.Mutex
+	pass map[int64]float64
+}
+
+func newScheduler(cfg config.SchedulerConfig) *scheduler {
+	return &scheduler{cfg: cfg, pass: make(map[int64]float64)}
+}
+
+// weight returns the share of the agents of users with the role.
+func (s *scheduler) weight(role string) int {
+	switch role {
+	case model.RoleAdmin:
+		return s.cfg.AdminWeight
+	case model.RolePremium:
+		return s.cfg.PremiumWeight
+	default:
+		return s.cfg.UserWeight
+	}
+}
+
+func (s *scheduler) pick(candidates []candidate) *candidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	best := make(map[int64]*candidate)
+	for i := range candidates {
+		c := &candidates[i]
+		if current, ok := best[c.userId]; !ok || c.before(current) {
+			best[c.userId] = c
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// users which had no ready tasks start from the lowest pass of the others,
+	// so idle time does not turn into a burst of tasks later
+	baseline, found := 0.0, false
+	for userId := range best {
+		if pass, ok := s.pass[userId]; ok && (!found || pass < baseline) {
+			baseline, found = pass, true
+		}
+	}
+	for userId := range s.pass {
+		if best[userId] == nil {
+			delete(s.pass, userId)
+		}
+	}
+
+	var picked *candidate
+	for userId, c := range best {
+		if _, ok := s.pass[userId]; !ok {
+			s.pass[userId] = baseline
+		}
+		if picked == nil || s.pass[userId] < s.pass[picked.userId] ||
+			(s.pass[userId] == s.pass[picked.userId] && c.before(picked)) {
+			picked = c
+		}
+	}
+
+	s.pass[picked.userId] += 1 / float64(max(picked.weight, 1))
+
+	return picked
+}
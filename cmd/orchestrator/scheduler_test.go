@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+var testSchedulerConfig = config.SchedulerConfig{UserWeight: 1, PremiumWeight: 2, AdminWeight: 4}
+
+func TestSchedulerWeight(t *testing.T) {
+	s := newScheduler(testSchedulerConfig)
+
+	tests := []struct {
+		role string
+		want int
+	}{
+		{role: model.RoleUser, want: 1},
+		{role: model.RolePremium, want: 2},
+		{role: model.RoleAdmin, want: 4},
+		// users missing from the role lookup get the weight of a normal user
+		{role: "", want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := s.weight(tt.role); got != tt.want {
+			t.Errorf("weight(%q) = %d, want %d", tt.role, got, tt.want)
+		}
+	}
+}
+
+// TestSchedulerShares picks from users which always have ready tasks and
+// counts how many tasks each of them gets.
+func TestSchedulerShares(t *testing.T) {
+	tests := []struct {
+		name string
+		// weights and priorities of the users by user id
+		weights    map[int64]int
+		priorities map[int64]int
+		picks      int
+		want       map[int64]int
+	}{
+		{
+			name:    "equal weights",
+			weights: map[int64]int{1: 1, 2: 1, 3: 1},
+			picks:   30,
+			want:    map[int64]int{1: 10, 2: 10, 3: 10},
+		},
+		{
+			name:    "by weight",
+			weights: map[int64]int{1: 1, 2: 2, 3: 4},
+			picks:   70,
+			want:    map[int64]int{1: 10, 2: 20, 3: 40},
+		},
+		{
+			name:       "priority does not buy a larger share",
+			weights:    map[int64]int{1: 1, 2: 1},
+			priorities: map[int64]int{1: 9, 2: 0},
+			picks:      20,
+			want:       map[int64]int{1: 10, 2: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(testSchedulerConfig)
+			var candidates []candidate
+			for userId, weight := range tt.weights {
+				candidates = append(candidates, candidate{
+					task:     model.Task{Id: fmt.Sprintf("task-%d", userId)},
+					userId:   userId,
+					weight:   weight,
+					priority: tt.priorities[userId],
+				})
+			}
+
+			got := make(map[int64]int)
+			for range tt.picks {
+				got[s.pick(candidates).userId]++
+			}
+
+			for userId, want := range tt.want {
+				if got[userId] != want {
+					t.Errorf("user %d got %d tasks, want %d", userId, got[userId], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerOrdersTasksOfUser(t *testing.T) {
+	earlier := time.Now()
+	later := earlier.Add(time.Second)
+
+	tests := []struct {
+		name       string
+		candidates []candidate
+		want       string
+	}{
+		{
+			name: "higher priority first",
+			candidates: []candidate{
+				{task: model.Task{Id: "low"}, userId: 1, priority: 1},
+				{task: model.Task{Id: "high"}, userId: 1, priority: 5},
+			},
+			want: "high",
+		},
+		{
+			name: "closest to completion",
+			candidates: []candidate{
+				{task: model.Task{Id: "long"}, userId: 1, remaining: 5},
+				{task: model.Task{Id: "short"}, userId: 1, remaining: 1},
+			},
+			want: "short",
+		},
+		{
+			name: "oldest",
+			candidates: []candidate{
+				{task: model.Task{Id: "new", CreatedAt: &later}, userId: 1},
+				{task: model.Task{Id: "old", CreatedAt: &earlier}, userId: 1},
+			},
+			want: "old",
+		},
+		{
+			name: "priority before completion",
+			candidates: []candidate{
+				{task: model.Task{Id: "short"}, userId: 1, remaining: 1},
+				{task: model.Task{Id: "urgent"}, userId: 1, priority: 2, remaining: 9},
+			},
+			want: "urgent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(testSchedulerConfig)
+			if got := s.pick(tt.candidates).task.Id; got != tt.want {
+				t.Errorf("pick() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerNewUserStartsFromBaseline(t *testing.T) {
+	s := newScheduler(testSchedulerConfig)
+	busy := candidate{task: model.Task{Id: "busy"}, userId: 1, weight: 1}
+	for range 10 {
+		s.pick([]candidate{busy})
+	}
+
+	// the new user must not get ten tasks in a row for the time it had none
+	newcomer := candidate{task: model.Task{Id: "new"}, userId: 2, weight: 1}
+	got := make(map[int64]int)
+	for range 4 {
+		got[s.pick([]candidate{busy, newcomer}).userId]++
+	}
+	if got[1] != 2 || got[2] != 2 {
+		t.Errorf("picks = %v, want 2 for each user", got)
+	}
+}
+
+func TestSchedulerPickEmpty(t *testing.T) {
+	if got := newScheduler(testSchedulerConfig).pick(nil); got != nil {
+		t.Errorf("pick(nil) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/app"
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/grpcauth"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/internal/resultcache"
+	"github.com/raikh/calc_micro_final/internal/tracing"
+	"github.com/raikh/calc_micro_final/model"
+	pb "github.com/raikh/calc_micro_final/proto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type TaskServer struct {
+	pb.UnimplementedTaskServiceServer
+	Config      *config.Config
+	Users       model.UserRepository
+	Tasks       model.TaskRepository
+	Expressions model.ExpressionRepository
+	// CustomOperations are sent to agents, which compute them in a WASM runtime
+	CustomOperations model.CustomOperationRepository
+	Metrics          *metrics.Orchestrator
+	// ResultCache gets the results of tasks for later expressions, nil when disabled
+	ResultCache *resultcache.Cache
+
+	dispatchMu sync.Mutex
+	scheduler  *scheduler
+	// verifier is nil unless tasks are computed by several agents
+	verifier *verifier
+}
+
+func NewServer(application *app.App) *TaskServer {
+	return &TaskServer{
+		Config:           application.Cfg,
+		Users:            application.Users,
+		Tasks:            application.Tasks,
+		Expressions:      application.Expressions,
+		CustomOperations: application.CustomOperations,
+		Metrics:          application.Metrics,
+		ResultCache:      application.ResultCache,
+		scheduler:        newScheduler(application.Cfg.Scheduler),
+		verifier:         newVerifier(application),
+	}
+}
+
+// countReadyTasks returns the number of tasks which can be given to an agent,
+// including retries still waiting for their backoff.
+func (ts *TaskServer) countReadyTasks() (int, error) {
+	return ts.Tasks.CountForProcessing(ts.redistributionDelay())
+}
+
+// expired tells whether the deadline of the expression has passed.
+func expired(expression *model.Expression, now time.Time) bool {
+	return expression.Deadline != nil && !now.Before(*expression.Deadline)
+}
+
+type retry int
+
+const (
+	retryNow retry = iota
+	retryLater
+	retryExhausted
+)
+
+// retryState tells whether a task taken by an agent which did not answer may
+// be given to another agent. Every retry waits longer by the backoff.
+func (ts *TaskServer) retryState(task *model.Task) retry {
+	if !task.IsProcessing {
+		return retryNow
+	}
+
+	cfg := ts.Config.TaskRetry
+	attempts := ts.rounds(task)
+	if attempts >= cfg.MaxAttempts {
+		return retryExhausted
+	}
+
+	backoff := cfg.Backoff
+	for i := 1; i < attempts && backoff < cfg.BackoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, cfg.BackoffMax)
+
+	if task.DispatchedAt != nil && time.Since(*task.DispatchedAt) < ts.Config.TaskRedistributeDelay+backoff {
+		return retryLater
+	}
+
+	return retryNow
+}
+
+// rounds is the number of times the task was given out, with verification
+// a round gives copies to all the replicas.
+func (ts *TaskServer) rounds(task *model.Task) int {
+	if ts.verifier == nil {
+		return task.Attempts
+	}
+
+	replicas := ts.verifier.cfg.Replicas
+	return (task.Attempts + replicas - 1) / replicas
+}
+
+// deadLetter stops giving the task to agents and fails its expression.
+func (ts *TaskServer) deadLetter(task *model.Task) {
+	task.IsProcessing = false
+	task.DeadLetter = true
+	task.FailureReason = fmt.Sprintf("no result after %d attempts", task.Attempts)
+	if err := ts.Tasks.Update(task); err != nil {
+		log.Printf("Failed to dead-letter task %s: %v", task.Id, err)
+		return
+	}
+	ts.Metrics.TasksDeadLettered.Inc()
+
+	expression, err := ts.Expressions.GetById(task.ExpressionId)
+	if err != nil {
+		log.Printf("Failed to load expression %s of dead-lettered task %s: %v", task.ExpressionId, task.Id, err)
+		return
+	}
+	if expression.Status == model.StatusFailed {
+		return
+	}
+
+	expression.Status = model.StatusFailed
+	expression.FailureReason = fmt.Sprintf("task %s (%s) was not computed after %d attempts", task.Id, task.Operation, task.Attempts)
+	if err := ts.Expressions.Update(&expression); err != nil {
+		log.Printf("Failed to fail expression %s: %v", expression.Id, err)
+	}
+	log.Printf("Task %s of expression %s is dead-lettered after %d attempts", task.Id, expression.Id, task.Attempts)
+}
+
+func (ts *TaskServer) redistributionDelay() int {
+	return int(ts.Config.TaskRedistributeDelay / time.Second)
+}
+
+// builtinOperations are assumed for agents which do not advertise their operations.
+var builtinOperations = []string{"+", "-", "*", "/"}
+
+func supportedOperations(req *pb.TaskRequest) map[string]bool {
+	names := req.GetOperations()
+	if len(names) == 0 {
+		names = builtinOperations
+	}
+
+	supported := make(map[string]bool, len(names))
+	for _, name := range names {
+		supported[name] = true
+	}
+
+	return supported
+}
+
+// Task gives the agent a ready task with an operation it supports. The task is
+// chosen by the scheduler, so users share the agents fairly.
+func (ts *TaskServer) Task(ctx context.Context, req *pb.TaskRequest) (*pb.TaskResponse, error) {
+	// a task must not be given to two agents polling at the same time
+	ts.dispatchMu.Lock()
+	defer ts.dispatchMu.Unlock()
+
+	supported := supportedOperations(req)
+	// only tasks with both arguments computed are loaded
+	tasks, err := ts.Tasks.GetForProcessing(ts.redistributionDelay())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to load tasks")
+	}
+
+	var ready []model.Task
+	var expressionIds []string
+	for _, task := range tasks {
+		switch ts.retryState(&task) {
+		case retryExhausted:
+			ts.deadLetter(&task)
+			continue
+		case retryLater:
+			continue
+		}
+		if !supported[task.Operation] {
+			continue
+		}
+		if !slices.Contains(expressionIds, task.ExpressionId) {
+			expressionIds = append(expressionIds, task.ExpressionId)
+		}
+		ready = append(ready, task)
+	}
+	now := time.Now()
+	agentId := grpcauth.AgentId(ctx)
+	var copiesByTask map[string]copies
+	if ts.verifier != nil && len(ready) > 0 {
+		var err error
+		ready, copiesByTask, err = ts.filterCopies(ready, agentId, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ready) == 0 {
+		return nil, status.Error(codes.NotFound, "object not found")
+	}
+
+	expressions, err := ts.Expressions.GetByIds(expressionIds)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to load expressions")
+	}
+	byId := make(map[string]model.Expression, len(expressions))
+	var userIds []int64
+	for _, expression := range expressions {
+		byId[expression.Id] = expression
+		if !slices.Contains(userIds, expression.UserId) {
+			userIds = append(userIds, expression.UserId)
+		}
+	}
+	roles, err := ts.Users.GetRoles(userIds)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to load users")
+	}
+	// blocked tasks count too, an expression is nearly done when little of it is left
+	remaining, err := ts.Tasks.CountIncomplete(expressionIds)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to count tasks")
+	}
+
+	candidates := make([]candidate, 0, len(ready))
+	for _, task := range ready {
+		expression := byId[task.ExpressionId]
+		// failed and timed out expressions need no more results
+		if expression.Status != model.StatusPending || expired(&expression, now) {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			task:      task,
+			userId:    expression.UserId,
+			weight:    ts.scheduler.weight(roles[expression.UserId]),
+			priority:  expression.Priority,
+			remaining: remaining[task.ExpressionId],
+		})
+	}
+	for len(candidates) > 0 {
+		task := ts.scheduler.pick(candidates).task
+		claimed, err := ts.claim(&task, copiesByTask[task.Id], agentId, now)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return ts.taskResponse(ctx, task, byId[task.ExpressionId].Deadline, now), nil
+		}
+		// another orchestrator gave the task out since it was loaded
+		candidates = slices.DeleteFunc(candidates, func(c candidate) bool { return c.task.Id == task.Id })
+	}
+
+	return nil, status.Error(codes.NotFound, "object not found")
+}
+
+// claim stores the dispatch of the task to the agent. It reports false when
+// another orchestrator sharing the database claimed the task first.
+func (ts *TaskServer) claim(task *model.Task, c copies, agentId string, now time.Time) (bool, error) {
+	redistributed := task.IsProcessing
+	loadedAttempts := task.Attempts
+
+	task.IsProcessing = true
+	task.DispatchedAt = &now
+	task.Attempts++
+	if ts.verifier != nil {
+		c.live++
+		// the task stays ready for other agents until enough copies are out
+		task.IsProcessing = !ts.verifier.needsMore(c)
+	}
+	claimed, err := ts.Tasks.Claim(task, loadedAttempts)
+	if err != nil {
+		// a task given out without its attempt stored would be given out again
+		return false, status.Error(codes.Unavailable, "Failed to store task")
+	}
+	if !claimed {
+		return false, nil
+	}
+	if ts.verifier != nil {
+		if err := ts.verifier.replicas.Dispatch(task.Id, agentId); err != nil {
+			return false, status.Error(codes.Unavailable, "Failed to store task copy")
+		}
+	}
+
+	if redistributed {
+		ts.Metrics.TaskRedistributions.Inc()
+	}
+	ts.Metrics.ObserveTaskWait(task.Operation, task.CreatedAt)
+
+	return true, nil
+}
+
+func (ts *TaskServer) taskResponse(ctx context.Context, task model.Task, deadline *time.Time, now time.Time) *pb.TaskResponse {
+	// the agent continues the trace of the request which created the task
+	grpc.SetHeader(ctx, tracing.TraceParentMetadata(task.TraceParent))
+
+	w := &pb.TaskResponse{
+		Id:            task.Id,
+		Arg1:          *task.Arg1,
+		Arg2:          *task.Arg2,
+		Operation:     task.Operation,
+		OperationTime: task.OperationTime,
+	}
+	if deadline != nil {
+		// at least a millisecond, zero means no deadline
+		w.TimeoutMs = max(deadline.Sub(now).Milliseconds(), 1)
+	}
+	return w
+}
+
+func (ts *TaskServer) CalculatedTask(ctx context.Context, calculatedTask *pb.TaskResult) (*pb.Empty, error) {
+	if ts.verifier != nil {
+		// two copies answered at once must not both complete the task
+		ts.dispatchMu.Lock()
+		defer ts.dispatchMu.Unlock()
+	}
+
+	task, err := ts.Tasks.GetById(calculatedTask.Id)
+	if err != nil {
+		return &pb.Empty{}, status.Error(codes.NotFound, "Task not found")
+	}
+
+	if ts.verifier != nil {
+		result, accepted, err := ts.verify(ctx, task, calculatedTask.Result)
+		if err != nil || !accepted {
+			return &pb.Empty{}, err
+		}
+		calculatedTask.Result = result
+	}
+
+	if task.Completed {
+		return &pb.Empty{}, status.Error(codes.AlreadyExists, "Task already completed")
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("task.id", task.Id),
+		attribute.String("expression.id", task.ExpressionId),
+	)
+	ts.Metrics.ObserveTaskExecution(task.Operation, task.DispatchedAt)
+
+	// a late result still counts when the task was dead-lettered meanwhile
+	deadLettered := task.DeadLetter
+	task.Result = &calculatedTask.Result
+	task.Completed = true
+	task.DeadLetter = false
+	task.FailureReason = ""
+	if err := ts.Tasks.Complete(task); err != nil {
+		// the agent keeps the result and sends it again
+		return &pb.Empty{}, status.Error(codes.Unavailable, "Failed to store result")
+	}
+	if deadLettered {
+		if err := model.ResumeExpression(ts.Expressions, ts.Tasks, task.ExpressionId); err != nil {
+			log.Printf("Failed to resume expression %s: %v", task.ExpressionId, err)
+		}
+	}
+	if ts.ResultCache != nil && task.CacheKey != "" {
+		ts.ResultCache.Put(task.CacheKey, calculatedTask.Result)
+	}
+
+	if ts.Tasks.IsAllCompleted(task.ExpressionId) {
+		expression, _ := ts.Expressions.GetById(task.ExpressionId)
+		// a timed out expression keeps its status even if the last result arrives late
+		if expression.Status == model.StatusPending {
+			expression.Result = task.Result
+			expression.Status = model.StatusCompleted
+			ts.Expressions.Update(&expression)
+		}
+	}
+
+	return &pb.Empty{}, nil
+}
+
+// filterCopies keeps the tasks the agent should compute a copy of.
+func (ts *TaskServer) filterCopies(ready []model.Task, agentId string, now time.Time) ([]model.Task, map[string]copies, error) {
+	if agentId == "" {
+		return nil, nil, status.Error(codes.Unauthenticated, "Verification requires an authenticated agent")
+	}
+
+	record, err := ts.verifier.agents.Get(agentId)
+	if err != nil {
+		return nil, nil, status.Error(codes.Unavailable, "Failed to load agent")
+	}
+	if record.Quarantined {
+		return nil, nil, status.Error(codes.PermissionDenied, "Agent is quarantined")
+	}
+
+	taskIds := make([]string, 0, len(ready))
+	for _, task := range ready {
+		taskIds = append(taskIds, task.Id)
+	}
+	copiesByTask, err := ts.verifier.load(taskIds, now)
+	if err != nil {
+		return nil, nil, status.Error(codes.Unavailable, "Failed to load task copies")
+	}
+
+	var filtered []model.Task
+	for _, task := range ready {
+		if ts.verifier.needsCopy(copiesByTask[task.Id], agentId, now) {
+			filtered = append(filtered, task)
+		}
+	}
+
+	return filtered, copiesByTask, nil
+}
+
+// verify stores the result of a copy of the task. It reports the result once
+// a quorum of agents agrees on it, the task is given to more agents when the
+// answered copies cannot make a quorum.
+func (ts *TaskServer) verify(ctx context.Context, task *model.Task, result float64) (float64, bool, error) {
+	v := ts.verifier
+	agentId := grpcauth.AgentId(ctx)
+	if agentId == "" {
+		return 0, false, status.Error(codes.Unauthenticated, "Verification requires an authenticated agent")
+	}
+
+	record, err := v.agents.Get(agentId)
+	if err != nil {
+		return 0, false, status.Error(codes.Unavailable, "Failed to load agent")
+	}
+	if record.Quarantined {
+		return 0, false, status.Error(codes.PermissionDenied, "Agent is quarantined")
+	}
+
+	stored, err := v.replicas.SetResult(task.Id, agentId, result)
+	if err != nil {
+		return 0, false, status.Error(codes.Unavailable, "Failed to store result")
+	}
+	if !stored {
+		return 0, false, ts.unstoredResult(task.Id, agentId)
+	}
+
+	if task.Completed {
+		// a late copy is only compared with the accepted result
+		v.record(agentId, task.Result != nil && *task.Result == result)
+		return 0, false, nil
+	}
+
+	now := time.Now()
+	copiesByTask, err := v.load([]string{task.Id}, now)
+	if err != nil {
+		return 0, false, status.Error(codes.Unavailable, "Failed to load task copies")
+	}
+	c := copiesByTask[task.Id]
+
+	if value, ok := v.accepted(c); ok {
+		for _, replica := range c.byAgent {
+			if replica.Result != nil {
+				v.record(replica.AgentId, *replica.Result == value)
+			}
+		}
+		return value, true, nil
+	}
+
+	if c.live == 0 {
+		// all the copies disagree, more agents have to compute the task
+		if ts.rounds(task) >= ts.Config.TaskRetry.MaxAttempts {
+			ts.deadLetter(task)
+		} else {
+			task.IsProcessing = false
+			if err := ts.Tasks.Update(task); err != nil {
+				return 0, false, status.Error(codes.Unavailable, "Failed to store task")
+			}
+		}
+	}
+
+	return 0, false, nil
+}
+
+// unstoredResult tells a retry of a stored result, whose answer was lost, from
+// a result of a task the agent was not given.
+func (ts *TaskServer) unstoredResult(taskId string, agentId string) error {
+	replicas, err := ts.verifier.replicas.GetByTaskIds([]string{taskId})
+	if err != nil {
+		return status.Error(codes.Unavailable, "Failed to load task copies")
+	}
+	for _, replica := range replicas {
+		if replica.AgentId == agentId && replica.AnsweredAt != nil {
+			return status.Error(codes.AlreadyExists, "Result already stored")
+		}
+	}
+
+	return status.Error(codes.FailedPrecondition, "Task is not assigned to the agent")
+}
+
+func (ts *TaskServer) ListCustomOperations(ctx context.Context, req *pb.Empty) (*pb.OperationList, error) {
+	operations, err := ts.CustomOperations.List()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to list operations")
+	}
+
+	list := &pb.OperationList{}
+	for _, operation := range operations {
+		list.Operations = append(list.Operations, &pb.OperationInfo{Name: operation.Name, Hash: operation.Hash})
+	}
+
+	return list, nil
+}
+
+func (ts *TaskServer) GetCustomOperation(ctx context.Context, req *pb.OperationRequest) (*pb.OperationModule, error) {
+	operation, err := ts.CustomOperations.Get(req.Name)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Operation not found")
+	}
+
+	return &pb.OperationModule{Name: operation.Name, Hash: operation.Hash, Module: operation.Module}, nil
+}
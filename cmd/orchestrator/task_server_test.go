@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/raikh/calc_micro_final/internal/app"
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/grpcauth"
+	"github.com/raikh/calc_micro_final/internal/logging"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/model"
+	pb "github.com/raikh/calc_micro_final/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newTestServer(t *testing.T, verification config.VerificationConfig) (*TaskServer, model.Repositories) {
+	t.Helper()
+	repositories := model.NewMemoryRepositories()
+	application := &app.App{
+		Cfg: &config.Config{
+			TaskRedistributeDelay: time.Minute,
+			TaskRetry:             config.TaskRetryConfig{MaxAttempts: 3, Backoff: time.Second, BackoffMax: time.Minute},
+			Verification:          verification,
+			Scheduler:             testSchedulerConfig,
+			AgentTokens:           map[string]string{"a": "token-a", "b": "token-b", "c": "token-c"},
+		},
+		Users:            repositories.Users,
+		Expressions:      repositories.Expressions,
+		Tasks:            repositories.Tasks,
+		CustomOperations: repositories.CustomOperations,
+		Replicas:         repositories.Replicas,
+		Agents:           repositories.Agents,
+		Metrics:          metrics.NewOrchestrator(prometheus.NewRegistry()),
+	}
+
+	return NewServer(application), repositories
+}
+
+// agentContext is the context of a call of the agent authenticated by its token.
+func agentContext(agentId string) context.Context {
+	return grpcauth.WithAgentId(context.Background(), agentId)
+}
+
+// createExpression stores the expression (1+2)*3 as two tasks, the second one
+// waits for the result of the first.
+func createExpression(t *testing.T, repositories model.Repositories, id string, modify func(*model.Expression)) (*model.Task, *model.Task) {
+	t.Helper()
+	now := time.Now()
+	one, two, three := 1.0, 2.0, 3.0
+	sum := &model.Task{Id: id + "-sum", ExpressionId: id, Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, CreatedAt: &now}
+	product := &model.Task{Id: id + "-product", ExpressionId: id, Arg2: &three, Operation: "*", Dependencies: []string{sum.Id}, CreatedAt: &now}
+	expression := &model.Expression{Id: id, UserId: 1, Expression: "(1+2)*3", Status: model.StatusPending, CreatedAt: &now}
+	if modify != nil {
+		modify(expression)
+	}
+	if err := repositories.Expressions.Create(expression, []*model.Task{sum, product}); err != nil {
+		t.Fatalf("creating expression: %v", err)
+	}
+
+	return sum, product
+}
+
+func TestTaskServerComputesExpression(t *testing.T) {
+	ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+	sum, product := createExpression(t, repositories, "expression", nil)
+	ctx := context.Background()
+
+	steps := []struct {
+		name string
+		// call is Task when result is nil, otherwise CalculatedTask of the task
+		taskId   string
+		result   *float64
+		wantCode codes.Code
+		wantTask string
+		wantArgs [2]float64
+	}{
+		{name: "first ready task", wantTask: sum.Id, wantArgs: [2]float64{1, 2}},
+		{name: "nothing ready while the dependency is computed", wantCode: codes.NotFound},
+		{name: "unknown task", taskId: "unknown", result: value(0), wantCode: codes.NotFound},
+		{name: "result of the dependency", taskId: sum.Id, result: value(3)},
+		{name: "result sent twice", taskId: sum.Id, result: value(3), wantCode: codes.AlreadyExists},
+		{name: "dependent task with the result", wantTask: product.Id, wantArgs: [2]float64{3, 3}},
+		{name: "result of the last task", taskId: product.Id, result: value(9)},
+		{name: "nothing left", wantCode: codes.NotFound},
+	}
+
+	for _, step := range steps {
+		if step.result == nil {
+			task, err := ts.Task(ctx, &pb.TaskRequest{})
+			if status.Code(err) != step.wantCode {
+				t.Fatalf("%s: Task() error = %v, want %s", step.name, err, step.wantCode)
+			}
+			if err != nil {
+				continue
+			}
+			if task.Id != step.wantTask || task.Arg1 != step.wantArgs[0] || task.Arg2 != step.wantArgs[1] {
+				t.Fatalf("%s: Task() = %s(%v, %v), want %s(%v, %v)", step.name,
+					task.Id, task.Arg1, task.Arg2, step.wantTask, step.wantArgs[0], step.wantArgs[1])
+			}
+			continue
+		}
+
+		_, err := ts.CalculatedTask(ctx, &pb.TaskResult{Id: step.taskId, Result: *step.result})
+		if status.Code(err) != step.wantCode {
+			t.Fatalf("%s: CalculatedTask() error = %v, want %s", step.name, err, step.wantCode)
+		}
+	}
+
+	expression, err := repositories.Expressions.GetById("expression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expression.Status != model.StatusCompleted || expression.Result == nil || *expression.Result != 9 {
+		t.Errorf("expression = %s %v, want completed with 9", expression.Status, deref(expression.Result))
+	}
+}
+
+func TestTaskServerSkipsTasks(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression func(*model.Expression)
+		request    *pb.TaskRequest
+		wantCode   codes.Code
+	}{
+		{name: "ready task", request: &pb.TaskRequest{}},
+		{name: "operation the agent does not support", request: &pb.TaskRequest{Operations: []string{"*"}}, wantCode: codes.NotFound},
+		{
+			name:       "failed expression",
+			expression: func(e *model.Expression) { e.Status = model.StatusFailed },
+			request:    &pb.TaskRequest{},
+			wantCode:   codes.NotFound,
+		},
+		{
+			name: "expression past its deadline",
+			expression: func(e *model.Expression) {
+				deadline := time.Now().Add(-time.Second)
+				e.Deadline = &deadline
+			},
+			request:  &pb.TaskRequest{},
+			wantCode: codes.NotFound,
+		},
+		{
+			name:       "timed out expression",
+			expression: func(e *model.Expression) { e.Status = model.StatusTimedOut },
+			request:    &pb.TaskRequest{},
+			wantCode:   codes.NotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+			createExpression(t, repositories, "expression", tt.expression)
+
+			_, err := ts.Task(context.Background(), tt.request)
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("Task() error = %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestTaskServerPrefersNearlyDoneExpressions(t *testing.T) {
+	ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+	now := time.Now()
+	one, two := 1.0, 2.0
+
+	// "long" has a single ready task and two blocked behind it, "short" has two
+	// ready tasks and nothing else left
+	long := []*model.Task{
+		{Id: "long-1", ExpressionId: "long", Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, CreatedAt: &now},
+		{Id: "long-2", ExpressionId: "long", Arg2: &two, Operation: "+", Dependencies: []string{"long-1"}, CreatedAt: &now},
+		{Id: "long-3", ExpressionId: "long", Arg2: &two, Operation: "+", Dependencies: []string{"long-2"}, CreatedAt: &now},
+	}
+	short := []*model.Task{
+		{Id: "short-1", ExpressionId: "short", Arg1: &one, Arg2: &two, Operation: "*", Dependencies: []string{}, CreatedAt: &now},
+		{Id: "short-2", ExpressionId: "short", Arg1: &two, Arg2: &two, Operation: "*", Dependencies: []string{}, CreatedAt: &now},
+	}
+	for id, tasks := range map[string][]*model.Task{"long": long, "short": short} {
+		expression := &model.Expression{Id: id, UserId: 1, Status: model.StatusPending, CreatedAt: &now}
+		if err := repositories.Expressions.Create(expression, tasks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task, err := ts.Task(context.Background(), &pb.TaskRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Id != "short-1" && task.Id != "short-2" {
+		t.Errorf("Task() = %s, want a task of the expression with less work left", task.Id)
+	}
+}
+
+func TestTaskServerSendsDeadline(t *testing.T) {
+	ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+	createExpression(t, repositories, "expression", func(e *model.Expression) {
+		deadline := time.Now().Add(time.Minute)
+		e.Deadline = &deadline
+	})
+
+	task, err := ts.Task(context.Background(), &pb.TaskRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.TimeoutMs <= 0 || task.TimeoutMs > time.Minute.Milliseconds() {
+		t.Errorf("TimeoutMs = %d, want up to a minute", task.TimeoutMs)
+	}
+}
+
+func TestTaskServerVerifiesResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		results map[string]float64
+		// wantCompleted tells whether the first task is completed after all the results
+		wantCompleted bool
+		wantResult    float64
+	}{
+		{name: "agents agree", results: map[string]float64{"a": 3, "b": 3}, wantCompleted: true, wantResult: 3},
+		{name: "agents disagree", results: map[string]float64{"a": 3, "b": 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 2})
+			sum, _ := createExpression(t, repositories, "expression", nil)
+
+			// the id in the metadata is not trusted
+			if _, err := ts.Task(metadata.NewIncomingContext(context.Background(), metadata.Pairs(logging.AgentIdKey, "a")), &pb.TaskRequest{}); status.Code(err) != codes.Unauthenticated {
+				t.Fatalf("Task() of an unauthenticated agent error = %v, want Unauthenticated", err)
+			}
+			for agentId := range tt.results {
+				task, err := ts.Task(agentContext(agentId), &pb.TaskRequest{})
+				if err != nil || task.Id != sum.Id {
+					t.Fatalf("Task() for agent %s = %v, %v, want %s", agentId, task, err, sum.Id)
+				}
+			}
+			// every agent gets a single copy
+			if _, err := ts.Task(agentContext("a"), &pb.TaskRequest{}); status.Code(err) != codes.NotFound {
+				t.Fatalf("second Task() for agent a error = %v, want NotFound", err)
+			}
+			if _, err := ts.CalculatedTask(agentContext("c"), &pb.TaskResult{Id: sum.Id, Result: 3}); status.Code(err) != codes.FailedPrecondition {
+				t.Fatalf("CalculatedTask() of an agent without a copy error = %v, want FailedPrecondition", err)
+			}
+
+			for agentId, result := range tt.results {
+				if _, err := ts.CalculatedTask(agentContext(agentId), &pb.TaskResult{Id: sum.Id, Result: result}); err != nil {
+					t.Fatalf("CalculatedTask() for agent %s error = %v", agentId, err)
+				}
+			}
+			if _, err := ts.CalculatedTask(agentContext("a"), &pb.TaskResult{Id: sum.Id, Result: tt.results["a"]}); status.Code(err) != codes.AlreadyExists {
+				t.Fatalf("repeated CalculatedTask() error = %v, want AlreadyExists", err)
+			}
+
+			task, err := repositories.Tasks.GetById(sum.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if task.Completed != tt.wantCompleted || (tt.wantCompleted && *task.Result != tt.wantResult) {
+				t.Errorf("task completed = %v with %s, want %v with %v", task.Completed, deref(task.Result), tt.wantCompleted, tt.wantResult)
+			}
+			// a disagreement gives the task to other agents
+			if !tt.wantCompleted && task.IsProcessing {
+				t.Error("task with disagreeing results is still processing")
+			}
+		})
+	}
+}
+
+func TestTaskServerRetriesUnansweredTasks(t *testing.T) {
+	tests := []struct {
+		name string
+		// attempts and dispatched describe the task given out before
+		attempts   int
+		dispatched time.Duration
+		wantCode   codes.Code
+		wantFailed bool
+	}{
+		{name: "answer is awaited", attempts: 1, dispatched: 500 * time.Millisecond, wantCode: codes.NotFound},
+		{name: "backoff has passed", attempts: 1, dispatched: 2 * time.Second},
+		{name: "backoff doubles", attempts: 2, dispatched: 1500 * time.Millisecond, wantCode: codes.NotFound},
+		{name: "attempts exhausted", attempts: 3, dispatched: time.Hour, wantCode: codes.NotFound, wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+			// only the backoff delays the retries
+			ts.Config.TaskRedistributeDelay = 0
+			sum, _ := createExpression(t, repositories, "expression", nil)
+			dispatchedAt := time.Now().Add(-tt.dispatched)
+			sum.IsProcessing = true
+			sum.Attempts = tt.attempts
+			sum.DispatchedAt = &dispatchedAt
+			if err := repositories.Tasks.Update(sum); err != nil {
+				t.Fatal(err)
+			}
+
+			task, err := ts.Task(context.Background(), &pb.TaskRequest{})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("Task() error = %v, want %s", err, tt.wantCode)
+			}
+			if err == nil && task.Id != sum.Id {
+				t.Errorf("Task() = %s, want %s", task.Id, sum.Id)
+			}
+
+			stored, err := repositories.Tasks.GetById(sum.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expression, err := repositories.Expressions.GetById("expression")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.DeadLetter != tt.wantFailed || (expression.Status == model.StatusFailed) != tt.wantFailed {
+				t.Errorf("task dead-lettered = %v, expression %s, want dead-lettered = %v", stored.DeadLetter, expression.Status, tt.wantFailed)
+			}
+		})
+	}
+}
+
+// failingUpdates stores nothing, as if the database went away after loading the tasks.
+type failingUpdates struct {
+	model.TaskRepository
+}
+
+func (failingUpdates) Claim(*model.Task, int) (bool, error) {
+	return false, errors.New("database is gone")
+}
+
+func TestTaskServerKeepsTaskWhenStoringFails(t *testing.T) {
+	ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+	sum, _ := createExpression(t, repositories, "expression", nil)
+	ts.Tasks = failingUpdates{repositories.Tasks}
+
+	if _, err := ts.Task(context.Background(), &pb.TaskRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Task() error = %v, want Unavailable", err)
+	}
+
+	task, err := repositories.Tasks.GetById(sum.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.IsProcessing || task.Attempts != 0 {
+		t.Errorf("task processing = %v with %d attempts, want it untouched", task.IsProcessing, task.Attempts)
+	}
+}
+
+// otherOrchestrator claims the tasks first, as if another orchestrator
+// sharing the database handed them out between loading and claiming.
+type otherOrchestrator struct {
+	model.TaskRepository
+	taken map[string]bool
+}
+
+func (r otherOrchestrator) Claim(task *model.Task, loadedAttempts int) (bool, error) {
+	if r.taken[task.Id] {
+		stolen := *task
+		if _, err := r.TaskRepository.Claim(&stolen, loadedAttempts); err != nil {
+			return false, err
+		}
+	}
+	return r.TaskRepository.Claim(task, loadedAttempts)
+}
+
+func TestTaskServerSkipsTasksClaimedElsewhere(t *testing.T) {
+	tests := []struct {
+		name     string
+		taken    map[string]bool
+		wantTask string
+		wantCode codes.Code
+	}{
+		{name: "free", taken: map[string]bool{}, wantTask: "first-sum"},
+		{name: "next task", taken: map[string]bool{"first-sum": true}, wantTask: "second-sum"},
+		{name: "all taken", taken: map[string]bool{"first-sum": true, "second-sum": true}, wantCode: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, repositories := newTestServer(t, config.VerificationConfig{Replicas: 1})
+			createExpression(t, repositories, "first", nil)
+			createExpression(t, repositories, "second", func(e *model.Expression) { e.UserId = 2 })
+			ts.Tasks = otherOrchestrator{repositories.Tasks, tt.taken}
+
+			task, err := ts.Task(context.Background(), &pb.TaskRequest{})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("Task() error = %v, want %s", err, tt.wantCode)
+			}
+			if err == nil && task.Id != tt.wantTask {
+				t.Errorf("Task() = %s, want %s", task.Id, tt.wantTask)
+			}
+		})
+	}
+}
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func deref(value *float64) any {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
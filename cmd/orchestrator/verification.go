@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/app"
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// verifier gives every task to several distinct agents and accepts a result
+// once a quorum of them agrees on it. Agents which keep disagreeing with the
+// accepted results are quarantined.
+type verifier struct {
+	cfg      config.VerificationConfig
+	replicas model.ReplicaRepository
+	agents   model.AgentRepository
+	metrics  *metrics.Orchestrator
+	// tokens are the agents authenticated by the orchestrator
+	tokens map[string]string
+	// lostAfter is how long an unanswered copy is waited for
+	lostAfter time.Duration
+}
+
+// newVerifier returns nil when every task is computed by a single agent.
+func newVerifier(application *app.App) *verifier {
+	cfg := application.Cfg
+	if cfg.Verification.Replicas <= 1 {
+		return nil
+	}
+
+	return &verifier{
+		cfg:       cfg.Verification,
+		replicas:  application.Replicas,
+		agents:    application.Agents,
+		metrics:   application.Metrics,
+		tokens:    cfg.AgentTokens,
+		lostAfter: cfg.TaskRedistributeDelay,
+	}
+}
+
+// copies sums up the copies of one task.
+type copies struct {
+	byAgent map[string]model.Replica
+	// live copies are not answered yet and not lost
+	live     int
+	answered int
+	// votes counts the agents which sent each result
+	votes map[float64]int
+}
+
+// best returns the result most agents agree on and the number of those agents.
+func (c copies) best() (float64, int) {
+	var result float64
+	count := 0
+	for value, votes := range c.votes {
+		if votes > count {
+			result, count = value, votes
+		}
+	}
+
+	return result, count
+}
+
+func (v *verifier) lost(replica model.Replica, now time.Time) bool {
+	return replica.AnsweredAt == nil && (replica.DispatchedAt == nil || now.Sub(*replica.DispatchedAt) > v.lostAfter)
+}
+
+// load returns the copies of the tasks by task id.
+func (v *verifier) load(taskIds []string, now time.Time) (map[string]copies, error) {
+	replicas, err := v.replicas.GetByTaskIds(taskIds)
+	if err != nil {
+		return nil, err
+	}
+
+	byTask := make(map[string]copies, len(taskIds))
+	for _, replica := range replicas {
+		c, ok := byTask[replica.TaskId]
+		if !ok {
+			c = copies{byAgent: make(map[string]model.Replica), votes: make(map[float64]int)}
+		}
+		c.byAgent[replica.AgentId] = replica
+		switch {
+		case replica.Result != nil:
+			c.answered++
+			c.votes[*replica.Result]++
+		case !v.lost(replica, now):
+			c.live++
+		}
+		byTask[replica.TaskId] = c
+	}
+
+	return byTask, nil
+}
+
+// needsMore tells whether the task must be given to another agent: there are
+// fewer copies than replicas or the copies out cannot make a quorum anymore.
+func (v *verifier) needsMore(c copies) bool {
+	_, agreeing := c.best()
+	return c.live+c.answered < v.cfg.Replicas || c.live+agreeing < v.cfg.RequiredQuorum()
+}
+
+// needsCopy tells whether the agent may compute the task, an agent gets a
+// single copy of a task unless its copy was lost.
+func (v *verifier) needsCopy(c copies, agentId string, now time.Time) bool {
+	if replica, ok := c.byAgent[agentId]; ok && !v.lost(replica, now) {
+		return false
+	}
+
+	return v.needsMore(c)
+}
+
+// accepted returns the result a quorum of the copies agrees on.
+func (v *verifier) accepted(c copies) (float64, bool) {
+	result, agreeing := c.best()
+	return result, agreeing >= v.cfg.RequiredQuorum()
+}
+
+// record counts whether the result of the agent matched the accepted one.
+func (v *verifier) record(agentId string, agreed bool) {
+	wasQuarantined := false
+	if !agreed {
+		// the label is bounded by the configured agents, copies may be left by agents removed since
+		if _, known := v.tokens[agentId]; known {
+			v.metrics.ResultDisagreements.WithLabelValues(agentId).Inc()
+		}
+		if record, err := v.agents.Get(agentId); err == nil {
+			wasQuarantined = record.Quarantined
+		}
+	}
+
+	record, err := v.agents.Record(agentId, agreed, v.cfg.QuarantineAfter)
+	if err != nil {
+		log.Printf("Failed to record result of agent %s: %v", agentId, err)
+		return
+	}
+	if record.Quarantined && !wasQuarantined {
+		log.Warnf("Agent %s is quarantined after %d disagreements", agentId, record.Disagreements)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// testCopies builds the copies of a task from the results of the agents,
+// nil results are copies still being computed.
+func testCopies(results ...*float64) copies {
+	c := copies{byAgent: make(map[string]model.Replica), votes: make(map[float64]int)}
+	for _, result := range results {
+		if result == nil {
+			c.live++
+			continue
+		}
+		c.answered++
+		c.votes[*result]++
+	}
+	return c
+}
+
+func TestVerifierQuorum(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          config.VerificationConfig
+		copies       copies
+		wantMore     bool
+		wantAccepted bool
+		wantResult   float64
+	}{
+		{
+			name:     "no copies",
+			cfg:      config.VerificationConfig{Replicas: 3},
+			copies:   testCopies(),
+			wantMore: true,
+		},
+		{
+			name:     "fewer copies than replicas",
+			cfg:      config.VerificationConfig{Replicas: 3},
+			copies:   testCopies(nil, value(1)),
+			wantMore: true,
+		},
+		{
+			name:   "all copies out",
+			cfg:    config.VerificationConfig{Replicas: 3},
+			copies: testCopies(nil, nil, value(1)),
+		},
+		{
+			name:         "majority agrees",
+			cfg:          config.VerificationConfig{Replicas: 3},
+			copies:       testCopies(value(2), nil, value(2)),
+			wantAccepted: true,
+			wantResult:   2,
+		},
+		{
+			name:         "majority with one wrong result",
+			cfg:          config.VerificationConfig{Replicas: 3},
+			copies:       testCopies(value(2), value(5), value(2)),
+			wantAccepted: true,
+			wantResult:   2,
+		},
+		{
+			name:     "quorum out of reach",
+			cfg:      config.VerificationConfig{Replicas: 3},
+			copies:   testCopies(value(1), value(2), value(3)),
+			wantMore: true,
+		},
+		{
+			name:     "split with a copy out",
+			cfg:      config.VerificationConfig{Replicas: 3},
+			copies:   testCopies(value(1), value(2), nil),
+			wantMore: false,
+		},
+		{
+			name:         "explicit quorum",
+			cfg:          config.VerificationConfig{Replicas: 3, Quorum: 3},
+			copies:       testCopies(value(4), value(4), value(4)),
+			wantAccepted: true,
+			wantResult:   4,
+		},
+		{
+			name:     "explicit quorum not reached",
+			cfg:      config.VerificationConfig{Replicas: 3, Quorum: 3},
+			copies:   testCopies(value(4), value(4), value(7)),
+			wantMore: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &verifier{cfg: tt.cfg, lostAfter: time.Minute}
+
+			if got := v.needsMore(tt.copies); got != tt.wantMore {
+				t.Errorf("needsMore() = %v, want %v", got, tt.wantMore)
+			}
+			result, accepted := v.accepted(tt.copies)
+			if accepted != tt.wantAccepted || (accepted && result != tt.wantResult) {
+				t.Errorf("accepted() = %v, %v, want %v, %v", result, accepted, tt.wantResult, tt.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestVerifierNeedsCopy(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Second)
+	old := now.Add(-time.Hour)
+	v := &verifier{cfg: config.VerificationConfig{Replicas: 2}, lostAfter: time.Minute}
+
+	tests := []struct {
+		name    string
+		replica *model.Replica
+		want    bool
+	}{
+		{name: "agent without a copy", want: true},
+		{name: "agent computing a copy", replica: &model.Replica{AgentId: "a", DispatchedAt: &recent}},
+		{name: "agent which lost its copy", replica: &model.Replica{AgentId: "a", DispatchedAt: &old}, want: true},
+		{name: "agent which answered", replica: &model.Replica{AgentId: "a", DispatchedAt: &recent, AnsweredAt: &recent, Result: value(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCopies()
+			if tt.replica != nil {
+				c.byAgent["a"] = *tt.replica
+			}
+			if got := v.needsCopy(c, "a", now); got != tt.want {
+				t.Errorf("needsCopy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifierLabelsKnownAgents(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.NewOrchestrator(registry)
+	v := &verifier{
+		cfg:     config.VerificationConfig{Replicas: 2, QuarantineAfter: 3},
+		agents:  model.NewMemoryRepositories().Agents,
+		metrics: m,
+		tokens:  map[string]string{"a": "token-a"},
+	}
+
+	v.record("a", false)
+	// a copy left by an agent removed from the tokens
+	v.record("removed", false)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "calc_result_disagreements_total" && len(family.GetMetric()) != 1 {
+			t.Errorf("disagreements are labeled with %d agents, want 1", len(family.GetMetric()))
+		}
+	}
+	record, err := v.agents.Get("removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Disagreements != 1 {
+		t.Errorf("removed agent has %d disagreements stored, want 1", record.Disagreements)
+	}
+}
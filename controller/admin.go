@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// maxOperationTimeMs keeps a typo in the admin request from freezing workers for days
+const maxOperationTimeMs = 60 * 60 * 1000
+
+type OperationTimesRequest struct {
+	// UserId is optional, without it the defaults are changed
+	UserId         int64            `json:"user_id"`
+	OperationTimes map[string]int64 `json:"operation_times"`
+}
+
+type OperationTimesResponse struct {
+	Defaults map[string]int64           `json:"defaults"`
+	Users    map[int64]map[string]int64 `json:"users"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+func operationTimesResponse(operationTimes model.OperationTimeRepository) (OperationTimesResponse, error) {
+	defaults, err := operationTimes.GetDefaults()
+	if err != nil {
+		return OperationTimesResponse{}, err
+	}
+
+	overrides, err := operationTimes.GetOverrides()
+	if err != nil {
+		return OperationTimesResponse{}, err
+	}
+
+	return OperationTimesResponse{Defaults: defaults, Users: overrides}, nil
+}
+
+func HandleGetOperationTimes(operationTimes model.OperationTimeRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		response, err := operationTimesResponse(operationTimes)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func HandleSetOperationTimes(operationTimes model.OperationTimeRepository, users model.UserRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(OperationTimesRequest)
+		if err := c.Bind(req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if len(req.OperationTimes) == 0 {
+			return c.JSON(http.StatusUnprocessableEntity, "operation_times must not be empty")
+		}
+		for operation, timeMs := range req.OperationTimes {
+			if !isSupportedOperation(operation) {
+				return c.JSON(http.StatusUnprocessableEntity, fmt.Sprintf("Unsupported operation %q", operation))
+			}
+			if timeMs < 0 || timeMs > maxOperationTimeMs {
+				return c.JSON(http.StatusUnprocessableEntity, fmt.Sprintf("Time of %q must be between 0 and %d ms", operation, maxOperationTimeMs))
+			}
+		}
+
+		if req.UserId != model.DefaultsUserId {
+			if _, err := users.GetById(req.UserId); err != nil {
+				return c.JSON(http.StatusNotFound, fmt.Sprintf("user with id %d not found", req.UserId))
+			}
+		}
+
+		if err := operationTimes.Set(req.UserId, req.OperationTimes); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		response, err := operationTimesResponse(operationTimes)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func HandleDeleteUserOperationTimes(operationTimes model.OperationTimeRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil || userId == model.DefaultsUserId {
+			return c.JSON(http.StatusUnprocessableEntity, "Invalid user id")
+		}
+
+		if err := operationTimes.DeleteForUser(userId); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func HandleSetUserRole(users model.UserRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, "Invalid user id")
+		}
+
+		req := new(RoleRequest)
+		if err := c.Bind(req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if !model.IsValidRole(req.Role) {
+			return c.JSON(http.StatusUnprocessableEntity, fmt.Sprintf("Unknown role %q", req.Role))
+		}
+
+		if _, err := users.GetById(userId); err != nil {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("user with id %d not found", userId))
+		}
+
+		if err := users.SetRole(userId, req.Role); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		user, err := users.GetById(userId)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, user)
+	}
+}
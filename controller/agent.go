@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+func HandleGetAgents(agents model.AgentRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		records, err := agents.List()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"agents": records})
+	}
+}
+
+// HandleReleaseAgent lifts the quarantine of the agent, its disagreements are forgotten.
+func HandleReleaseAgent(agents model.AgentRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+
+		released, err := agents.Release(id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if !released {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("agent %s not found", id))
+		}
+
+		record, err := agents.Get(id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, record)
+	}
+}
@@ -2,8 +2,8 @@ package controller
 
 import (
 	"net/http"
-	"time"
 
+	"github.com/raikh/calc_micro_final/api"
 	"github.com/raikh/calc_micro_final/middleware"
 	"github.com/raikh/calc_micro_final/model"
 
@@ -11,19 +11,11 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-type UserRequest struct {
-	Email    string `json:"email" valid:"required,email"`
-	Password string `json:"password" valid:"required,minstringlength(3)~Password too short,type(string)"`
-}
-
-type TokenResponse struct {
-	Token     string     `json:"access_token"`
-	ExpiresAt *time.Time `json:"expires_at"`
-}
-
-func Register() echo.HandlerFunc {
+// Register creates a user with the user role, admins are promoted by
+// APP_ADMIN_EMAILS at startup or through the admin API.
+func Register(users model.UserRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		requestUser := new(UserRequest)
+		requestUser := new(api.UserRequest)
 		if err := c.Bind(requestUser); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -34,7 +26,7 @@ func Register() echo.HandlerFunc {
 			return c.JSON(http.StatusUnprocessableEntity, err.Error())
 		}
 
-		_, err = model.Create(requestUser.Email, requestUser.Password)
+		_, err = users.Create(requestUser.Email, requestUser.Password, model.RoleUser)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Unprocessable Entity")
 		}
@@ -43,9 +35,9 @@ func Register() echo.HandlerFunc {
 	}
 }
 
-func Login() echo.HandlerFunc {
+func Login(users model.UserRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		requestUser := new(UserRequest)
+		requestUser := new(api.UserRequest)
 		if err := c.Bind(requestUser); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -56,7 +48,7 @@ func Login() echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, err.Error())
 		}
 
-		user, err := model.GetByEmail(requestUser.Email)
+		user, err := users.GetByEmail(requestUser.Email)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
 		}
@@ -72,6 +64,6 @@ func Login() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 
-		return c.JSON(http.StatusOK, TokenResponse{token, &time})
+		return c.JSON(http.StatusOK, api.TokenResponse{Token: token, ExpiresAt: &time})
 	}
 }
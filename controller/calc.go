@@ -2,14 +2,24 @@ package controller
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/api"
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/planner"
+	"github.com/raikh/calc_micro_final/internal/quota"
+	"github.com/raikh/calc_micro_final/internal/tracing"
+	"github.com/raikh/calc_micro_final/middleware"
 	"github.com/raikh/calc_micro_final/model"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Task struct {
@@ -32,8 +42,57 @@ type Expression struct {
 	Result float64
 }
 
-type ExpressionRequest struct {
-	Expression string `json:"expression"`
+// requestDeadline returns the time the expression times out at, nil when the request sets no limit.
+func requestDeadline(req *api.ExpressionRequest, now time.Time) (*time.Time, error) {
+	if req.TimeoutMs < 0 {
+		return nil, fmt.Errorf("timeout_ms must not be negative")
+	}
+	if req.Deadline != nil && !req.Deadline.After(now) {
+		return nil, fmt.Errorf("deadline must be in the future")
+	}
+
+	deadline := req.Deadline
+	if req.TimeoutMs > 0 {
+		timeout := now.Add(time.Duration(req.TimeoutMs) * time.Millisecond)
+		if deadline == nil || timeout.Before(*deadline) {
+			deadline = &timeout
+		}
+	}
+	if deadline != nil {
+		utc := deadline.UTC()
+		deadline = &utc
+	}
+
+	return deadline, nil
+}
+
+// expressionResponse is the expression as the API shows it.
+func expressionResponse(e model.Expression) api.Expression {
+	return api.Expression{
+		Id:            e.Id,
+		Expression:    e.Expression,
+		Status:        e.Status,
+		Result:        e.Result,
+		FailureReason: e.FailureReason,
+		Priority:      e.Priority,
+		Deadline:      e.Deadline,
+		CreatedAt:     e.CreatedAt,
+		UpdatedAt:     e.UpdatedAt,
+	}
+}
+
+const maxPriority = 9
+
+var precedence = map[string]int{
+	"+": 1,
+	"-": 1,
+	"*": 2,
+	"/": 2,
+}
+
+func isSupportedOperation(operation string) bool {
+	_, ok := precedence[operation]
+	return ok
 }
 
 func generateID() (uuid string) {
@@ -50,70 +109,106 @@ func generateID() (uuid string) {
 	return
 }
 
-func parseExpression(expr string, expressionID string, delayDict map[string]int64) []*model.Task {
-	postfix := infixToPostfix(expr)
-	stack := []*model.Task{}
-	tasks := []*model.Task{}
+// ExpressionLimitError names the limit of config.ExpressionLimits an expression exceeds.
+type ExpressionLimitError struct {
+	Limit  string
+	Max    int
+	Actual int
+}
 
-	for _, token := range postfix {
-		switch token {
-		case "+", "-", "*", "/":
-			arg2Task := stack[len(stack)-1]
-			arg1Task := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
+func (e *ExpressionLimitError) Error() string {
+	return fmt.Sprintf("expression exceeds %s: %d, the maximum is %d", e.Limit, e.Actual, e.Max)
+}
 
-			deps := []string{}
-			if !arg1Task.Completed {
-				deps = append(deps, arg1Task.Id)
-			}
-			if !arg2Task.Completed {
-				deps = append(deps, arg2Task.Id)
-			}
+// errUnbalancedParentheses is returned for a closing parenthesis without an opening one and vice versa.
+var errUnbalancedParentheses = errors.New("unbalanced parentheses")
+
+// validateExpression checks the size of the expression before any task is
+// built. Exceeded limits are returned as *ExpressionLimitError.
+func validateExpression(expr string, functions map[string]bool, limits config.ExpressionLimits) error {
+	if length := utf8.RuneCountInString(expr); length > limits.MaxLength {
+		return &ExpressionLimitError{Limit: "max_length", Max: limits.MaxLength, Actual: length}
+	}
+
+	tokens := tokenize(expr)
+	if len(tokens) > limits.MaxTokens {
+		return &ExpressionLimitError{Limit: "max_tokens", Max: limits.MaxTokens, Actual: len(tokens)}
+	}
 
-			task := &model.Task{
-				Id:            generateID(),
-				ExpressionId:  expressionID,
-				Arg1:          arg1Task.Result,
-				Arg2:          arg2Task.Result,
-				Operation:     token,
-				OperationTime: delayDict[token],
-				Dependencies:  deps,
+	depth, maxDepth, tasks := 0, 0, 0
+	for _, token := range tokens {
+		switch {
+		case token == "(":
+			depth++
+			maxDepth = max(maxDepth, depth)
+		case token == ")":
+			depth--
+			if depth < 0 {
+				return errUnbalancedParentheses
 			}
-			tasks = append(tasks, task)
+		case isSupportedOperation(token) || functions[token]:
+			tasks++
+		}
+	}
+	if depth != 0 {
+		return errUnbalancedParentheses
+	}
+	if maxDepth > limits.MaxDepth {
+		return &ExpressionLimitError{Limit: "max_depth", Max: limits.MaxDepth, Actual: maxDepth}
+	}
+	if tasks > limits.MaxTasks {
+		return &ExpressionLimitError{Limit: "max_tasks", Max: limits.MaxTasks, Actual: tasks}
+	}
+
+	return nil
+}
+
+// isIdentifier tells names of functions apart from numbers.
+func isIdentifier(token string) bool {
+	first, _ := utf8.DecodeRuneInString(token)
+	return unicode.IsLetter(first)
+}
+
+// parseExpression builds the syntax tree of the expression. Functions are
+// names of custom operations called with two arguments, e.g. fx(a, b).
+func parseExpression(expr string, functions map[string]bool) (*planner.Node, error) {
+	postfix, err := infixToPostfix(expr, functions)
+	if err != nil {
+		return nil, err
+	}
+	stack := []*planner.Node{}
 
-			stack = append(stack, task)
+	for _, token := range postfix {
+		switch {
+		case isSupportedOperation(token) || functions[token]:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("operation %s needs two arguments", token)
+			}
+			left := stack[len(stack)-2]
+			right := stack[len(stack)-1]
+			stack = append(stack[:len(stack)-2], planner.Apply(token, left, right))
+		case isIdentifier(token):
+			return nil, fmt.Errorf("unknown function %s", token)
 		default:
-			num, _ := strconv.ParseFloat(token, 64)
-
-			task := &model.Task{
-				Id:            generateID(),
-				ExpressionId:  expressionID,
-				Arg1:          &num,
-				Arg2:          nil,
-				Operation:     "",
-				OperationTime: 0,
-				Dependencies:  []string{},
-				Result:        &num,
-				Completed:     true,
+			num, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", token)
 			}
-			stack = append(stack, task)
+			stack = append(stack, planner.Number(num))
 		}
 	}
 
-	return tasks
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("invalid expression")
+	}
+
+	return stack[0], nil
 }
 
-func infixToPostfix(expr string) []string {
+func infixToPostfix(expr string, functions map[string]bool) ([]string, error) {
 	var output []string
 	var stack []string
 
-	precedence := map[string]int{
-		"+": 1,
-		"-": 1,
-		"*": 2,
-		"/": 2,
-	}
-
 	tokens := tokenize(expr)
 	for _, token := range tokens {
 		switch token {
@@ -125,23 +220,43 @@ func infixToPostfix(expr string) []string {
 			stack = append(stack, token)
 		case "(":
 			stack = append(stack, token)
+		case ",":
+			// the first argument of a function is complete
+			for len(stack) > 0 && stack[len(stack)-1] != "(" {
+				output = append(output, stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
 		case ")":
 			for len(stack) > 0 && stack[len(stack)-1] != "(" {
 				output = append(output, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
+			if len(stack) == 0 {
+				return nil, errUnbalancedParentheses
+			}
 			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && functions[stack[len(stack)-1]] {
+				output = append(output, stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
 		default:
-			output = append(output, token)
+			if functions[token] {
+				stack = append(stack, token)
+			} else {
+				output = append(output, token)
+			}
 		}
 	}
 
 	for len(stack) > 0 {
+		if stack[len(stack)-1] == "(" {
+			return nil, errUnbalancedParentheses
+		}
 		output = append(output, stack[len(stack)-1])
 		stack = stack[:len(stack)-1]
 	}
 
-	return output
+	return output, nil
 }
 
 func tokenize(expr string) []string {
@@ -152,7 +267,7 @@ func tokenize(expr string) []string {
 		if char == ' ' {
 			continue
 		}
-		if char == '+' || char == '-' || char == '*' || char == '/' || char == '(' || char == ')' {
+		if char == '+' || char == '-' || char == '*' || char == '/' || char == '(' || char == ')' || char == ',' {
 			if currentToken != "" {
 				tokens = append(tokens, currentToken)
 				currentToken = ""
@@ -170,7 +285,7 @@ func tokenize(expr string) []string {
 	return tokens
 }
 
-func HandleGetExpressions() echo.HandlerFunc {
+func HandleGetExpressions(expressions model.ExpressionRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
 		user, ok := c.Get("user").(model.User)
@@ -178,13 +293,18 @@ func HandleGetExpressions() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
 
-		expressions, _ := model.GetExpressionsByUserId(user.Id)
+		userExpressions, _ := expressions.GetByUserId(user.Id)
 
-		return c.JSON(http.StatusOK, map[string]interface{}{"expressions": expressions})
+		response := api.ExpressionsResponse{Expressions: make([]api.Expression, 0, len(userExpressions))}
+		for _, expression := range userExpressions {
+			response.Expressions = append(response.Expressions, expressionResponse(expression))
+		}
+
+		return c.JSON(http.StatusOK, response)
 	}
 }
 
-func HandleGetExpressionsById() echo.HandlerFunc {
+func HandleGetExpressionsById(expressions model.ExpressionRepository) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.Param("id")
 		user, ok := c.Get("user").(model.User)
@@ -192,19 +312,69 @@ func HandleGetExpressionsById() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
 
-		expressions, err := model.GetExpressionByIdForUser(id, user.Id)
+		expression, err := expressions.GetByIdForUser(id, user.Id)
 
 		if err != nil {
 			return c.JSON(http.StatusNotFound, err.Error())
 		}
 
-		return c.JSON(http.StatusOK, expressions)
+		return c.JSON(http.StatusOK, expressionResponse(expression))
+	}
+}
+
+// HandleGetExpressionTasks lists the tasks of an expression of the user with their progress.
+func HandleGetExpressionTasks(expressions model.ExpressionRepository, tasks model.TaskRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+		user, ok := c.Get("user").(model.User)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		if _, err := expressions.GetByIdForUser(id, user.Id); err != nil {
+			return c.JSON(http.StatusNotFound, err.Error())
+		}
+
+		expressionTasks, err := tasks.GetByExpressionId(id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		response := api.TasksResponse{Tasks: make([]api.Task, 0, len(expressionTasks))}
+		for _, task := range expressionTasks {
+			response.Tasks = append(response.Tasks, taskResponse(task))
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func taskResponse(t model.Task) api.Task {
+	status := api.TaskWaiting
+	switch {
+	case t.Completed:
+		status = api.TaskCompleted
+	case t.DeadLetter:
+		status = api.TaskDeadLetter
+	case t.IsProcessing:
+		status = api.TaskProcessing
+	}
+
+	return api.Task{
+		Id:        t.Id,
+		Operation: t.Operation,
+		Arg1:      t.Arg1,
+		Arg2:      t.Arg2,
+		Result:    t.Result,
+		Status:    status,
+		Attempts:  t.Attempts,
 	}
 }
 
-func HandleCalculate(delayDict map[string]int64) echo.HandlerFunc {
+func HandleCalculate(expressions model.ExpressionRepository, operationTimes model.OperationTimeRepository, customOperations model.CustomOperationRepository,
+	quotas *quota.Service, limits config.ExpressionLimits, taskPlanner *planner.Planner) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		req := new(ExpressionRequest)
+		req := new(api.ExpressionRequest)
 		if err := c.Bind(req); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -214,53 +384,102 @@ func HandleCalculate(delayDict map[string]int64) echo.HandlerFunc {
 			return c.JSON(http.StatusUnprocessableEntity, "Invalid request body")
 		}
 
+		if req.Priority < 0 || req.Priority > maxPriority {
+			return c.JSON(http.StatusUnprocessableEntity, fmt.Sprintf("Priority must be between 0 and %d", maxPriority))
+		}
+
+		now := time.Now()
+		deadline, err := requestDeadline(req, now)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, err.Error())
+		}
+
 		user, ok := c.Get("user").(model.User)
 		if !ok {
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
+		priority := min(req.Priority, model.MaxPriority(user.Role))
+
+		delayDict, err := operationTimes.GetForUser(user.Id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 
-		tx, err := model.BeginTx()
+		functions, versions, err := customFunctions(customOperations)
 		if err != nil {
-			return err
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 
-		defer func() {
-			if p := recover(); p != nil {
-				tx.Rollback()
-				panic(p)
-			} else if err != nil {
-				tx.Rollback()
+		if err := validateExpression(req.Expression, functions, limits); err != nil {
+			var limitErr *ExpressionLimitError
+			if !errors.As(err, &limitErr) {
+				return c.JSON(http.StatusUnprocessableEntity, err.Error())
 			}
-		}()
+			return c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"message": limitErr.Error(),
+				"limit":   limitErr.Limit,
+				"max":     limitErr.Max,
+				"actual":  limitErr.Actual,
+			})
+		}
+
+		// tasks are linked to the request span, so agent computations show up under it
+		traceParent := tracing.TraceParent(c.Request().Context())
+		_, span := tracing.Tracer().Start(c.Request().Context(), "plan expression")
+		defer span.End()
 
 		id := generateID()
-		now := time.Now()
+		span.SetAttributes(attribute.String("expression.id", id))
 		expr := &model.Expression{
 			Id:         id,
 			UserId:     user.Id,
 			Expression: req.Expression,
-			Status:     "pending",
+			Status:     model.StatusPending,
 			Result:     nil,
+			Priority:   priority,
+			Deadline:   deadline,
 			CreatedAt:  &now,
 			UpdatedAt:  &now,
 		}
-		err = expr.InsertTx(tx)
+
+		root, err := parseExpression(req.Expression, functions)
 		if err != nil {
-			return err
+			return c.JSON(http.StatusUnprocessableEntity, err.Error())
 		}
 
-		tasksForExpr := parseExpression(req.Expression, id, delayDict)
+		tasksForExpr, result := taskPlanner.Plan(planner.Input{
+			Root:         root,
+			ExpressionId: id,
+			Delays:       delayDict,
+			StrictOrder:  req.StrictOrder,
+			NoCache:      req.NoCache,
+			Versions:     versions,
+		}, generateID)
+		if result != nil {
+			// folded to a number or found in the cache, there is nothing for agents to do
+			expr.Status = model.StatusCompleted
+			expr.Result = result
+		}
+
+		apiKey := middleware.APIKey(c)
+		if apiKey != nil {
+			expr.APIKeyId = &apiKey.Id
+		}
+		expr.TaskCount = len(tasksForExpr)
 		for _, task := range tasksForExpr {
 			task.CreatedAt = &now
 			task.UpdatedAt = &now
-			err = task.InsertTx(tx)
-			if err != nil {
-				return err
-			}
+			task.TraceParent = traceParent
 		}
+		span.SetAttributes(attribute.Int("expression.tasks", len(tasksForExpr)))
 
-		tx.Commit()
+		err = quotas.CreateExpression(user, apiKey, len(tasksForExpr), func() error {
+			return expressions.Create(expr, tasksForExpr)
+		})
+		if err != nil {
+			return middleware.QuotaError(c, err)
+		}
 
-		return c.JSON(http.StatusCreated, map[string]string{"id": id})
+		return c.JSON(http.StatusCreated, api.CalculateResponse{Id: id, Priority: priority, Deadline: deadline})
 	}
 }
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/planner"
+)
+
+// format writes the tree with every operation in parentheses.
+func format(n *planner.Node) string {
+	if n.IsNumber() {
+		return strconv.FormatFloat(n.Value, 'g', -1, 64)
+	}
+	if isSupportedOperation(n.Operation) {
+		return "(" + format(n.Left) + n.Operation + format(n.Right) + ")"
+	}
+	return n.Operation + "(" + format(n.Left) + "," + format(n.Right) + ")"
+}
+
+func TestParseExpression(t *testing.T) {
+	functions := map[string]bool{"fx": true}
+
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "2", want: "2"},
+		{expr: "1+2*3", want: "(1+(2*3))"},
+		{expr: "(1+2)*3", want: "((1+2)*3)"},
+		{expr: "8/4/2", want: "((8/4)/2)"},
+		{expr: "1 - 2 + 3", want: "((1-2)+3)"},
+		{expr: "2.5*((1+2)-3)", want: "(2.5*((1+2)-3))"},
+		{expr: "fx(1+2, 3)*4", want: "(fx((1+2),3)*4)"},
+		{expr: "fx(fx(1,2),3)", want: "fx(fx(1,2),3)"},
+		{expr: "2*fx(3,4)", want: "(2*fx(3,4))"},
+		{expr: "1+2)", wantErr: true},
+		{expr: "(1+2", wantErr: true},
+		{expr: ")(", wantErr: true},
+		{expr: "1+", wantErr: true},
+		{expr: "1,2", wantErr: true},
+		{expr: "1+ж", wantErr: true},
+		{expr: "1+١", wantErr: true},
+		{expr: "1.2.3", wantErr: true},
+		{expr: "gx(1,2)", wantErr: true},
+		{expr: "fx(1)", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			root, err := parseExpression(tt.expr, functions)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExpression(%q) = %s, want an error", tt.expr, format(root))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExpression(%q) returned %v", tt.expr, err)
+			}
+			if got := format(root); got != tt.want {
+				t.Errorf("parseExpression(%q) = %s, want %s", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateExpression(t *testing.T) {
+	limits := config.ExpressionLimits{MaxLength: 20, MaxTokens: 10, MaxDepth: 2, MaxTasks: 3}
+
+	tests := []struct {
+		expr      string
+		wantLimit string
+		wantErr   error
+	}{
+		{expr: "1+2*3"},
+		{expr: "((1+2))"},
+		{expr: "fx(1,2)+3"},
+		{expr: "1+2+3+4+5+6+7+8+9+10", wantLimit: "max_tokens"},
+		{expr: "1111111111+2222222222", wantLimit: "max_length"},
+		{expr: "(((1)))", wantLimit: "max_depth"},
+		{expr: "1+2+3+4+5", wantLimit: "max_tasks"},
+		{expr: "1+2)", wantErr: errUnbalancedParentheses},
+		{expr: "(1+2", wantErr: errUnbalancedParentheses},
+		{expr: ")1+2(", wantErr: errUnbalancedParentheses},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			err := validateExpression(tt.expr, map[string]bool{"fx": true}, limits)
+
+			var limitErr *ExpressionLimitError
+			switch {
+			case tt.wantLimit != "":
+				if !errors.As(err, &limitErr) || limitErr.Limit != tt.wantLimit {
+					t.Errorf("validateExpression(%q) = %v, want the %s limit", tt.expr, err, tt.wantLimit)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("validateExpression(%q) = %v, want %v", tt.expr, err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("validateExpression(%q) = %v, want no error", tt.expr, err)
+			}
+		})
+	}
+}
+
+func TestIsIdentifier(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{token: "fx", want: true},
+		{token: "ж", want: true},
+		{token: "é1", want: true},
+		{token: "12", want: false},
+		{token: ".5", want: false},
+		// an Arabic-Indic digit, its first byte alone would read as a Latin letter
+		{token: "١", want: false},
+		{token: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isIdentifier(tt.token); got != tt.want {
+			t.Errorf("isIdentifier(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
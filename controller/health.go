@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/health"
+)
+
+// readinessTimeout bounds all checks of a single /readyz request
+const readinessTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks health.Result `json:"checks,omitempty"`
+}
+
+// HandleHealthz reports that the process is alive and serving HTTP.
+func HandleHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// HandleReadyz reports whether the orchestrator can accept expressions and agents.
+func HandleReadyz(checks []health.Check) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+		defer cancel()
+
+		result, ready := health.RunChecks(ctx, checks)
+		if !ready {
+			return c.JSON(http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Checks: result})
+		}
+
+		return c.JSON(http.StatusOK, HealthResponse{Status: "ok", Checks: result})
+	}
+}
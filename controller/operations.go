@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/operation/wasm"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// maxModuleSize limits uploaded WASM modules, agents keep all of them in memory
+const maxModuleSize = 1 << 20
+
+type OperationsResponse struct {
+	Operators []string `json:"operators"`
+	// Functions are custom operations used as name(a, b)
+	Functions []string `json:"functions"`
+}
+
+// customFunctions returns the names of the custom operations usable in
+// expressions and the hashes of their modules.
+func customFunctions(customOperations model.CustomOperationRepository) (map[string]bool, map[string]string, error) {
+	operations, err := customOperations.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	functions := make(map[string]bool, len(operations))
+	versions := make(map[string]string, len(operations))
+	for _, operation := range operations {
+		functions[operation.Name] = true
+		versions[operation.Name] = operation.Hash
+	}
+
+	return functions, versions, nil
+}
+
+func HandleGetOperations(customOperations model.CustomOperationRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		operations, err := customOperations.List()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		response := OperationsResponse{Functions: []string{}}
+		for operator := range precedence {
+			response.Operators = append(response.Operators, operator)
+		}
+		sort.Strings(response.Operators)
+		for _, operation := range operations {
+			response.Functions = append(response.Functions, operation.Name)
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func HandleListCustomOperations(customOperations model.CustomOperationRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		operations, err := customOperations.List()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"operations": operations})
+	}
+}
+
+// HandleUploadCustomOperation stores the WASM module sent as the request body.
+func HandleUploadCustomOperation(customOperations model.CustomOperationRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if !wasm.IsValidName(name) {
+			return c.JSON(http.StatusUnprocessableEntity, "Name must start with a lowercase letter and contain up to 32 lowercase letters, digits and underscores")
+		}
+
+		module, err := io.ReadAll(io.LimitReader(c.Request().Body, maxModuleSize+1))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if len(module) > maxModuleSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, fmt.Sprintf("Module must not exceed %d bytes", maxModuleSize))
+		}
+
+		if err := wasm.Validate(c.Request().Context(), module); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, err.Error())
+		}
+
+		hash := sha256.Sum256(module)
+		operation := &model.CustomOperation{
+			Name:   name,
+			Hash:   hex.EncodeToString(hash[:]),
+			Size:   len(module),
+			Module: module,
+		}
+		if err := customOperations.Save(operation); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, operation)
+	}
+}
+
+// HandleDeleteCustomOperation removes the operation and fails the pending
+// expressions using it, no agent would compute their tasks.
+func HandleDeleteCustomOperation(customOperations model.CustomOperationRepository, tasks model.TaskRepository, expressions model.ExpressionRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if _, err := customOperations.Get(name); err != nil {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("operation %s not found", name))
+		}
+
+		// deleted first, so no expression using it is accepted afterwards
+		if err := customOperations.Delete(name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		reason := fmt.Sprintf("custom operation %s was deleted", name)
+		if _, err := model.FailOperation(expressions, tasks, name, reason); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/quota"
+	"github.com/raikh/calc_micro_final/middleware"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+const maxAPIKeyNameLength = 64
+
+type UsageResponse struct {
+	User quota.Report `json:"user"`
+	// APIKey is set when the request is authenticated with an API key
+	APIKey *quota.Report `json:"api_key,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name string `json:"name"`
+	// Quota of the key, zero limits leave only the quota of the user
+	Quota model.Quota `json:"quota"`
+}
+
+type APIKeyResponse struct {
+	model.APIKey
+	// Key is shown only once, on creation
+	Key string `json:"key"`
+}
+
+type QuotasResponse struct {
+	Defaults model.Quota           `json:"defaults"`
+	Users    map[int64]model.Quota `json:"users"`
+}
+
+func HandleGetUsage(quotas *quota.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("user").(model.User)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		userReport, keyReport, err := quotas.Usage(user, middleware.APIKey(c))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, UsageResponse{User: userReport, APIKey: keyReport})
+	}
+}
+
+func HandleCreateAPIKey(apiKeys model.APIKeyRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("user").(model.User)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		// a leaked key must not be able to create more keys
+		if middleware.APIKey(c) != nil {
+			return c.JSON(http.StatusForbidden, "API keys can be created only with a login token")
+		}
+
+		req := new(APIKeyRequest)
+		if err := c.Bind(req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+			return c.JSON(http.StatusUnprocessableEntity, fmt.Sprintf("Name must have 1 to %d characters", maxAPIKeyNameLength))
+		}
+		if !req.Quota.IsValid() {
+			return c.JSON(http.StatusUnprocessableEntity, "Quota limits must not be negative")
+		}
+
+		key, apiKey, err := model.NewAPIKey(user.Id, req.Name, req.Quota)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if err := apiKeys.Create(apiKey); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusCreated, APIKeyResponse{APIKey: *apiKey, Key: key})
+	}
+}
+
+func HandleGetAPIKeys(apiKeys model.APIKeyRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("user").(model.User)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		keys, err := apiKeys.GetByUserId(user.Id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"api_keys": keys})
+	}
+}
+
+func HandleDeleteAPIKey(apiKeys model.APIKeyRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, ok := c.Get("user").(model.User)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, "Invalid key id")
+		}
+
+		deleted, err := apiKeys.Delete(id, user.Id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		if !deleted {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("api key with id %d not found", id))
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func quotasResponse(quotas *quota.Service, userQuotas model.QuotaRepository) (QuotasResponse, error) {
+	overrides, err := userQuotas.GetOverrides()
+	if err != nil {
+		return QuotasResponse{}, err
+	}
+
+	return QuotasResponse{Defaults: quotas.Defaults(), Users: overrides}, nil
+}
+
+func HandleGetQuotas(quotas *quota.Service, userQuotas model.QuotaRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		response, err := quotasResponse(quotas, userQuotas)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func HandleSetUserQuota(quotas *quota.Service, userQuotas model.QuotaRepository, users model.UserRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, "Invalid user id")
+		}
+
+		req := new(model.Quota)
+		if err := c.Bind(req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if !req.IsValid() {
+			return c.JSON(http.StatusUnprocessableEntity, "Quota limits must not be negative")
+		}
+
+		if _, err := users.GetById(userId); err != nil {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("user with id %d not found", userId))
+		}
+
+		if err := userQuotas.Set(userId, *req); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		response, err := quotasResponse(quotas, userQuotas)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func HandleDeleteUserQuota(userQuotas model.QuotaRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, "Invalid user id")
+		}
+
+		if err := userQuotas.Delete(userId); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+func HandleGetDeadLetter(tasks model.TaskRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		deadLettered, err := tasks.GetDeadLettered()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"tasks": deadLettered})
+	}
+}
+
+// HandleRequeueTask gives a dead-lettered task all its attempts again, its
+// expression is pending again once it has no other dead-lettered tasks.
+func HandleRequeueTask(tasks model.TaskRepository, expressions model.ExpressionRepository) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+
+		task, err := tasks.GetById(id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, fmt.Sprintf("task with id %s not found", id))
+		}
+
+		if !task.DeadLetter {
+			return c.JSON(http.StatusConflict, "Task is not dead-lettered")
+		}
+
+		task.DeadLetter = false
+		task.FailureReason = ""
+		task.Attempts = 0
+		task.IsProcessing = false
+		task.DispatchedAt = nil
+		if err := tasks.Update(task); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		if err := model.ResumeExpression(expressions, tasks, task.ExpressionId); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, task)
+	}
+}
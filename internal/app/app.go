@@ -3,9 +3,39 @@ package app
 import (
 	"github.com/jmoiron/sqlx"
 	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+	"github.com/raikh/calc_micro_final/internal/planner"
+	"github.com/raikh/calc_micro_final/internal/quota"
+	"github.com/raikh/calc_micro_final/internal/resultcache"
+	"github.com/raikh/calc_micro_final/model"
+	grpchealth "google.golang.org/grpc/health"
 )
 
 type App struct {
 	Cfg *config.Config
-	DB  *sqlx.DB
+	// DB is nil when the application runs with in-memory storage
+	DB          *sqlx.DB
+	Users       model.UserRepository
+	Expressions model.ExpressionRepository
+	Tasks       model.TaskRepository
+	// OperationTimes are seeded from the configuration on the first start
+	OperationTimes model.OperationTimeRepository
+	// CustomOperations are WASM operations uploaded by admins
+	CustomOperations model.CustomOperationRepository
+	APIKeys          model.APIKeyRepository
+	// UserQuotas replace the configured quota for single users
+	UserQuotas model.QuotaRepository
+	// Replicas are copies of tasks given to several agents when results are verified
+	Replicas model.ReplicaRepository
+	// Agents count disagreements of agents with verified results
+	Agents model.AgentRepository
+	// Quotas limits users and their API keys
+	Quotas *quota.Service
+	// Planner makes tasks of parsed expressions
+	Planner *planner.Planner
+	// ResultCache is filled with results sent by agents, nil when disabled
+	ResultCache *resultcache.Cache
+	Metrics     *metrics.Orchestrator
+	// GRPCHealth serves grpc.health.v1 and tells agents whether tasks can be taken
+	GRPCHealth *grpchealth.Server
 }
@@ -1,66 +1,510 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
-	"strings"
-
-	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// Component selects which part of the configuration a binary uses.
+type Component int
+
+const (
+	Orchestrator Component = 1 << iota
+	Agent
+
+	Common = Orchestrator | Agent
+)
+
+type DBConfig struct {
+	Type     string
+	Host     string
+	Port     int
+	User     string
+	Name     string
+	Password string
+}
+
+type OperationTimes struct {
+	Addition       time.Duration
+	Subtraction    time.Duration
+	Multiplication time.Duration
+	Division       time.Duration
+}
+
+type AgentConfig struct {
+	ComputingPower int
+	GRPCAddress    string
+	GRPCPort       int
+	// Orchestrators are host:port addresses of several orchestrators, they
+	// replace GRPCAddress and GRPCPort when set
+	Orchestrators []string
+	// MetricsAddress of the agent metrics listener, empty disables it
+	MetricsAddress string
+	// Id identifies the agent in the orchestrator logs, hostname and pid when empty
+	Id string
+	// Token authenticates the agent, it must match APP_AGENT_TOKENS of the orchestrator
+	Token string
+	TLS   AgentTLSConfig
+	// BackoffMin and BackoffMax bound the delay between retries while the orchestrator is unreachable
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// ResultBuffer is how many computed results wait for submission before workers stop taking tasks
+	ResultBuffer int
+	// DrainTimeout is how long buffered results are still sent on shutdown
+	DrainTimeout time.Duration
+	// OperationsSyncInterval is how often custom operations are loaded, zero disables them
+	OperationsSyncInterval time.Duration
+	// WASMMemoryPages and WASMTimeout limit every call of a custom operation
+	WASMMemoryPages int
+	WASMTimeout     time.Duration
+}
+
+// AgentTLSConfig secures the connection to the orchestrator.
+type AgentTLSConfig struct {
+	Enabled bool
+	// CAFile verifies the orchestrator certificate, system roots are used when empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mTLS
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+// GRPCTLSConfig enables TLS on the task server when CertFile is set.
+type GRPCTLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires agents to present a certificate signed by it (mTLS)
+	ClientCAFile string
+}
+
+type LogConfig struct {
+	// Format is text or json
+	Format string
+	Level  string
+}
+
+// ExpressionLimits bound the size of a single expression for every user.
+type ExpressionLimits struct {
+	// MaxLength is in characters
+	MaxLength int
+	MaxTokens int
+	// MaxDepth is the nesting of parentheses
+	MaxDepth int
+	// MaxTasks is the number of operations
+	MaxTasks int
+}
+
+type PlannerConfig struct {
+	// FoldConstants computes operations on literals in the orchestrator, without their delays
+	FoldConstants bool
+	// ShareSubexpressions computes identical parts of an expression once
+	ShareSubexpressions bool
+	// Rebalance regroups chains of + and * to compute them in parallel
+	Rebalance bool
+}
+
+// TaskRetryConfig limits how often a task is given to another agent when its agent vanishes.
+type TaskRetryConfig struct {
+	MaxAttempts int
+	// Backoff is added to the redistribution delay and doubles with every attempt up to BackoffMax
+	Backoff    time.Duration
+	BackoffMax time.Duration
+}
+
+// VerificationConfig makes several agents compute every task and accepts the result a quorum agrees on.
+type VerificationConfig struct {
+	// Replicas is the number of agents computing a task, 1 disables the verification
+	Replicas int
+	// Quorum is the number of equal results accepted, zero means a majority of the replicas
+	Quorum int
+	// QuarantineAfter disagreements an agent gets no more tasks, zero never quarantines
+	QuarantineAfter int
+}
+
+// SchedulerConfig sets the share of the agents users of every role get: a user
+// with weight 2 gets twice the tasks of a user with weight 1 while both wait.
+type SchedulerConfig struct {
+	UserWeight    int
+	PremiumWeight int
+	AdminWeight   int
+}
+
+// RequiredQuorum returns the number of agents which must agree on a result.
+func (c VerificationConfig) RequiredQuorum() int {
+	if c.Quorum > 0 {
+		return c.Quorum
+	}
+	return c.Replicas/2 + 1
+}
+
+// ResultCacheConfig bounds the cache of computed subexpressions.
+type ResultCacheConfig struct {
+	// Size is the number of results kept, zero disables the cache
+	Size int
+	TTL  time.Duration
+}
+
+// QuotaConfig are the default limits of every user, zero means unlimited.
+type QuotaConfig struct {
+	RequestsPerMinute     int
+	MaxPendingExpressions int
+	MaxOperations         int
+	DailyTasks            int
+}
+
+type TracingConfig struct {
+	// Exporter is one of none, stdout or otlp
+	Exporter     string
+	OTLPEndpoint string
+	OTLPInsecure bool
+}
+
 type Config struct {
-	data map[string]string
+	// RootDir is the directory of the .env file or the working directory if there is none
+	RootDir string
+	Env     string
+
+	ListenAddress string
+	HTTPPort      int
+	GRPCPort      int
+	GRPCTLS       GRPCTLSConfig
+	// AgentTokens maps agent ids to their tokens, empty disables token authentication
+	AgentTokens map[string]string
+
+	JWTSecretKey        string
+	JWTRefreshSecretKey string
+	JWTExpiration       time.Duration
+	// AdminEmails of registered users get the admin role at startup
+	AdminEmails []string
+
+	DB DBConfig
+
+	OperationTimes        OperationTimes
+	TaskRedistributeDelay time.Duration
+	TaskRetry             TaskRetryConfig
+	Verification          VerificationConfig
+	Scheduler             SchedulerConfig
+
+	Quota            QuotaConfig
+	ExpressionLimits ExpressionLimits
+	Planner          PlannerConfig
+	ResultCache      ResultCacheConfig
+
+	Agent AgentConfig
+
+	Tracing TracingConfig
+
+	Log LogConfig
+
+	PrintConfig bool
+
+	component Component
 }
 
-func InitConfig() *Config {
-	rootDir := getRootDir()
-	err := godotenv.Load(filepath.Join(rootDir, ".env"))
+func defaultConfig() *Config {
+	return &Config{
+		Env:           "production",
+		ListenAddress: "localhost",
+		HTTPPort:      1234,
+		GRPCPort:      5000,
+		JWTExpiration: 720 * time.Hour,
+		DB: DBConfig{
+			Type: "sqlite",
+			Name: "./golang.sqlite",
+		},
+		OperationTimes: OperationTimes{
+			Addition:       time.Second,
+			Subtraction:    time.Second,
+			Multiplication: time.Second,
+			Division:       time.Second,
+		},
+		TaskRedistributeDelay: 60 * time.Second,
+		TaskRetry: TaskRetryConfig{
+			MaxAttempts: 5,
+			Backoff:     5 * time.Second,
+			BackoffMax:  5 * time.Minute,
+		},
+		Verification: VerificationConfig{
+			Replicas:        1,
+			QuarantineAfter: 3,
+		},
+		Scheduler: SchedulerConfig{
+			UserWeight:    1,
+			PremiumWeight: 2,
+			AdminWeight:   4,
+		},
+		ExpressionLimits: ExpressionLimits{
+			MaxLength: 10000,
+			MaxTokens: 4000,
+			MaxDepth:  100,
+			MaxTasks:  2000,
+		},
+		Planner: PlannerConfig{
+			ShareSubexpressions: true,
+			Rebalance:           true,
+		},
+		ResultCache: ResultCacheConfig{
+			Size: 0,
+			TTL:  time.Hour,
+		},
+		Agent: AgentConfig{
+			ComputingPower: 2,
+			GRPCAddress:    "localhost",
+			GRPCPort:       5000,
+			MetricsAddress: "localhost:2112",
+			BackoffMin:     500 * time.Millisecond,
+			BackoffMax:     30 * time.Second,
+			ResultBuffer:   100,
+			DrainTimeout:   10 * time.Second,
+
+			OperationsSyncInterval: 10 * time.Second,
+			WASMMemoryPages:        16,
+			WASMTimeout:            time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "localhost:4317",
+			OTLPInsecure: true,
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+// InitConfig loads the configuration of the component from defaults, optional .env file,
+// environment variables and command line flags (in order of increasing priority).
+// Invalid configuration stops the program with the list of all found problems.
+func InitConfig(component Component) *Config {
+	cfg, err := Load(component, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err.Error())
+		// every problem on its own line, the log formatter would escape line breaks
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
 	}
 
-	cfg := new(Config)
-	cfg.data = make(map[string]string)
-	cfg.data["ROOT_DIR"] = rootDir
-	for _, item := range os.Environ() {
-		splits := strings.SplitN(item, "=", 2)
-		cfg.data[splits[0]] = splits[1]
+	if cfg.PrintConfig {
+		cfg.Print(os.Stdout)
+		os.Exit(0)
 	}
 
 	return cfg
 }
 
-func (cfg *Config) GetKey(key string) string {
-	value, ok := cfg.data[key]
+func Load(component Component, args []string) (*Config, error) {
+	rootDir, found := findRootDir()
+	if found {
+		if err := godotenv.Load(filepath.Join(rootDir, ".env")); err != nil {
+			return nil, fmt.Errorf("error loading .env file: %w", err)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.RootDir = rootDir
+	cfg.component = component
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	var errs []error
+	for _, opt := range cfg.options() {
+		fs.Var(opt.value, opt.flag, opt.describe())
+		if opt.env == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(opt.env); ok {
+			if err := opt.value.Set(value); err != nil {
+				if opt.secret {
+					value = "<redacted>"
+				}
+				errs = append(errs, fmt.Errorf("%s: invalid value %q: %w", opt.env, value, err))
+			}
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return cfg, nil
+}
+
+// Print writes the configuration in .env format with secret values redacted.
+func (cfg *Config) Print(w io.Writer) {
+	for _, opt := range cfg.options() {
+		if opt.env == "" {
+			continue
+		}
+		value := opt.value.String()
+		if opt.secret && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "%s=%s\n", opt.env, value)
+	}
+}
+
+func (cfg *Config) Is(component Component) bool {
+	return cfg.component&component != 0
+}
 
-	if !ok {
-		log.Fatalf("Undefined config key: %s", key)
+func (cfg *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
 	}
+	validPort := func(port int) bool { return port > 0 && port <= 65535 }
+
+	if cfg.Is(Orchestrator) {
+		check(cfg.ListenAddress != "", "APP_LISTENING_ADDRESS must not be empty")
+		check(validPort(cfg.HTTPPort), "APP_HTTP_LISTEN_PORT must be between 1 and 65535, got %d", cfg.HTTPPort)
+		check(validPort(cfg.GRPCPort), "APP_GRPC_LISTEN_PORT must be between 1 and 65535, got %d", cfg.GRPCPort)
+		check(cfg.HTTPPort != cfg.GRPCPort, "APP_HTTP_LISTEN_PORT and APP_GRPC_LISTEN_PORT must differ")
+
+		check(cfg.JWTSecretKey != "", "APP_JWT_SECRET_KEY must not be empty")
+		check(cfg.JWTRefreshSecretKey != "", "APP_JWT_REFRESH_SECRET_KEY must not be empty")
+		check(cfg.JWTExpiration > 0, "APP_JWT_EXPIRATION_HOURS must be positive")
+
+		switch cfg.DB.Type {
+		case "memory":
+		case "sqlite":
+			check(cfg.DB.Name != "", "APP_DB_NAME must not be empty")
+		case "mysql", "postgres":
+			check(cfg.DB.Name != "", "APP_DB_NAME must not be empty")
+			check(cfg.DB.Host != "", "APP_DB_HOST must not be empty")
+			check(validPort(cfg.DB.Port), "APP_DB_PORT must be between 1 and 65535, got %d", cfg.DB.Port)
+			check(cfg.DB.User != "", "APP_DB_USER must not be empty")
+		default:
+			errs = append(errs, fmt.Errorf("APP_DB_TYPE must be one of sqlite, mysql, postgres, memory, got %q", cfg.DB.Type))
+		}
 
-	return value
+		check(cfg.OperationTimes.Addition >= 0, "TIME_ADDITION_MS must not be negative")
+		check(cfg.OperationTimes.Subtraction >= 0, "TIME_SUBTRACTION_MS must not be negative")
+		check(cfg.OperationTimes.Multiplication >= 0, "TIME_MULTIPLICATIONS_MS must not be negative")
+		check(cfg.OperationTimes.Division >= 0, "TIME_DIVISIONS_MS must not be negative")
+		check(cfg.TaskRedistributeDelay >= time.Second, "TIME_TASK_IN_PROGRESS_REDISTRIBUTE must be at least 1 second")
+		check(cfg.TaskRetry.MaxAttempts > 0, "APP_TASK_MAX_ATTEMPTS must be positive, got %d", cfg.TaskRetry.MaxAttempts)
+		check(cfg.TaskRetry.Backoff >= 0, "APP_TASK_RETRY_BACKOFF must not be negative")
+		check(cfg.TaskRetry.BackoffMax >= cfg.TaskRetry.Backoff, "APP_TASK_RETRY_BACKOFF_MAX must not be less than APP_TASK_RETRY_BACKOFF")
+		check(cfg.Verification.Replicas > 0, "APP_VERIFICATION_REPLICAS must be positive, got %d", cfg.Verification.Replicas)
+		check(cfg.Verification.Quorum >= 0 && cfg.Verification.Quorum <= cfg.Verification.Replicas,
+			"APP_VERIFICATION_QUORUM must be between 0 and APP_VERIFICATION_REPLICAS, got %d", cfg.Verification.Quorum)
+		check(cfg.Verification.QuarantineAfter >= 0, "APP_VERIFICATION_QUARANTINE_AFTER must not be negative")
+		// the quorum counts distinct agents, an agent without a token could claim any id
+		check(cfg.Verification.Replicas <= 1 || len(cfg.AgentTokens) > 0,
+			"APP_VERIFICATION_REPLICAS above 1 requires per-agent tokens in APP_AGENT_TOKENS")
+		check(len(cfg.AgentTokens) == 0 || cfg.Verification.Replicas <= len(cfg.AgentTokens),
+			"APP_VERIFICATION_REPLICAS must not exceed the number of agents in APP_AGENT_TOKENS, got %d", cfg.Verification.Replicas)
+		tokenOwners := make(map[string]string, len(cfg.AgentTokens))
+		for agentId, token := range cfg.AgentTokens {
+			check(token != "", "APP_AGENT_TOKENS has an empty token of agent %s", agentId)
+			owner, taken := tokenOwners[token]
+			check(token == "" || !taken, "APP_AGENT_TOKENS gives agents %s and %s the same token", owner, agentId)
+			tokenOwners[token] = agentId
+		}
+		check(cfg.Scheduler.UserWeight > 0, "APP_SCHEDULER_WEIGHT_USER must be positive, got %d", cfg.Scheduler.UserWeight)
+		check(cfg.Scheduler.PremiumWeight > 0, "APP_SCHEDULER_WEIGHT_PREMIUM must be positive, got %d", cfg.Scheduler.PremiumWeight)
+		check(cfg.Scheduler.AdminWeight > 0, "APP_SCHEDULER_WEIGHT_ADMIN must be positive, got %d", cfg.Scheduler.AdminWeight)
+
+		check(cfg.ResultCache.Size >= 0, "APP_RESULT_CACHE_SIZE must not be negative, got %d", cfg.ResultCache.Size)
+		check(cfg.ResultCache.TTL > 0, "APP_RESULT_CACHE_TTL must be positive")
+
+		check(cfg.Quota.RequestsPerMinute >= 0, "APP_QUOTA_REQUESTS_PER_MINUTE must not be negative")
+		check(cfg.Quota.MaxPendingExpressions >= 0, "APP_QUOTA_MAX_PENDING_EXPRESSIONS must not be negative")
+		check(cfg.Quota.MaxOperations >= 0, "APP_QUOTA_MAX_OPERATIONS must not be negative")
+		check(cfg.Quota.DailyTasks >= 0, "APP_QUOTA_DAILY_TASKS must not be negative")
+
+		check(cfg.ExpressionLimits.MaxLength > 0, "APP_EXPRESSION_MAX_LENGTH must be positive, got %d", cfg.ExpressionLimits.MaxLength)
+		check(cfg.ExpressionLimits.MaxTokens > 0, "APP_EXPRESSION_MAX_TOKENS must be positive, got %d", cfg.ExpressionLimits.MaxTokens)
+		check(cfg.ExpressionLimits.MaxDepth > 0, "APP_EXPRESSION_MAX_DEPTH must be positive, got %d", cfg.ExpressionLimits.MaxDepth)
+		check(cfg.ExpressionLimits.MaxTasks > 0, "APP_EXPRESSION_MAX_TASKS must be positive, got %d", cfg.ExpressionLimits.MaxTasks)
+
+		check((cfg.GRPCTLS.CertFile == "") == (cfg.GRPCTLS.KeyFile == ""), "APP_GRPC_TLS_CERT and APP_GRPC_TLS_KEY must be set together")
+		check(cfg.GRPCTLS.ClientCAFile == "" || cfg.GRPCTLS.CertFile != "", "APP_GRPC_TLS_CLIENT_CA requires APP_GRPC_TLS_CERT")
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		check(cfg.Tracing.OTLPEndpoint != "", "APP_TRACING_OTLP_ENDPOINT must not be empty")
+	default:
+		errs = append(errs, fmt.Errorf("APP_TRACING_EXPORTER must be one of none, stdout, otlp, got %q", cfg.Tracing.Exporter))
+	}
+
+	switch cfg.Log.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("APP_LOG_FORMAT must be one of text, json, got %q", cfg.Log.Format))
+	}
+	switch cfg.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("APP_LOG_LEVEL must be one of debug, info, warn, error, got %q", cfg.Log.Level))
+	}
+
+	if cfg.Is(Agent) {
+		check(cfg.Agent.ComputingPower > 0, "CLIENT_COMPUTING_POWER must be positive, got %d", cfg.Agent.ComputingPower)
+		check(cfg.Agent.GRPCAddress != "", "CLIENT_GRPC_ARRT must not be empty")
+		check(validPort(cfg.Agent.GRPCPort), "CLIENT_GRPC_PORT must be between 1 and 65535, got %d", cfg.Agent.GRPCPort)
+		for _, address := range cfg.Agent.Orchestrators {
+			host, port, err := net.SplitHostPort(address)
+			portNumber, _ := strconv.Atoi(port)
+			check(err == nil && host != "" && validPort(portNumber), "CLIENT_ORCHESTRATORS must contain host:port addresses, got %q", address)
+		}
+		check(cfg.Agent.BackoffMin > 0, "CLIENT_BACKOFF_MIN_MS must be positive")
+		check(cfg.Agent.BackoffMax >= cfg.Agent.BackoffMin, "CLIENT_BACKOFF_MAX_MS must not be less than CLIENT_BACKOFF_MIN_MS")
+		check(cfg.Agent.OperationsSyncInterval >= 0, "CLIENT_OPERATIONS_SYNC_INTERVAL must not be negative")
+		// 65536 pages are the whole 4 GiB address space of a WASM module
+		check(cfg.Agent.WASMMemoryPages > 0 && cfg.Agent.WASMMemoryPages <= 65536, "CLIENT_WASM_MEMORY_PAGES must be between 1 and 65536, got %d", cfg.Agent.WASMMemoryPages)
+		check(cfg.Agent.WASMTimeout > 0, "CLIENT_WASM_TIMEOUT_MS must be positive")
+		check(cfg.Agent.ResultBuffer > 0, "CLIENT_RESULT_BUFFER must be positive, got %d", cfg.Agent.ResultBuffer)
+		check(cfg.Agent.DrainTimeout >= 0, "CLIENT_DRAIN_TIMEOUT_MS must not be negative")
+		check(cfg.Agent.Token == "" || cfg.Agent.Id != "", "CLIENT_AGENT_TOKEN requires CLIENT_AGENT_ID")
+
+		agentTLS := cfg.Agent.TLS
+		check((agentTLS.CertFile == "") == (agentTLS.KeyFile == ""), "CLIENT_TLS_CERT and CLIENT_TLS_KEY must be set together")
+		check(agentTLS.Enabled || (agentTLS.CAFile == "" && agentTLS.CertFile == "" && agentTLS.ServerName == ""),
+			"CLIENT_TLS_CA, CLIENT_TLS_CERT and CLIENT_TLS_SERVER_NAME require CLIENT_TLS=true")
+	}
+
+	return errs
 }
 
-func getRootDir() string {
-	currentDir, err := os.Getwd()
+// findRootDir looks for the .env file in the working directory and its parents.
+func findRootDir() (string, bool) {
+	workDir, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 
+	currentDir := workDir
 	for {
-		goEnvPath := filepath.Join(currentDir, ".env")
-		if _, err := os.Stat(goEnvPath); err == nil {
-			break
+		if _, err := os.Stat(filepath.Join(currentDir, ".env")); err == nil {
+			return currentDir, true
 		}
 
 		parent := filepath.Dir(currentDir)
 		if parent == currentDir {
-			panic(fmt.Errorf("go.mod not found"))
+			return workDir, false
 		}
 		currentDir = parent
 	}
-
-	return currentDir
 }
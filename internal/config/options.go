@@ -0,0 +1,246 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// option binds a configuration field to its environment variable and command line flag.
+type option struct {
+	env    string
+	flag   string
+	usage  string
+	scope  Component
+	secret bool
+	value  flag.Value
+}
+
+func (o option) describe() string {
+	if o.env == "" {
+		return o.usage
+	}
+	return fmt.Sprintf("%s (env %s)", o.usage, o.env)
+}
+
+// options lists every configuration key of the component. Order is used by Print.
+func (cfg *Config) options() []option {
+	all := []option{
+		{env: "APP_ENV", flag: "env", usage: "application environment", scope: Common, value: (*stringValue)(&cfg.Env)},
+
+		{env: "APP_LISTENING_ADDRESS", flag: "listen-address", usage: "address to listen on", scope: Orchestrator, value: (*stringValue)(&cfg.ListenAddress)},
+		{env: "APP_HTTP_LISTEN_PORT", flag: "http-port", usage: "HTTP API port", scope: Orchestrator, value: (*intValue)(&cfg.HTTPPort)},
+		{env: "APP_GRPC_LISTEN_PORT", flag: "grpc-port", usage: "gRPC task server port", scope: Orchestrator, value: (*intValue)(&cfg.GRPCPort)},
+
+		{env: "APP_GRPC_TLS_CERT", flag: "grpc-tls-cert", usage: "task server certificate file, enables TLS", scope: Orchestrator, value: (*stringValue)(&cfg.GRPCTLS.CertFile)},
+		{env: "APP_GRPC_TLS_KEY", flag: "grpc-tls-key", usage: "task server private key file", scope: Orchestrator, value: (*stringValue)(&cfg.GRPCTLS.KeyFile)},
+		{env: "APP_GRPC_TLS_CLIENT_CA", flag: "grpc-tls-client-ca", usage: "CA file for agent certificates, enables mTLS", scope: Orchestrator, value: (*stringValue)(&cfg.GRPCTLS.ClientCAFile)},
+		{env: "APP_AGENT_TOKENS", flag: "agent-tokens", usage: "comma separated agent_id=token pairs, empty disables agent authentication", scope: Orchestrator, secret: true, value: (*mapValue)(&cfg.AgentTokens)},
+
+		{env: "APP_JWT_SECRET_KEY", flag: "jwt-secret-key", usage: "secret for access tokens", scope: Orchestrator, secret: true, value: (*stringValue)(&cfg.JWTSecretKey)},
+		{env: "APP_JWT_REFRESH_SECRET_KEY", flag: "jwt-refresh-secret-key", usage: "secret for refresh tokens", scope: Orchestrator, secret: true, value: (*stringValue)(&cfg.JWTRefreshSecretKey)},
+		{env: "APP_JWT_EXPIRATION_HOURS", flag: "jwt-expiration", usage: "access token lifetime in hours", scope: Orchestrator, value: &durationValue{&cfg.JWTExpiration, time.Hour}},
+
+		{env: "APP_ADMIN_EMAILS", flag: "admin-emails", usage: "comma separated emails of registered users which get the admin role at startup", scope: Orchestrator, value: (*listValue)(&cfg.AdminEmails)},
+
+		{env: "APP_DB_TYPE", flag: "db-type", usage: "database type: sqlite, mysql, postgres or memory", scope: Orchestrator, value: (*stringValue)(&cfg.DB.Type)},
+		{env: "APP_DB_HOST", flag: "db-host", usage: "database host", scope: Orchestrator, value: (*stringValue)(&cfg.DB.Host)},
+		{env: "APP_DB_PORT", flag: "db-port", usage: "database port", scope: Orchestrator, value: (*intValue)(&cfg.DB.Port)},
+		{env: "APP_DB_USER", flag: "db-user", usage: "database user", scope: Orchestrator, value: (*stringValue)(&cfg.DB.User)},
+		{env: "APP_DB_NAME", flag: "db-name", usage: "database name or sqlite file", scope: Orchestrator, value: (*stringValue)(&cfg.DB.Name)},
+		{env: "APP_DB_PASSWORD", flag: "db-password", usage: "database password", scope: Orchestrator, secret: true, value: (*stringValue)(&cfg.DB.Password)},
+
+		{env: "TIME_ADDITION_MS", flag: "time-addition", usage: "addition delay in ms", scope: Orchestrator, value: &durationValue{&cfg.OperationTimes.Addition, time.Millisecond}},
+		{env: "TIME_SUBTRACTION_MS", flag: "time-subtraction", usage: "subtraction delay in ms", scope: Orchestrator, value: &durationValue{&cfg.OperationTimes.Subtraction, time.Millisecond}},
+		{env: "TIME_MULTIPLICATIONS_MS", flag: "time-multiplication", usage: "multiplication delay in ms", scope: Orchestrator, value: &durationValue{&cfg.OperationTimes.Multiplication, time.Millisecond}},
+		{env: "TIME_DIVISIONS_MS", flag: "time-division", usage: "division delay in ms", scope: Orchestrator, value: &durationValue{&cfg.OperationTimes.Division, time.Millisecond}},
+		{env: "TIME_TASK_IN_PROGRESS_REDISTRIBUTE", flag: "task-redistribute-delay", usage: "seconds before a task in progress is given to another worker", scope: Orchestrator, value: &durationValue{&cfg.TaskRedistributeDelay, time.Second}},
+		{env: "APP_TASK_MAX_ATTEMPTS", flag: "task-max-attempts", usage: "times a task is given to agents before it fails the expression", scope: Orchestrator, value: (*intValue)(&cfg.TaskRetry.MaxAttempts)},
+		{env: "APP_TASK_RETRY_BACKOFF", flag: "task-retry-backoff", usage: "seconds added to the redistribution delay, doubled with every attempt", scope: Orchestrator, value: &durationValue{&cfg.TaskRetry.Backoff, time.Second}},
+		{env: "APP_TASK_RETRY_BACKOFF_MAX", flag: "task-retry-backoff-max", usage: "maximal seconds added to the redistribution delay", scope: Orchestrator, value: &durationValue{&cfg.TaskRetry.BackoffMax, time.Second}},
+		{env: "APP_VERIFICATION_REPLICAS", flag: "verification-replicas", usage: "distinct agents computing every task, 1 disables the verification", scope: Orchestrator, value: (*intValue)(&cfg.Verification.Replicas)},
+		{env: "APP_VERIFICATION_QUORUM", flag: "verification-quorum", usage: "equal results needed to accept a task, 0 is a majority of the replicas", scope: Orchestrator, value: (*intValue)(&cfg.Verification.Quorum)},
+		{env: "APP_VERIFICATION_QUARANTINE_AFTER", flag: "verification-quarantine-after", usage: "disagreements before an agent is quarantined, 0 never quarantines", scope: Orchestrator, value: (*intValue)(&cfg.Verification.QuarantineAfter)},
+		{env: "APP_SCHEDULER_WEIGHT_USER", flag: "scheduler-weight-user", usage: "share of the agents of a user with the user role", scope: Orchestrator, value: (*intValue)(&cfg.Scheduler.UserWeight)},
+		{env: "APP_SCHEDULER_WEIGHT_PREMIUM", flag: "scheduler-weight-premium", usage: "share of the agents of a premium user", scope: Orchestrator, value: (*intValue)(&cfg.Scheduler.PremiumWeight)},
+		{env: "APP_SCHEDULER_WEIGHT_ADMIN", flag: "scheduler-weight-admin", usage: "share of the agents of an admin", scope: Orchestrator, value: (*intValue)(&cfg.Scheduler.AdminWeight)},
+
+		{env: "APP_EXPRESSION_MAX_LENGTH", flag: "expression-max-length", usage: "maximal expression length in characters", scope: Orchestrator, value: (*intValue)(&cfg.ExpressionLimits.MaxLength)},
+		{env: "APP_EXPRESSION_MAX_TOKENS", flag: "expression-max-tokens", usage: "maximal number of numbers, operators and parentheses in an expression", scope: Orchestrator, value: (*intValue)(&cfg.ExpressionLimits.MaxTokens)},
+		{env: "APP_EXPRESSION_MAX_DEPTH", flag: "expression-max-depth", usage: "maximal nesting of parentheses", scope: Orchestrator, value: (*intValue)(&cfg.ExpressionLimits.MaxDepth)},
+		{env: "APP_EXPRESSION_MAX_TASKS", flag: "expression-max-tasks", usage: "maximal number of operations in an expression", scope: Orchestrator, value: (*intValue)(&cfg.ExpressionLimits.MaxTasks)},
+
+		{env: "APP_PLANNER_FOLD_CONSTANTS", flag: "planner-fold-constants", usage: "compute operations on numbers in the orchestrator without their delays", scope: Orchestrator, value: (*boolValue)(&cfg.Planner.FoldConstants)},
+		{env: "APP_PLANNER_REBALANCE", flag: "planner-rebalance", usage: "regroup chains of + and * to compute them in parallel", scope: Orchestrator, value: (*boolValue)(&cfg.Planner.Rebalance)},
+		{env: "APP_PLANNER_SHARE_SUBEXPRESSIONS", flag: "planner-share-subexpressions", usage: "compute identical parts of an expression once", scope: Orchestrator, value: (*boolValue)(&cfg.Planner.ShareSubexpressions)},
+
+		{env: "APP_RESULT_CACHE_SIZE", flag: "result-cache-size", usage: "computed subexpressions kept for reuse, 0 disables the cache", scope: Orchestrator, value: (*intValue)(&cfg.ResultCache.Size)},
+		{env: "APP_RESULT_CACHE_TTL", flag: "result-cache-ttl", usage: "seconds a computed subexpression is reused", scope: Orchestrator, value: &durationValue{&cfg.ResultCache.TTL, time.Second}},
+
+		{env: "APP_QUOTA_REQUESTS_PER_MINUTE", flag: "quota-requests-per-minute", usage: "calculation requests per minute of a user, 0 is unlimited", scope: Orchestrator, value: (*intValue)(&cfg.Quota.RequestsPerMinute)},
+		{env: "APP_QUOTA_MAX_PENDING_EXPRESSIONS", flag: "quota-max-pending-expressions", usage: "expressions of a user being calculated at once, 0 is unlimited", scope: Orchestrator, value: (*intValue)(&cfg.Quota.MaxPendingExpressions)},
+		{env: "APP_QUOTA_MAX_OPERATIONS", flag: "quota-max-operations", usage: "operations in one expression, 0 is unlimited", scope: Orchestrator, value: (*intValue)(&cfg.Quota.MaxOperations)},
+		{env: "APP_QUOTA_DAILY_TASKS", flag: "quota-daily-tasks", usage: "operations a user may submit per UTC day, 0 is unlimited", scope: Orchestrator, value: (*intValue)(&cfg.Quota.DailyTasks)},
+
+		{env: "CLIENT_COMPUTING_POWER", flag: "computing-power", usage: "number of calculation workers", scope: Agent, value: (*intValue)(&cfg.Agent.ComputingPower)},
+		{env: "CLIENT_GRPC_ARRT", flag: "orchestrator-address", usage: "orchestrator gRPC address", scope: Agent, value: (*stringValue)(&cfg.Agent.GRPCAddress)},
+		{env: "CLIENT_GRPC_PORT", flag: "orchestrator-port", usage: "orchestrator gRPC port", scope: Agent, value: (*intValue)(&cfg.Agent.GRPCPort)},
+		{env: "CLIENT_ORCHESTRATORS", flag: "orchestrators", usage: "comma separated host:port addresses of orchestrators, replaces the address and port above", scope: Agent, value: (*listValue)(&cfg.Agent.Orchestrators)},
+		{env: "CLIENT_METRICS_ADDRESS", flag: "metrics-address", usage: "address of the agent metrics endpoint, empty disables it", scope: Agent, value: (*stringValue)(&cfg.Agent.MetricsAddress)},
+
+		{env: "CLIENT_BACKOFF_MIN_MS", flag: "backoff-min", usage: "first retry delay in ms when the orchestrator is unreachable", scope: Agent, value: &durationValue{&cfg.Agent.BackoffMin, time.Millisecond}},
+		{env: "CLIENT_BACKOFF_MAX_MS", flag: "backoff-max", usage: "maximal retry delay in ms", scope: Agent, value: &durationValue{&cfg.Agent.BackoffMax, time.Millisecond}},
+		{env: "CLIENT_RESULT_BUFFER", flag: "result-buffer", usage: "computed results kept until the orchestrator acknowledges them", scope: Agent, value: (*intValue)(&cfg.Agent.ResultBuffer)},
+		{env: "CLIENT_DRAIN_TIMEOUT_MS", flag: "drain-timeout", usage: "time in ms to send buffered results on shutdown", scope: Agent, value: &durationValue{&cfg.Agent.DrainTimeout, time.Millisecond}},
+		{env: "CLIENT_OPERATIONS_SYNC_INTERVAL", flag: "operations-sync-interval", usage: "seconds between loading custom operations from the orchestrator, 0 disables them", scope: Agent, value: &durationValue{&cfg.Agent.OperationsSyncInterval, time.Second}},
+		{env: "CLIENT_WASM_MEMORY_PAGES", flag: "wasm-memory-pages", usage: "memory limit of a custom operation call in 64 KiB pages", scope: Agent, value: (*intValue)(&cfg.Agent.WASMMemoryPages)},
+		{env: "CLIENT_WASM_TIMEOUT_MS", flag: "wasm-timeout", usage: "time limit of a custom operation call in ms", scope: Agent, value: &durationValue{&cfg.Agent.WASMTimeout, time.Millisecond}},
+		{env: "CLIENT_AGENT_ID", flag: "agent-id", usage: "agent id shown in the orchestrator logs, hostname and pid when empty", scope: Agent, value: (*stringValue)(&cfg.Agent.Id)},
+
+		{env: "CLIENT_AGENT_TOKEN", flag: "agent-token", usage: "token of the agent", scope: Agent, secret: true, value: (*stringValue)(&cfg.Agent.Token)},
+		{env: "CLIENT_TLS", flag: "tls", usage: "connect to the orchestrator with TLS", scope: Agent, value: (*boolValue)(&cfg.Agent.TLS.Enabled)},
+		{env: "CLIENT_TLS_CA", flag: "tls-ca", usage: "CA file for the orchestrator certificate, system roots when empty", scope: Agent, value: (*stringValue)(&cfg.Agent.TLS.CAFile)},
+		{env: "CLIENT_TLS_CERT", flag: "tls-cert", usage: "client certificate file for mTLS", scope: Agent, value: (*stringValue)(&cfg.Agent.TLS.CertFile)},
+		{env: "CLIENT_TLS_KEY", flag: "tls-key", usage: "client private key file for mTLS", scope: Agent, value: (*stringValue)(&cfg.Agent.TLS.KeyFile)},
+		{env: "CLIENT_TLS_SERVER_NAME", flag: "tls-server-name", usage: "expected name in the orchestrator certificate, the address host when empty", scope: Agent, value: (*stringValue)(&cfg.Agent.TLS.ServerName)},
+
+		{env: "APP_LOG_FORMAT", flag: "log-format", usage: "log format: text or json", scope: Common, value: (*stringValue)(&cfg.Log.Format)},
+		{env: "APP_LOG_LEVEL", flag: "log-level", usage: "log level: debug, info, warn or error", scope: Common, value: (*stringValue)(&cfg.Log.Level)},
+
+		{env: "APP_TRACING_EXPORTER", flag: "tracing-exporter", usage: "trace exporter: none, stdout or otlp", scope: Common, value: (*stringValue)(&cfg.Tracing.Exporter)},
+		{env: "APP_TRACING_OTLP_ENDPOINT", flag: "tracing-otlp-endpoint", usage: "OTLP gRPC collector address", scope: Common, value: (*stringValue)(&cfg.Tracing.OTLPEndpoint)},
+		{env: "APP_TRACING_OTLP_INSECURE", flag: "tracing-otlp-insecure", usage: "connect to the OTLP collector without TLS", scope: Common, value: (*boolValue)(&cfg.Tracing.OTLPInsecure)},
+
+		{flag: "print-config", usage: "print the effective configuration with secrets redacted and exit", scope: Common, value: (*boolValue)(&cfg.PrintConfig)},
+	}
+
+	options := make([]option, 0, len(all))
+	for _, opt := range all {
+		if cfg.Is(opt.scope) {
+			options = append(options, opt)
+		}
+	}
+
+	return options
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("not an integer")
+	}
+	*v = intValue(i)
+	return nil
+}
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("not a boolean")
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// listValue is a comma separated list, empty items are dropped.
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*v = items
+	return nil
+}
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+// mapValue is a comma separated list of key=value pairs.
+type mapValue map[string]string
+
+func (v *mapValue) Set(s string) error {
+	items := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return fmt.Errorf("items must be key=value pairs")
+		}
+		items[key] = value
+	}
+	*v = items
+	return nil
+}
+
+func (v *mapValue) String() string {
+	keys := make([]string, 0, len(*v))
+	for key := range *v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, key+"="+(*v)[key])
+	}
+	return strings.Join(items, ",")
+}
+
+// durationValue accepts either a plain number in unit or a Go duration like "1m30s".
+type durationValue struct {
+	d    *time.Duration
+	unit time.Duration
+}
+
+func (v *durationValue) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*v.d = time.Duration(n) * v.unit
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("not a number or duration")
+	}
+	*v.d = d
+	return nil
+}
+
+func (v *durationValue) String() string {
+	if v.d == nil {
+		return ""
+	}
+	if *v.d%v.unit == 0 {
+		return strconv.FormatInt(int64(*v.d/v.unit), 10)
+	}
+	return v.d.String()
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -13,40 +14,51 @@ import (
 )
 
 var db *sqlx.DB
+var dialect Dialect
 
 func InitDB(ctx context.Context, appCfg *config.Config) *sqlx.DB {
-	// mysql & postgres not tested and written only for example
-	switch dbType := appCfg.GetKey("APP_DB_TYPE"); dbType {
+	dbType := appCfg.DB.Type
+	d, err := NewDialect(dbType)
+	if err != nil {
+		log.Fatalf("Unsupported database type: %s\n", dbType)
+	}
+	dialect = d
+
+	// postgres not tested and written only for example
+	switch dbType {
 	case "mysql":
 		db = initMysql(appCfg)
 	case "postgres":
 		db = initPostgres(appCfg)
 	case "sqlite":
-		dbName := fmt.Sprintf("file:%s/%s?mode=rwc", appCfg.GetKey("ROOT_DIR"), appCfg.GetKey("APP_DB_NAME"))
+		dbName := fmt.Sprintf("file:%s/%s?mode=rwc", appCfg.RootDir, appCfg.DB.Name)
 		db = openConn("sqlite3", dbName)
-	default:
-		log.Fatalf("Unsupported database type: %s\n", dbType)
 	}
 
-	err := db.PingContext(ctx)
+	err = db.PingContext(ctx)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	createTables(ctx, db)
+	if err = migrate(ctx, db, dialect); err != nil {
+		log.Fatalf("Error creating tables: %v", err)
+	}
 
 	return db
 }
 
 func initMysql(appCfg *config.Config) *sqlx.DB {
 	cfg := mysql.Config{
-		User:                 appCfg.GetKey("APP_DB_USER"),
-		Passwd:               appCfg.GetKey("APP_DB_PASSWORD"),
+		User:                 appCfg.DB.User,
+		Passwd:               appCfg.DB.Password,
 		Net:                  "tcp",
-		Addr:                 fmt.Sprintf("%s:%s", appCfg.GetKey("APP_DB_HOST"), appCfg.GetKey("APP_DB_PORT")),
-		DBName:               appCfg.GetKey("APP_DB_NAME"),
+		Addr:                 fmt.Sprintf("%s:%d", appCfg.DB.Host, appCfg.DB.Port),
+		DBName:               appCfg.DB.Name,
 		AllowNativePasswords: true,
 		ParseTime:            true,
+		// updates report matched rows, an update which changes nothing is not mistaken for a missing row
+		ClientFoundRows: true,
+		Loc:             time.UTC,
 	}
 
 	return openConn("mysql", cfg.FormatDSN())
@@ -54,12 +66,12 @@ func initMysql(appCfg *config.Config) *sqlx.DB {
 
 func initPostgres(appCfg *config.Config) *sqlx.DB {
 	connString := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s",
-		appCfg.GetKey("APP_DB_USER"),
-		appCfg.GetKey("APP_DB_PASSWORD"),
-		appCfg.GetKey("APP_DB_HOST"),
-		appCfg.GetKey("APP_DB_PORT"),
-		appCfg.GetKey("APP_DB_NAME"),
+		"postgres://%s:%s@%s:%d/%s",
+		appCfg.DB.User,
+		appCfg.DB.Password,
+		appCfg.DB.Host,
+		appCfg.DB.Port,
+		appCfg.DB.Name,
 	)
 
 	return openConn("postgres", connString)
@@ -82,60 +94,6 @@ func GetDB() *sqlx.DB {
 	return db
 }
 
-func createTables(ctx context.Context, db *sqlx.DB) error {
-	const (
-		usersTable = `
-	CREATE TABLE IF NOT EXISTS users(
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		email TEXT NOT NULL,
-        password TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        updated_at TIMESTAMP DEFAULT NULL,
-        deleted_at TIMESTAMP DEFAULT NULL
-	);`
-
-		expressionsTable = `
-	CREATE TABLE IF NOT EXISTS expressions(
-		id TEXT PRIMARY KEY,
-        user_id INTEGER NOT NULL,
-		expression TEXT NOT NULL,
-        result double precision,
-        status text NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        updated_at TIMESTAMP DEFAULT NULL,
-        deleted_at TIMESTAMP DEFAULT NULL
-	);`
-		tasksTable = `
-	CREATE TABLE IF NOT EXISTS tasks(
-		id TEXT PRIMARY KEY,
-		expression_id TEXT NOT NULL,
-        arg1 double precision NULL,
-        arg2 double precision NULL,
-        operation text NOT NULL,
-        operation_time integer,
-        dependencies TEXT,
-        result double precision,
-        completed boolean,
-        is_processing boolean,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        updated_at TIMESTAMP DEFAULT NULL,
-        deleted_at TIMESTAMP DEFAULT NULL
-	);`
-	)
-
-	if _, err := db.ExecContext(ctx, usersTable); err != nil {
-		log.Println("Error creating users table")
-		return err
-	}
-
-	if _, err := db.ExecContext(ctx, expressionsTable); err != nil {
-		log.Printf("Error creating expressions table: %v", err)
-		return err
-	}
-	if _, err := db.ExecContext(ctx, tasksTable); err != nil {
-		log.Println("Error creating tasks table")
-		return err
-	}
-
-	return nil
+func GetDialect() Dialect {
+	return dialect
 }
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// Dialect hides the SQL differences between supported database engines.
+type Dialect interface {
+	Name() string
+	// Builder returns a query builder using the placeholder format of the engine.
+	Builder() sq.StatementBuilderType
+	// AutoIncrementKey is the column definition of an integer auto increment primary key.
+	AutoIncrementKey() string
+	// StringKey is the column definition of a textual primary key.
+	StringKey() string
+	// StringRef is the column type of a textual reference to another table key.
+	StringRef() string
+	// Timestamp is the column type used for date and time values.
+	Timestamp() string
+	// Blob is the column type of binary data up to a few megabytes.
+	Blob() string
+	// CurrentTimestamp is the default expression for timestamp columns.
+	CurrentTimestamp() string
+	// SecondsSince returns an expression with the amount of seconds passed since column value.
+	SecondsSince(column string) string
+}
+
+func NewDialect(dbType string) (Dialect, error) {
+	switch dbType {
+	case "sqlite":
+		return sqliteDialect{}, nil
+	case "mysql":
+		return mysqlDialect{}, nil
+	case "postgres":
+		return postgresDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) Builder() sq.StatementBuilderType {
+	return sq.StatementBuilder.PlaceholderFormat(sq.Question)
+}
+
+func (sqliteDialect) AutoIncrementKey() string { return "INTEGER PRIMARY KEY AUTOINCREMENT" }
+
+func (sqliteDialect) StringKey() string { return "TEXT PRIMARY KEY" }
+
+func (sqliteDialect) StringRef() string { return "TEXT" }
+
+func (sqliteDialect) Timestamp() string { return "TIMESTAMP" }
+
+func (sqliteDialect) Blob() string { return "BLOB" }
+
+func (sqliteDialect) CurrentTimestamp() string { return "CURRENT_TIMESTAMP" }
+
+func (sqliteDialect) SecondsSince(column string) string {
+	return fmt.Sprintf("strftime('%%s','now') - strftime('%%s', %s)", column)
+}
+
+// mysqlDialect expects the connection to store times in UTC (the driver default).
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return "mysql" }
+
+func (mysqlDialect) Builder() sq.StatementBuilderType {
+	return sq.StatementBuilder.PlaceholderFormat(sq.Question)
+}
+
+func (mysqlDialect) AutoIncrementKey() string { return "BIGINT AUTO_INCREMENT PRIMARY KEY" }
+
+// MySQL can't index TEXT columns without a prefix length, so keys are VARCHAR.
+func (mysqlDialect) StringKey() string { return "VARCHAR(64) PRIMARY KEY" }
+
+func (mysqlDialect) StringRef() string { return "VARCHAR(64)" }
+
+func (mysqlDialect) Timestamp() string { return "DATETIME(6)" }
+
+// BLOB is limited to 64 KiB in MySQL.
+func (mysqlDialect) Blob() string { return "MEDIUMBLOB" }
+
+func (mysqlDialect) CurrentTimestamp() string { return "CURRENT_TIMESTAMP(6)" }
+
+func (mysqlDialect) SecondsSince(column string) string {
+	return fmt.Sprintf("TIMESTAMPDIFF(SECOND, %s, UTC_TIMESTAMP())", column)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) Builder() sq.StatementBuilderType {
+	return sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+func (postgresDialect) AutoIncrementKey() string { return "BIGSERIAL PRIMARY KEY" }
+
+func (postgresDialect) StringKey() string { return "TEXT PRIMARY KEY" }
+
+func (postgresDialect) StringRef() string { return "TEXT" }
+
+func (postgresDialect) Timestamp() string { return "TIMESTAMP" }
+
+func (postgresDialect) Blob() string { return "BYTEA" }
+
+func (postgresDialect) CurrentTimestamp() string { return "CURRENT_TIMESTAMP" }
+
+func (postgresDialect) SecondsSince(column string) string {
+	return fmt.Sprintf("EXTRACT(EPOCH FROM (NOW() - %s))", column)
+}
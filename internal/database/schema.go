@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// Definitions use placeholders filled from the dialect:
+// {auto_key} - auto increment key, {string_key} - string key, {string_ref} - string reference,
+// {timestamp} - timestamp type, {now} - current timestamp, {blob} - binary data
+var tables = []struct {
+	name string
+	ddl  string
+}{
+	{"users", `
+	CREATE TABLE IF NOT EXISTS users(
+		id {auto_key},
+		email TEXT NOT NULL,
+        password TEXT NOT NULL,
+		created_at {timestamp} DEFAULT {now},
+        updated_at {timestamp} NULL DEFAULT NULL,
+        deleted_at {timestamp} NULL DEFAULT NULL
+	);`},
+	{"expressions", `
+	CREATE TABLE IF NOT EXISTS expressions(
+		id {string_key},
+        user_id INTEGER NOT NULL,
+		expression TEXT NOT NULL,
+        result double precision,
+        status text NOT NULL,
+		created_at {timestamp} DEFAULT {now},
+        updated_at {timestamp} NULL DEFAULT NULL,
+        deleted_at {timestamp} NULL DEFAULT NULL
+	);`},
+	{"tasks", `
+	CREATE TABLE IF NOT EXISTS tasks(
+		id {string_key},
+		expression_id {string_ref} NOT NULL,
+        arg1 double precision NULL,
+        arg2 double precision NULL,
+        operation text NOT NULL,
+        operation_time integer,
+        dependencies TEXT,
+        result double precision,
+        completed boolean,
+        is_processing boolean,
+		created_at {timestamp} DEFAULT {now},
+        updated_at {timestamp} NULL DEFAULT NULL,
+        deleted_at {timestamp} NULL DEFAULT NULL
+	);`},
+	{"operation_times", `
+	CREATE TABLE IF NOT EXISTS operation_times(
+		operation VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL DEFAULT 0,
+		time_ms BIGINT NOT NULL,
+		updated_at {timestamp} NULL DEFAULT NULL,
+		PRIMARY KEY (operation, user_id)
+	);`},
+	{"custom_operations", `
+	CREATE TABLE IF NOT EXISTS custom_operations(
+		name VARCHAR(64) NOT NULL PRIMARY KEY,
+		hash VARCHAR(64) NOT NULL,
+		size INTEGER NOT NULL,
+		module {blob} NOT NULL,
+		created_at {timestamp} DEFAULT {now},
+		updated_at {timestamp} NULL DEFAULT NULL
+	);`},
+	{"user_quotas", `
+	CREATE TABLE IF NOT EXISTS user_quotas(
+		user_id INTEGER NOT NULL PRIMARY KEY,
+		requests_per_minute INTEGER NOT NULL DEFAULT 0,
+		max_pending_expressions INTEGER NOT NULL DEFAULT 0,
+		max_operations INTEGER NOT NULL DEFAULT 0,
+		daily_tasks INTEGER NOT NULL DEFAULT 0,
+		updated_at {timestamp} NULL DEFAULT NULL
+	);`},
+	{"api_keys", `
+	CREATE TABLE IF NOT EXISTS api_keys(
+		id {auto_key},
+		user_id INTEGER NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		hash VARCHAR(64) NOT NULL UNIQUE,
+		requests_per_minute INTEGER NOT NULL DEFAULT 0,
+		max_pending_expressions INTEGER NOT NULL DEFAULT 0,
+		max_operations INTEGER NOT NULL DEFAULT 0,
+		daily_tasks INTEGER NOT NULL DEFAULT 0,
+		created_at {timestamp} DEFAULT {now}
+	);`},
+	{"task_replicas", `
+	CREATE TABLE IF NOT EXISTS task_replicas(
+		task_id VARCHAR(64) NOT NULL,
+		agent_id VARCHAR(128) NOT NULL,
+		result double precision NULL,
+		dispatched_at {timestamp} NULL DEFAULT NULL,
+		answered_at {timestamp} NULL DEFAULT NULL,
+		PRIMARY KEY (task_id, agent_id)
+	);`},
+	{"agents", `
+	CREATE TABLE IF NOT EXISTS agents(
+		id VARCHAR(128) NOT NULL PRIMARY KEY,
+		agreements INTEGER NOT NULL DEFAULT 0,
+		disagreements INTEGER NOT NULL DEFAULT 0,
+		quarantined BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at {timestamp} NULL DEFAULT NULL
+	);`},
+}
+
+// Columns added to tables after their first release. They are created on
+// databases made by older versions and on new ones alike.
+var columns = []struct {
+	table      string
+	name       string
+	definition string
+}{
+	{"users", "role", "VARCHAR(16) NOT NULL DEFAULT 'user'"},
+	{"tasks", "dispatched_at", "{timestamp} NULL DEFAULT NULL"},
+	{"tasks", "trace_parent", "VARCHAR(128) NOT NULL DEFAULT ''"},
+	{"tasks", "cache_key", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"tasks", "dead_letter", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"tasks", "failure_reason", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"expressions", "failure_reason", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"expressions", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "api_key_id", "BIGINT NULL DEFAULT NULL"},
+	{"expressions", "task_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "deadline", "{timestamp} NULL DEFAULT NULL"},
+}
+
+func migrate(ctx context.Context, db *sqlx.DB, d Dialect) error {
+	for _, table := range tables {
+		if _, err := db.ExecContext(ctx, expand(d, table.ddl)); err != nil {
+			log.Printf("Error creating %s table: %v", table.name, err)
+			return err
+		}
+	}
+
+	existing := make(map[string]map[string]bool)
+	for _, column := range columns {
+		if existing[column.table] == nil {
+			names, err := tableColumns(ctx, db, column.table)
+			if err != nil {
+				return err
+			}
+			existing[column.table] = names
+		}
+		if existing[column.table][column.name] {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, expand(d, column.definition))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			log.Printf("Error adding %s.%s column: %v", column.table, column.name, err)
+			return err
+		}
+		existing[column.table][column.name] = true
+	}
+
+	return nil
+}
+
+func expand(d Dialect, ddl string) string {
+	return strings.NewReplacer(
+		"{auto_key}", d.AutoIncrementKey(),
+		"{string_key}", d.StringKey(),
+		"{string_ref}", d.StringRef(),
+		"{timestamp}", d.Timestamp(),
+		"{now}", d.CurrentTimestamp(),
+		"{blob}", d.Blob(),
+	).Replace(ddl)
+}
+
+func tableColumns(ctx context.Context, db *sqlx.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(names))
+	for _, name := range names {
+		result[name] = true
+	}
+
+	return result, nil
+}
@@ -0,0 +1,229 @@
+package grpcauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/logging"
+)
+
+const (
+	authorizationKey = "authorization"
+	bearerPrefix     = "Bearer "
+	// healthService stays open, probes and agents check it before authenticating
+	healthService = "/grpc.health.v1.Health/"
+)
+
+// ServerCredentials returns TLS credentials of the task server, nil when TLS is not configured.
+func ServerCredentials(cfg config.GRPCTLSConfig) (credentials.TransportCredentials, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// ClientCredentials returns the transport credentials of the agent.
+func ClientCredentials(cfg config.AgentTLSConfig) (credentials.TransportCredentials, error) {
+	if !cfg.Enabled {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+// TokenCredentials sends the agent token with every call.
+type TokenCredentials struct {
+	Token string
+	// Secure refuses to send the token over a connection without TLS
+	Secure bool
+}
+
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: bearerPrefix + c.Token}, nil
+}
+
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return c.Secure
+}
+
+// Authenticator identifies agents by their tokens.
+type Authenticator struct {
+	tokens map[string]string
+}
+
+func NewAuthenticator(tokens map[string]string) *Authenticator {
+	return &Authenticator{tokens: tokens}
+}
+
+type agentIdKey struct{}
+
+// WithAgentId returns the context of a call of the agent authenticated by its token.
+func WithAgentId(ctx context.Context, agentId string) context.Context {
+	return context.WithValue(ctx, agentIdKey{}, agentId)
+}
+
+// AgentId returns the id of the agent authenticated by its token, empty when
+// agent authentication is disabled. Unlike the id in the metadata it cannot be
+// chosen by the agent.
+func AgentId(ctx context.Context) string {
+	agentId, _ := ctx.Value(agentIdKey{}).(string)
+	return agentId
+}
+
+func (a *Authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, healthService) {
+		return ctx, nil
+	}
+
+	agentId, err := a.identify(ctx)
+	if err != nil {
+		fields := log.Fields{"grpc_method": method, "agent_id": logging.AgentId(ctx)}
+		if p, ok := peer.FromContext(ctx); ok {
+			fields["peer"] = p.Addr.String()
+			if subject := certificateSubject(p); subject != "" {
+				fields["certificate"] = subject
+			}
+		}
+		log.WithFields(fields).WithError(err).Warn("agent authentication failed")
+
+		return nil, status.Error(codes.Unauthenticated, "agent authentication failed")
+	}
+
+	return WithAgentId(ctx, agentId), nil
+}
+
+// identify returns the agent the token belongs to. The id the agent sends in
+// the metadata must be its own.
+func (a *Authenticator) identify(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationKey)
+	if len(values) == 0 || !strings.HasPrefix(values[0], bearerPrefix) {
+		return "", fmt.Errorf("missing token")
+	}
+
+	token := []byte(strings.TrimPrefix(values[0], bearerPrefix))
+	agentId := ""
+	// every token is compared, so the time does not tell which one matched
+	for id, expected := range a.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+			agentId = id
+		}
+	}
+	if agentId == "" {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	if sent := logging.AgentId(ctx); sent != agentId {
+		return "", fmt.Errorf("agent id %q does not match the token of %q", sent, agentId)
+	}
+
+	return agentId, nil
+}
+
+func certificateSubject(p *peer.Peer) string {
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return tlsInfo.State.PeerCertificates[0].Subject.String()
+}
+
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// authenticatedStream carries the context with the authenticated agent id.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, authenticatedStream{ss, ctx})
+	}
+}
@@ -0,0 +1,49 @@
+package grpcauth
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/raikh/calc_micro_final/internal/logging"
+)
+
+func TestAuthenticatorIdentifiesAgentByToken(t *testing.T) {
+	interceptor := NewAuthenticator(map[string]string{"a": "token-a", "b": "token-b"}).UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/TaskService/Task"}
+
+	tests := []struct {
+		name     string
+		md       metadata.MD
+		wantCode codes.Code
+		wantId   string
+	}{
+		{name: "id and token", md: metadata.Pairs(logging.AgentIdKey, "b", authorizationKey, "Bearer token-b"), wantId: "b"},
+		{name: "token alone", md: metadata.Pairs(authorizationKey, "Bearer token-a"), wantCode: codes.Unauthenticated},
+		{name: "id of another agent", md: metadata.Pairs(logging.AgentIdKey, "a", authorizationKey, "Bearer token-b"), wantCode: codes.Unauthenticated},
+		{name: "wrong token", md: metadata.Pairs(logging.AgentIdKey, "a", authorizationKey, "Bearer token-c"), wantCode: codes.Unauthenticated},
+		{name: "no token", md: metadata.Pairs(logging.AgentIdKey, "a"), wantCode: codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			var gotId string
+			_, err := interceptor(ctx, nil, info, func(ctx context.Context, req any) (any, error) {
+				gotId = AgentId(ctx)
+				return nil, nil
+			})
+
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("interceptor error = %v, want %s", err, tt.wantCode)
+			}
+			if gotId != tt.wantId {
+				t.Errorf("AgentId() = %q, want %q", gotId, tt.wantId)
+			}
+		})
+	}
+}
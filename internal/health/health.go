@@ -0,0 +1,63 @@
+package health
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Check is a named readiness check, Run returns why the dependency is not ready.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result maps names of the checks to "ok" or the error text.
+type Result map[string]string
+
+// RunChecks runs all checks and reports whether every one of them passed.
+func RunChecks(ctx context.Context, checks []Check) (Result, bool) {
+	result := make(Result, len(checks))
+	ready := true
+	for _, check := range checks {
+		if err := check.Run(ctx); err != nil {
+			result[check.Name] = err.Error()
+			ready = false
+			continue
+		}
+		result[check.Name] = "ok"
+	}
+
+	return result, ready
+}
+
+func Database(db *sqlx.DB) Check {
+	return Check{
+		Name: "database",
+		Run: func(ctx context.Context) error {
+			return db.PingContext(ctx)
+		},
+	}
+}
+
+// GRPC passes when the gRPC server reports the service as serving, which
+// happens once its listener is open.
+func GRPC(server *grpchealth.Server, service string) Check {
+	return Check{
+		Name: "grpc",
+		Run: func(ctx context.Context) error {
+			resp, err := server.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				return err
+			}
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				return fmt.Errorf("status %s", resp.Status)
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+)
+
+// AgentIdKey is the gRPC metadata key carrying the id of the calling agent.
+const AgentIdKey = "x-agent-id"
+
+// Setup configures the format and level of the global logger.
+func Setup(cfg *config.Config) {
+	if cfg.Log.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+
+	level, err := log.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+}
+
+// DefaultAgentId is used when the agent id is not configured.
+func DefaultAgentId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// AgentId returns the id sent by the agent in the incoming metadata.
+func AgentId(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(AgentIdKey); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// UnaryClientInterceptor sends the agent id with every call.
+func UnaryClientInterceptor(agentId string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, AgentIdKey, agentId), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor sends the agent id with every stream.
+func StreamClientInterceptor(agentId string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(metadata.AppendToOutgoingContext(ctx, AgentIdKey, agentId), desc, cc, method, opts...)
+	}
+}
+
+// taskIdentified is implemented by task requests and responses.
+type taskIdentified interface {
+	GetId() string
+}
+
+// agentIdentified is implemented by requests naming the agent.
+type agentIdentified interface {
+	GetAgentId() string
+}
+
+// UnaryServerInterceptor logs every call with the agent id, the task id and the outcome.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		fields := callFields(ctx, info.FullMethod, start, err)
+		if task, ok := req.(taskIdentified); ok && task.GetId() != "" {
+			fields["task_id"] = task.GetId()
+		} else if task, ok := resp.(taskIdentified); ok && task.GetId() != "" {
+			fields["task_id"] = task.GetId()
+		}
+		if agent, ok := req.(agentIdentified); ok && fields["agent_id"] == nil && agent.GetAgentId() != "" {
+			fields["agent_id"] = agent.GetAgentId()
+		}
+		logCall(fields, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor logs every stream with the agent id and the outcome.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logCall(callFields(ss.Context(), info.FullMethod, start, err), err)
+
+		return err
+	}
+}
+
+func callFields(ctx context.Context, method string, start time.Time, err error) log.Fields {
+	fields := log.Fields{
+		"grpc_method": method,
+		"code":        status.Code(err).String(),
+		"latency_ms":  time.Since(start).Milliseconds(),
+	}
+	if agentId := AgentId(ctx); agentId != "" {
+		fields["agent_id"] = agentId
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		fields["trace_id"] = spanContext.TraceID().String()
+	}
+
+	return fields
+}
+
+func logCall(fields log.Fields, err error) {
+	entry := log.WithFields(fields)
+	switch status.Code(err) {
+	case codes.OK:
+		entry.Info("grpc call")
+	case codes.NotFound:
+		// idle agents poll for tasks every second
+		entry.Debug("grpc call")
+	default:
+		entry.WithError(err).Warn("grpc call")
+	}
+}
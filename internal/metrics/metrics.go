@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "calc"
+
+// Orchestrator holds metrics updated by the HTTP API and the task server.
+type Orchestrator struct {
+	HTTPRequestDuration *prometheus.HistogramVec
+	TaskWaitTime        *prometheus.HistogramVec
+	TaskExecutionTime   *prometheus.HistogramVec
+	TaskRedistributions prometheus.Counter
+	TasksDeadLettered   prometheus.Counter
+	// ResultDisagreements are results of agents which differ from the accepted ones
+	ResultDisagreements *prometheus.CounterVec
+}
+
+func NewOrchestrator(reg prometheus.Registerer) *Orchestrator {
+	m := &Orchestrator{
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		TaskWaitTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "task_wait_seconds",
+			Help:      "Time from task creation until it is given to an agent.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"operation"}),
+		TaskExecutionTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "task_execution_seconds",
+			Help:      "Time from giving a task to an agent until its result arrives.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"operation"}),
+		TaskRedistributions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_redistributions_total",
+			Help:      "Tasks given to another agent after the previous one did not answer in time.",
+		}),
+		TasksDeadLettered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tasks_dead_lettered_total",
+			Help:      "Tasks which were not computed after all attempts and failed their expressions.",
+		}),
+		ResultDisagreements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "result_disagreements_total",
+			Help:      "Results of agents which differ from the result accepted by the quorum.",
+		}, []string{"agent_id"}),
+	}
+
+	reg.MustRegister(m.HTTPRequestDuration, m.TaskWaitTime, m.TaskExecutionTime, m.TaskRedistributions, m.TasksDeadLettered, m.ResultDisagreements)
+
+	return m
+}
+
+func (m *Orchestrator) ObserveTaskWait(operation string, createdAt *time.Time) {
+	if createdAt != nil {
+		m.TaskWaitTime.WithLabelValues(operation).Observe(time.Since(*createdAt).Seconds())
+	}
+}
+
+func (m *Orchestrator) ObserveTaskExecution(operation string, dispatchedAt *time.Time) {
+	if dispatchedAt != nil {
+		m.TaskExecutionTime.WithLabelValues(operation).Observe(time.Since(*dispatchedAt).Seconds())
+	}
+}
+
+// StateCollector reads gauges from the storage on every scrape, so the values
+// stay correct with several orchestrators sharing one database.
+type StateCollector struct {
+	expressionsByStatus func() (map[string]int, error)
+	readyTasks          func() (int, error)
+
+	expressionsDesc *prometheus.Desc
+	readyTasksDesc  *prometheus.Desc
+}
+
+func NewStateCollector(expressionsByStatus func() (map[string]int, error), readyTasks func() (int, error)) *StateCollector {
+	return &StateCollector{
+		expressionsByStatus: expressionsByStatus,
+		readyTasks:          readyTasks,
+		expressionsDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "expressions"),
+			"Number of expressions by status.", []string{"status"}, nil),
+		readyTasksDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ready_tasks"),
+			"Tasks with computed dependencies waiting for an agent.", nil, nil),
+	}
+}
+
+func (c *StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.expressionsDesc
+	ch <- c.readyTasksDesc
+}
+
+func (c *StateCollector) Collect(ch chan<- prometheus.Metric) {
+	if counts, err := c.expressionsByStatus(); err != nil {
+		log.Printf("Error collecting expressions metric: %v", err)
+	} else {
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(c.expressionsDesc, prometheus.GaugeValue, float64(count), status)
+		}
+	}
+
+	if count, err := c.readyTasks(); err != nil {
+		log.Printf("Error collecting ready tasks metric: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.readyTasksDesc, prometheus.GaugeValue, float64(count))
+	}
+}
+
+// Agent holds metrics of the calculation agent.
+type Agent struct {
+	TasksComputed *prometheus.CounterVec
+	Errors        *prometheus.CounterVec
+	BusyWorkers   prometheus.Gauge
+	// PendingResults are computed results not acknowledged by the orchestrator yet
+	PendingResults prometheus.Gauge
+	// ConnectionState is 1 for the current state of the orchestrator connection
+	ConnectionState *prometheus.GaugeVec
+}
+
+func NewAgent(reg prometheus.Registerer) *Agent {
+	m := &Agent{
+		TasksComputed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "tasks_computed_total",
+			Help:      "Tasks computed by the agent.",
+		}, []string{"operation"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "errors_total",
+			Help:      "Errors of the agent by stage.",
+		}, []string{"stage"}),
+		BusyWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "busy_workers",
+			Help:      "Workers computing a task right now.",
+		}),
+		PendingResults: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "pending_results",
+			Help:      "Computed results waiting to be acknowledged by the orchestrator.",
+		}),
+		ConnectionState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "connection_state",
+			Help:      "State of the orchestrator connection, 1 for the current state.",
+		}, []string{"state"}),
+	}
+
+	reg.MustRegister(m.TasksComputed, m.Errors, m.BusyWorkers, m.PendingResults, m.ConnectionState)
+
+	return m
+}
@@ -0,0 +1,12 @@
+// Package arithmetic registers the four basic operations. Import it for its
+// side effect to make an agent compute them.
+package arithmetic
+
+import "github.com/raikh/calc_micro_final/internal/operation"
+
+func init() {
+	operation.MustRegister(operation.Func{Symbol: "+", Fn: func(a, b float64) float64 { return a + b }})
+	operation.MustRegister(operation.Func{Symbol: "-", Fn: func(a, b float64) float64 { return a - b }})
+	operation.MustRegister(operation.Func{Symbol: "*", Fn: func(a, b float64) float64 { return a * b }})
+	operation.MustRegister(operation.Func{Symbol: "/", Fn: func(a, b float64) float64 { return a / b }})
+}
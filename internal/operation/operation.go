@@ -0,0 +1,106 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Operation computes the result of a task for its two arguments.
+type Operation interface {
+	// Name is the symbol of the operation in expressions, e.g. "+".
+	Name() string
+	Compute(ctx context.Context, a, b float64) (float64, error)
+}
+
+// Registry holds the operations an agent can compute.
+type Registry struct {
+	mu         sync.RWMutex
+	operations map[string]Operation
+}
+
+func NewRegistry() *Registry {
+	return &Registry{operations: make(map[string]Operation)}
+}
+
+// Register adds the operation, registering a name twice is an error.
+func (r *Registry) Register(op Operation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.operations[op.Name()]; ok {
+		return fmt.Errorf("operation %q is already registered", op.Name())
+	}
+	r.operations[op.Name()] = op
+
+	return nil
+}
+
+// Replace adds the operation or replaces the one with the same name, which is returned.
+func (r *Registry) Replace(op Operation) Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.operations[op.Name()]
+	r.operations[op.Name()] = op
+
+	return previous
+}
+
+// Remove deletes the operation and returns it, nil when there was none.
+func (r *Registry) Remove(name string) Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	op := r.operations[name]
+	delete(r.operations, name)
+
+	return op
+}
+
+func (r *Registry) Get(name string) (Operation, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	op, ok := r.operations[name]
+	return op, ok
+}
+
+// Names returns the sorted names of the registered operations.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.operations))
+	for name := range r.operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Default is the registry operation packages add themselves to in init.
+var Default = NewRegistry()
+
+// MustRegister adds the operation to the default registry and panics on a duplicate name.
+func MustRegister(op Operation) {
+	if err := Default.Register(op); err != nil {
+		panic(err)
+	}
+}
+
+// Func adapts a function to the Operation interface.
+type Func struct {
+	Symbol string
+	Fn     func(a, b float64) float64
+}
+
+func (f Func) Name() string {
+	return f.Symbol
+}
+
+func (f Func) Compute(ctx context.Context, a, b float64) (float64, error) {
+	return f.Fn(a, b), nil
+}
@@ -0,0 +1,138 @@
+// Package wasm runs operations uploaded as WebAssembly modules. A module must
+// not import anything and must export "compute" taking and returning f64:
+//
+//	(func (export "compute") (param f64 f64) (result f64) ...)
+//
+// Every call gets a fresh instance, so calls share no state, and is limited
+// in memory and time.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ExportName is the function the module must export.
+const ExportName = "compute"
+
+// ErrTimeLimit is returned by calls which exceed the time limit of the operation.
+var ErrTimeLimit = errors.New("time limit exceeded")
+
+// namePattern keeps custom operation names apart from numbers and operators.
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+func IsValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+type Limits struct {
+	// MemoryPages caps the memory of an instance in 64 KiB pages
+	MemoryPages uint32
+	Timeout     time.Duration
+}
+
+// Validate checks that the module compiles and has the expected interface.
+func Validate(ctx context.Context, module []byte) error {
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	_, err := compile(ctx, runtime, module)
+	return err
+}
+
+func compile(ctx context.Context, runtime wazero.Runtime, module []byte) (wazero.CompiledModule, error) {
+	compiled, err := runtime.CompileModule(ctx, module)
+	if err != nil {
+		return nil, fmt.Errorf("invalid module: %w", err)
+	}
+
+	if imports := compiled.ImportedFunctions(); len(imports) > 0 {
+		return nil, fmt.Errorf("module must not import functions, it imports %d", len(imports))
+	}
+	if imports := compiled.ImportedMemories(); len(imports) > 0 {
+		return nil, errors.New("module must not import memory")
+	}
+
+	function, ok := compiled.ExportedFunctions()[ExportName]
+	if !ok {
+		return nil, fmt.Errorf("module must export function %q", ExportName)
+	}
+	params, results := function.ParamTypes(), function.ResultTypes()
+	if len(params) != 2 || params[0] != api.ValueTypeF64 || params[1] != api.ValueTypeF64 ||
+		len(results) != 1 || results[0] != api.ValueTypeF64 {
+		return nil, fmt.Errorf("function %q must take two f64 and return one f64", ExportName)
+	}
+
+	return compiled, nil
+}
+
+// Operation is a compiled module implementing operation.Operation.
+type Operation struct {
+	name     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+func Compile(ctx context.Context, name string, module []byte, limits Limits) (*Operation, error) {
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(limits.MemoryPages).
+		// stops endless loops when the call context is done
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	compiled, err := compile(ctx, runtime, module)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	return &Operation{name: name, runtime: runtime, compiled: compiled, timeout: limits.Timeout}, nil
+}
+
+func (o *Operation) Name() string {
+	return o.name
+}
+
+// Compute wraps ctx.Err() when the context of the caller ends the call and
+// ErrTimeLimit when the call runs out of its own time.
+func (o *Operation) Compute(ctx context.Context, a, b float64) (float64, error) {
+	callCtx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	// an empty name lets instances of the same module run concurrently
+	instance, err := o.runtime.InstantiateModule(callCtx, o.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return 0, o.callError(ctx, callCtx, fmt.Errorf("failed to instantiate %s: %w", o.name, err))
+	}
+	defer instance.Close(callCtx)
+
+	results, err := instance.ExportedFunction(ExportName).Call(callCtx, api.EncodeF64(a), api.EncodeF64(b))
+	if err != nil {
+		return 0, o.callError(ctx, callCtx, fmt.Errorf("%s failed: %w", o.name, err))
+	}
+
+	return api.DecodeF64(results[0]), nil
+}
+
+// callError tells a call stopped by the caller or by the time limit apart from a failing module.
+func (o *Operation) callError(ctx context.Context, callCtx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("%s was stopped: %w", o.name, ctx.Err())
+	case errors.Is(callCtx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s exceeded the time limit of %s: %w", o.name, o.timeout, ErrTimeLimit)
+	}
+	return err
+}
+
+// Close releases the compiled code, the operation must not be used afterwards.
+func (o *Operation) Close(ctx context.Context) error {
+	return o.runtime.Close(ctx)
+}
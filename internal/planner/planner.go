@@ -0,0 +1,212 @@
+// Package planner turns the syntax tree of an expression into the tasks given
+// to agents, optionally computing literal subtrees itself and sharing
+// identical subtrees between their dependents.
+package planner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/raikh/calc_micro_final/internal/operation"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// Node is an operation on two subtrees or, with an empty Operation, a number.
+type Node struct {
+	Operation string
+	Value     float64
+	Left      *Node
+	Right     *Node
+}
+
+func Number(value float64) *Node {
+	return &Node{Value: value}
+}
+
+func Apply(op string, left, right *Node) *Node {
+	return &Node{Operation: op, Left: left, Right: right}
+}
+
+func (n *Node) IsNumber() bool {
+	return n.Operation == ""
+}
+
+// commutative operations get their operands sorted in keys, so a+b and b+a are shared
+var commutative = map[string]bool{"+": true, "*": true}
+
+// Key identifies the value of the subtree: subtrees with equal keys compute the same.
+func Key(n *Node) string {
+	if n.IsNumber() {
+		return numberKey(n.Value)
+	}
+
+	return operationKey(n.Operation, Key(n.Left), Key(n.Right))
+}
+
+func numberKey(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func operationKey(op string, left, right string) string {
+	if commutative[op] && right < left {
+		left, right = right, left
+	}
+
+	return op + "(" + left + "," + right + ")"
+}
+
+// CacheKey addresses the result of a subtree with the given key in a ResultCache.
+// Grouping is part of the key, the precision mode keeps results of expressions
+// evaluated in strict order apart from regrouped ones.
+func CacheKey(precision string, key string) string {
+	sum := sha256.Sum256([]byte(precision + ":" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	PrecisionStrict    = "strict"
+	PrecisionRegrouped = "regrouped"
+)
+
+// ResultCache returns results of subtrees computed before by their CacheKey.
+type ResultCache interface {
+	Get(key string) (float64, bool)
+}
+
+type Planner struct {
+	// Fold computes operations on literals with the operations of the registry
+	// instead of giving them to agents, nil disables folding. Folded operations
+	// have no delay.
+	Fold *operation.Registry
+	// Share makes identical subtrees one task with several dependents.
+	Share bool
+	// Rebalance turns chains of associative operations into balanced trees,
+	// so their operations run in parallel.
+	Rebalance bool
+	// Cache replaces subtrees computed before with their results, nil disables it.
+	Cache ResultCache
+}
+
+// Input is an expression to plan.
+type Input struct {
+	Root         *Node
+	ExpressionId string
+	// Delays of operations in ms
+	Delays map[string]int64
+	// StrictOrder keeps the order of evaluation written in the expression, floating
+	// point sums and products may differ slightly when it changes
+	StrictOrder bool
+	// NoCache computes every operation anew, results still refresh the cache
+	NoCache bool
+	// Versions of custom operations, results of an old version are not reused
+	Versions map[string]string
+}
+
+// Plan returns the tasks of the expression with dependencies before their
+// dependents. When nothing is left for agents it returns the value instead.
+func (p *Planner) Plan(in Input, newId func() string) ([]*model.Task, *float64) {
+	root := in.Root
+	if p.Rebalance && !in.StrictOrder {
+		root = Rebalance(root)
+	}
+
+	b := &builder{
+		planner:      p,
+		expressionId: in.ExpressionId,
+		delays:       in.Delays,
+		versions:     in.Versions,
+		precision:    PrecisionRegrouped,
+		useCache:     p.Cache != nil && !in.NoCache,
+		newId:        newId,
+		shared:       make(map[string]*model.Task),
+	}
+	if in.StrictOrder || !p.Rebalance {
+		b.precision = PrecisionStrict
+	}
+
+	result := b.build(root)
+
+	return b.tasks, result.value
+}
+
+// planned is a built subtree: its value when it is known, otherwise its task.
+type planned struct {
+	value *float64
+	task  *model.Task
+	key   string
+}
+
+type builder struct {
+	planner      *Planner
+	expressionId string
+	delays       map[string]int64
+	versions     map[string]string
+	precision    string
+	useCache     bool
+	newId        func() string
+
+	tasks  []*model.Task
+	shared map[string]*model.Task
+}
+
+func (b *builder) build(n *Node) planned {
+	if n.IsNumber() {
+		value := n.Value
+		return planned{value: &value, key: numberKey(value)}
+	}
+
+	left := b.build(n.Left)
+	right := b.build(n.Right)
+
+	if left.value != nil && right.value != nil && b.planner.Fold != nil {
+		if op, ok := b.planner.Fold.Get(n.Operation); ok {
+			// an error leaves the operation to the agents, they report it the usual way
+			if value, err := op.Compute(context.Background(), *left.value, *right.value); err == nil {
+				return planned{value: &value, key: numberKey(value)}
+			}
+		}
+	}
+
+	name := n.Operation
+	if version, ok := b.versions[name]; ok {
+		name += "#" + version
+	}
+	key := operationKey(name, left.key, right.key)
+
+	cacheKey := CacheKey(b.precision, key)
+	if b.useCache {
+		// the key of the subtree stays, so keys of its parents do not depend on the cache
+		if value, ok := b.planner.Cache.Get(cacheKey); ok {
+			return planned{value: &value, key: key}
+		}
+	}
+
+	if b.planner.Share {
+		if task, ok := b.shared[key]; ok {
+			return planned{task: task, key: key}
+		}
+	}
+
+	task := &model.Task{
+		Id:            b.newId(),
+		ExpressionId:  b.expressionId,
+		Arg1:          left.value,
+		Arg2:          right.value,
+		Operation:     n.Operation,
+		OperationTime: b.delays[n.Operation],
+		Dependencies:  []string{},
+		CacheKey:      cacheKey,
+	}
+	for _, arg := range []planned{left, right} {
+		if arg.task != nil {
+			task.Dependencies = append(task.Dependencies, arg.task.Id)
+		}
+	}
+
+	b.tasks = append(b.tasks, task)
+	b.shared[key] = task
+
+	return planned{task: task, key: key}
+}
@@ -0,0 +1,170 @@
+package planner
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/raikh/calc_micro_final/internal/operation"
+	_ "github.com/raikh/calc_micro_final/internal/operation/arithmetic"
+)
+
+// chain returns the left-leaning tree of op over the numbers, as the parser builds it.
+func chain(op string, values ...float64) *Node {
+	n := Number(values[0])
+	for _, value := range values[1:] {
+		n = Apply(op, n, Number(value))
+	}
+	return n
+}
+
+func TestPlan(t *testing.T) {
+	// (1+2)*(2+1) - 3
+	shared := Apply("-", Apply("*", chain("+", 1, 2), chain("+", 2, 1)), Number(3))
+
+	tests := []struct {
+		name    string
+		planner Planner
+		in      Input
+		// wantTasks are the operations of the tasks in the order of the plan
+		wantTasks []string
+		// wantDependencies are the numbers of dependencies of the tasks
+		wantDependencies []int
+		wantResult       *float64
+	}{
+		{
+			name:             "every operation is a task",
+			in:               Input{Root: shared},
+			wantTasks:        []string{"+", "+", "*", "-"},
+			wantDependencies: []int{0, 0, 2, 1},
+		},
+		{
+			name:             "commutative subtrees are shared",
+			planner:          Planner{Share: true},
+			in:               Input{Root: shared},
+			wantTasks:        []string{"+", "*", "-"},
+			wantDependencies: []int{0, 2, 1},
+		},
+		{
+			name:             "subtraction operands are not swapped",
+			planner:          Planner{Share: true},
+			in:               Input{Root: Apply("*", chain("-", 1, 2), chain("-", 2, 1))},
+			wantTasks:        []string{"-", "-", "*"},
+			wantDependencies: []int{0, 0, 2},
+		},
+		{
+			name:       "folded to a number",
+			planner:    Planner{Fold: operation.Default},
+			in:         Input{Root: shared},
+			wantResult: ptr(6),
+		},
+		{
+			name:             "unknown operations are not folded",
+			planner:          Planner{Fold: operation.Default},
+			in:               Input{Root: Apply("fx", chain("+", 1, 2), Number(3))},
+			wantTasks:        []string{"fx"},
+			wantDependencies: []int{0},
+		},
+		{
+			name:             "rebalanced chain",
+			planner:          Planner{Rebalance: true},
+			in:               Input{Root: chain("+", 1, 2, 3, 4)},
+			wantTasks:        []string{"+", "+", "+"},
+			wantDependencies: []int{0, 0, 2},
+		},
+		{
+			name:             "strict order keeps the chain",
+			planner:          Planner{Rebalance: true},
+			in:               Input{Root: chain("+", 1, 2, 3, 4), StrictOrder: true},
+			wantTasks:        []string{"+", "+", "+"},
+			wantDependencies: []int{0, 1, 1},
+		},
+		{
+			name:             "cached subtree",
+			planner:          Planner{Cache: mapCache{CacheKey(PrecisionStrict, "+(1,2)"): 3}},
+			in:               Input{Root: Apply("*", chain("+", 1, 2), Number(4))},
+			wantTasks:        []string{"*"},
+			wantDependencies: []int{0},
+		},
+		{
+			name:             "cache is skipped on request",
+			planner:          Planner{Cache: mapCache{CacheKey(PrecisionStrict, "+(1,2)"): 3}},
+			in:               Input{Root: Apply("*", chain("+", 1, 2), Number(4)), NoCache: true},
+			wantTasks:        []string{"+", "*"},
+			wantDependencies: []int{0, 1},
+		},
+		{
+			name:             "new version of a custom operation misses the cache",
+			planner:          Planner{Cache: mapCache{CacheKey(PrecisionStrict, "fx#1(1,2)"): 3}},
+			in:               Input{Root: Apply("fx", Number(1), Number(2)), Versions: map[string]string{"fx": "2"}},
+			wantTasks:        []string{"fx"},
+			wantDependencies: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := 0
+			newId := func() string {
+				ids++
+				return fmt.Sprintf("task-%d", ids)
+			}
+
+			tasks, result := tt.planner.Plan(tt.in, newId)
+
+			if (result == nil) != (tt.wantResult == nil) || (result != nil && *result != *tt.wantResult) {
+				t.Fatalf("Plan() result = %v, want %v", deref(result), deref(tt.wantResult))
+			}
+			if len(tasks) != len(tt.wantTasks) {
+				t.Fatalf("Plan() returned %d tasks, want %d", len(tasks), len(tt.wantTasks))
+			}
+			seen := make(map[string]bool)
+			for i, task := range tasks {
+				if task.Operation != tt.wantTasks[i] {
+					t.Errorf("task %d operation = %s, want %s", i, task.Operation, tt.wantTasks[i])
+				}
+				if len(task.Dependencies) != tt.wantDependencies[i] {
+					t.Errorf("task %d has %d dependencies, want %d", i, len(task.Dependencies), tt.wantDependencies[i])
+				}
+				for _, dependency := range task.Dependencies {
+					if !seen[dependency] {
+						t.Errorf("task %d depends on %s, which is not planned before it", i, dependency)
+					}
+				}
+				// a task waits only for the arguments its dependencies compute
+				if missing := argsMissing(task.Arg1 == nil, task.Arg2 == nil); missing != len(task.Dependencies) {
+					t.Errorf("task %d misses %d arguments with %d dependencies", i, missing, len(task.Dependencies))
+				}
+				seen[task.Id] = true
+			}
+		})
+	}
+}
+
+type mapCache map[string]float64
+
+func (c mapCache) Get(key string) (float64, bool) {
+	value, ok := c[key]
+	return value, ok
+}
+
+func argsMissing(missing ...bool) int {
+	count := 0
+	for _, m := range missing {
+		if m {
+			count++
+		}
+	}
+	return count
+}
+
+func ptr(value float64) *float64 {
+	return &value
+}
+
+func deref(value *float64) string {
+	if value == nil {
+		return "nil"
+	}
+	return strconv.FormatFloat(*value, 'g', -1, 64)
+}
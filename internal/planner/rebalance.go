@@ -0,0 +1,46 @@
+package planner
+
+// associative operations may be regrouped, a chain of n of them is computed
+// in log2(n) steps instead of n
+var associative = map[string]bool{"+": true, "*": true}
+
+// Rebalance returns the tree with chains of the same associative operation
+// regrouped into balanced subtrees. The order of the operands is kept.
+func Rebalance(n *Node) *Node {
+	if n.IsNumber() {
+		return n
+	}
+
+	if !associative[n.Operation] {
+		return Apply(n.Operation, Rebalance(n.Left), Rebalance(n.Right))
+	}
+
+	var operands []*Node
+	collectChain(n, n.Operation, &operands)
+	for i, operand := range operands {
+		operands[i] = Rebalance(operand)
+	}
+
+	return balanced(n.Operation, operands)
+}
+
+// collectChain appends the operands of the chain of op starting at n from left to right.
+func collectChain(n *Node, op string, operands *[]*Node) {
+	if n.Operation != op {
+		*operands = append(*operands, n)
+		return
+	}
+
+	collectChain(n.Left, op, operands)
+	collectChain(n.Right, op, operands)
+}
+
+func balanced(op string, operands []*Node) *Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+
+	middle := len(operands) / 2
+
+	return Apply(op, balanced(op, operands[:middle]), balanced(op, operands[middle:]))
+}
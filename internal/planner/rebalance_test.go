@@ -0,0 +1,45 @@
+package planner
+
+import (
+	"strconv"
+	"testing"
+)
+
+func format(n *Node) string {
+	if n.IsNumber() {
+		return strconv.FormatFloat(n.Value, 'g', -1, 64)
+	}
+	return "(" + format(n.Left) + n.Operation + format(n.Right) + ")"
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		name string
+		root *Node
+		want string
+	}{
+		{name: "number", root: Number(1), want: "1"},
+		{name: "single operation", root: chain("+", 1, 2), want: "(1+2)"},
+		{name: "sum", root: chain("+", 1, 2, 3, 4), want: "((1+2)+(3+4))"},
+		{name: "odd product", root: chain("*", 1, 2, 3, 4, 5), want: "((1*2)*(3*(4*5)))"},
+		{name: "subtraction is kept", root: chain("-", 1, 2, 3, 4), want: "(((1-2)-3)-4)"},
+		{
+			name: "chains under another operation",
+			root: Apply("/", chain("+", 1, 2, 3, 4), chain("*", 5, 6, 7, 8)),
+			want: "(((1+2)+(3+4))/((5*6)*(7*8)))",
+		},
+		{
+			name: "mixed operations end the chain",
+			root: Apply("+", chain("+", 1, 2, 3), Apply("*", Number(4), Number(5))),
+			want: "((1+2)+(3+(4*5)))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := format(Rebalance(tt.root)); got != tt.want {
+				t.Errorf("Rebalance(%s) = %s, want %s", format(tt.root), got, tt.want)
+			}
+		})
+	}
+}
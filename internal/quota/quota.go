@@ -0,0 +1,220 @@
+package quota
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+const (
+	LimitRequestsPerMinute     = "requests_per_minute"
+	LimitMaxPendingExpressions = "max_pending_expressions"
+	LimitMaxOperations         = "max_operations"
+	LimitDailyTasks            = "daily_tasks"
+)
+
+// pendingRetryAfter is suggested when too many expressions are being calculated,
+// nobody knows when one of them completes
+const pendingRetryAfter = 5 * time.Second
+
+// Exceeded is returned when a limit of the user or of the API key does not allow the request.
+type Exceeded struct {
+	Limit string
+	// Subject is "user" or "api_key"
+	Subject string
+	// RetryAfter is zero when waiting does not help, like with too many operations in the expression
+	RetryAfter time.Duration
+}
+
+func (e *Exceeded) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %s", e.Subject, e.Limit)
+}
+
+// Report is the current usage of a quota.
+type Report struct {
+	Limits             model.Quota `json:"limits"`
+	RequestsLastMinute int         `json:"requests_last_minute"`
+	PendingExpressions int         `json:"pending_expressions"`
+	TasksToday         int         `json:"tasks_today"`
+	TasksResetAt       time.Time   `json:"tasks_reset_at"`
+}
+
+// Service checks the limits of users and their API keys. Defaults from the
+// configuration apply to users without a quota of their own.
+type Service struct {
+	defaults    model.Quota
+	quotas      model.QuotaRepository
+	expressions model.ExpressionRepository
+	requests    *window
+	// creating serializes the submissions of a user, so concurrent ones cannot
+	// pass the pending and daily limits together. Users share the stripes.
+	creating [lockStripes]sync.Mutex
+}
+
+// lockStripes bounds the locks of CreateExpression whatever the number of users.
+const lockStripes = 64
+
+func NewService(cfg config.QuotaConfig, quotas model.QuotaRepository, expressions model.ExpressionRepository) *Service {
+	return &Service{
+		defaults: model.Quota{
+			RequestsPerMinute:     cfg.RequestsPerMinute,
+			MaxPendingExpressions: cfg.MaxPendingExpressions,
+			MaxOperations:         cfg.MaxOperations,
+			DailyTasks:            cfg.DailyTasks,
+		},
+		quotas:      quotas,
+		expressions: expressions,
+		requests:    newWindow(time.Minute),
+	}
+}
+
+func (s *Service) Defaults() model.Quota {
+	return s.defaults
+}
+
+func (s *Service) ForUser(userId int64) (model.Quota, error) {
+	quota, ok, err := s.quotas.GetForUser(userId)
+	if err != nil {
+		return model.Quota{}, err
+	}
+	if !ok {
+		return s.defaults, nil
+	}
+
+	return quota, nil
+}
+
+// subject is a user or one of its API keys with the quota which applies to it.
+type subject struct {
+	name     string
+	quota    model.Quota
+	window   string
+	apiKeyId *int64
+}
+
+// subjects returns the API key first, so a limit of the key is reported before the same limit of the user.
+func (s *Service) subjects(user model.User, key *model.APIKey) ([]subject, error) {
+	quota, err := s.ForUser(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	userSubject := subject{name: "user", quota: quota, window: fmt.Sprintf("user:%d", user.Id)}
+	if key == nil {
+		return []subject{userSubject}, nil
+	}
+
+	keySubject := subject{name: "api_key", quota: key.Quota, window: fmt.Sprintf("key:%d", key.Id), apiKeyId: &key.Id}
+
+	return []subject{keySubject, userSubject}, nil
+}
+
+// AllowRequest records a calculation request. The key is nil for requests with a login token.
+func (s *Service) AllowRequest(user model.User, key *model.APIKey) error {
+	subjects, err := s.subjects(user, key)
+	if err != nil {
+		return err
+	}
+
+	limits := make([]windowLimit, len(subjects))
+	for i, subject := range subjects {
+		limits[i] = windowLimit{key: subject.window, max: subject.quota.RequestsPerMinute}
+	}
+
+	if i, retryAfter := s.requests.allow(time.Now(), limits); i >= 0 {
+		return &Exceeded{Limit: LimitRequestsPerMinute, Subject: subjects[i].name, RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// CheckExpression tells whether an expression of the given number of operations may be created.
+func (s *Service) CheckExpression(user model.User, key *model.APIKey, operations int) error {
+	subjects, err := s.subjects(user, key)
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range subjects {
+		if limit := subject.quota.MaxOperations; limit > 0 && operations > limit {
+			return &Exceeded{Limit: LimitMaxOperations, Subject: subject.name}
+		}
+	}
+
+	dayStart, dayEnd := today(time.Now())
+	for _, subject := range subjects {
+		if subject.quota.MaxPendingExpressions == 0 && subject.quota.DailyTasks == 0 {
+			continue
+		}
+
+		usage, err := s.expressions.Usage(user.Id, subject.apiKeyId, dayStart)
+		if err != nil {
+			return err
+		}
+
+		if limit := subject.quota.MaxPendingExpressions; limit > 0 && usage.PendingExpressions >= limit {
+			return &Exceeded{Limit: LimitMaxPendingExpressions, Subject: subject.name, RetryAfter: pendingRetryAfter}
+		}
+		if limit := subject.quota.DailyTasks; limit > 0 && usage.Tasks+operations > limit {
+			return &Exceeded{Limit: LimitDailyTasks, Subject: subject.name, RetryAfter: time.Until(dayEnd)}
+		}
+	}
+
+	return nil
+}
+
+// CreateExpression checks the limits like CheckExpression and calls create
+// while no other expression of the user is being checked or created. Like the
+// request window, the lock lives in the memory of the process.
+func (s *Service) CreateExpression(user model.User, key *model.APIKey, operations int, create func() error) error {
+	mu := &s.creating[uint64(user.Id)%lockStripes]
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := s.CheckExpression(user, key, operations); err != nil {
+		return err
+	}
+
+	return create()
+}
+
+// Usage reports the quota of the user and of the key, the key report is nil without a key.
+func (s *Service) Usage(user model.User, key *model.APIKey) (Report, *Report, error) {
+	subjects, err := s.subjects(user, key)
+	if err != nil {
+		return Report{}, nil, err
+	}
+
+	now := time.Now()
+	dayStart, dayEnd := today(now)
+	reports := make([]Report, len(subjects))
+	for i, subject := range subjects {
+		usage, err := s.expressions.Usage(user.Id, subject.apiKeyId, dayStart)
+		if err != nil {
+			return Report{}, nil, err
+		}
+
+		reports[i] = Report{
+			Limits:             subject.quota,
+			RequestsLastMinute: s.requests.count(subject.window, now),
+			PendingExpressions: usage.PendingExpressions,
+			TasksToday:         usage.Tasks,
+			TasksResetAt:       dayEnd,
+		}
+	}
+
+	if key == nil {
+		return reports[0], nil, nil
+	}
+
+	return reports[1], &reports[0], nil
+}
+
+// today returns the bounds of the current UTC day, the daily task budget resets at its end.
+func today(now time.Time) (time.Time, time.Time) {
+	start := now.UTC().Truncate(24 * time.Hour)
+	return start, start.Add(24 * time.Hour)
+}
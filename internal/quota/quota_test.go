@@ -0,0 +1,70 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+func TestCreateExpressionConcurrently(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config.QuotaConfig
+		operations  int
+		wantCreated int
+		wantLimit   string
+	}{
+		{name: "max pending", cfg: config.QuotaConfig{MaxPendingExpressions: 3}, operations: 1, wantCreated: 3, wantLimit: LimitMaxPendingExpressions},
+		{name: "daily tasks", cfg: config.QuotaConfig{DailyTasks: 10}, operations: 4, wantCreated: 2, wantLimit: LimitDailyTasks},
+		{name: "max operations", cfg: config.QuotaConfig{MaxOperations: 3}, operations: 4, wantCreated: 0, wantLimit: LimitMaxOperations},
+		{name: "unlimited", operations: 1, wantCreated: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repositories := model.NewMemoryRepositories()
+			service := NewService(tt.cfg, repositories.Quotas, repositories.Expressions)
+			user := model.User{Id: 1, Role: model.RoleUser}
+
+			var wg sync.WaitGroup
+			errs := make([]error, 20)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					now := time.Now()
+					expression := &model.Expression{
+						Id:        fmt.Sprintf("expression-%d", i),
+						UserId:    user.Id,
+						Status:    model.StatusPending,
+						TaskCount: tt.operations,
+						CreatedAt: &now,
+					}
+					errs[i] = service.CreateExpression(user, nil, tt.operations, func() error {
+						return repositories.Expressions.Create(expression, nil)
+					})
+				}()
+			}
+			wg.Wait()
+
+			created := 0
+			for _, err := range errs {
+				var exceeded *Exceeded
+				switch {
+				case err == nil:
+					created++
+				case !errors.As(err, &exceeded) || exceeded.Limit != tt.wantLimit:
+					t.Errorf("CreateExpression() = %v, want the %s limit", err, tt.wantLimit)
+				}
+			}
+			if created != tt.wantCreated {
+				t.Errorf("%d expressions created, want %d", created, tt.wantCreated)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package quota
+
+import (
+	"sync"
+	"time"
+)
+
+// window counts requests in a sliding window per key. Counts live in the
+// memory of the process, every orchestrator instance limits on its own.
+type window struct {
+	mu    sync.Mutex
+	size  time.Duration
+	hits  map[string][]time.Time
+	calls int
+}
+
+type windowLimit struct {
+	key string
+	max int
+}
+
+// sweepEvery is how many calls pass between removing keys without recent requests.
+const sweepEvery = 1000
+
+func newWindow(size time.Duration) *window {
+	return &window{size: size, hits: make(map[string][]time.Time)}
+}
+
+// allow records a request under every key when none of the limits is reached.
+// Otherwise it returns the index of the reached limit and when it frees up.
+func (w *window) allow(now time.Time, limits []windowLimit) (int, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.calls++
+	if w.calls%sweepEvery == 0 {
+		for key := range w.hits {
+			w.trim(key, now)
+		}
+	}
+
+	for i, limit := range limits {
+		hits := w.trim(limit.key, now)
+		if limit.max > 0 && len(hits) >= limit.max {
+			return i, hits[len(hits)-limit.max].Add(w.size).Sub(now)
+		}
+	}
+	for _, limit := range limits {
+		w.hits[limit.key] = append(w.hits[limit.key], now)
+	}
+
+	return -1, 0
+}
+
+func (w *window) count(key string, now time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.trim(key, now))
+}
+
+// trim drops requests older than the window, must be called with mu held.
+func (w *window) trim(key string, now time.Time) []time.Time {
+	hits := w.hits[key]
+	start := 0
+	for start < len(hits) && now.Sub(hits[start]) >= w.size {
+		start++
+	}
+	if start == len(hits) {
+		delete(w.hits, key)
+		return nil
+	}
+	hits = hits[start:]
+	w.hits[key] = hits
+
+	return hits
+}
@@ -0,0 +1,114 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowAllow(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := windowLimit{key: "user:1", max: 3}
+	key := windowLimit{key: "key:1", max: 2}
+	unlimited := windowLimit{key: "user:2", max: 0}
+
+	type call struct {
+		at     time.Duration
+		limits []windowLimit
+		// wantIndex is the reached limit, -1 when the request is allowed
+		wantIndex      int
+		wantRetryAfter time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{
+			name: "limit within the window",
+			calls: []call{
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 10 * time.Second, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 20 * time.Second, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 30 * time.Second, limits: []windowLimit{user}, wantIndex: 0, wantRetryAfter: 30 * time.Second},
+			},
+		},
+		{
+			name: "old requests leave the window",
+			calls: []call{
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 10 * time.Second, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 20 * time.Second, limits: []windowLimit{user}, wantIndex: -1},
+				{at: time.Minute, limits: []windowLimit{user}, wantIndex: -1},
+				{at: time.Minute + 5*time.Second, limits: []windowLimit{user}, wantIndex: 0, wantRetryAfter: 5 * time.Second},
+			},
+		},
+		{
+			name: "key is checked before its user",
+			calls: []call{
+				{at: 0, limits: []windowLimit{key, user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{key, user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{key, user}, wantIndex: 0, wantRetryAfter: time.Minute},
+				// the refused request was not counted for the user
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{user}, wantIndex: 0, wantRetryAfter: time.Minute},
+			},
+		},
+		{
+			name: "user limit refuses a request of its key",
+			calls: []call{
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{user}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{key, user}, wantIndex: 1, wantRetryAfter: time.Minute},
+			},
+		},
+		{
+			name: "zero is unlimited",
+			calls: []call{
+				{at: 0, limits: []windowLimit{unlimited}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{unlimited}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{unlimited}, wantIndex: -1},
+				{at: 0, limits: []windowLimit{unlimited}, wantIndex: -1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindow(time.Minute)
+			for i, c := range tt.calls {
+				index, retryAfter := w.allow(start.Add(c.at), c.limits)
+				if index != c.wantIndex || retryAfter != c.wantRetryAfter {
+					t.Errorf("call %d: allow() = %d, %s, want %d, %s", i, index, retryAfter, c.wantIndex, c.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowCount(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := newWindow(time.Minute)
+	for _, at := range []time.Duration{0, 30 * time.Second, 50 * time.Second} {
+		w.allow(start.Add(at), []windowLimit{{key: "user:1", max: 10}})
+	}
+
+	tests := []struct {
+		at   time.Duration
+		want int
+	}{
+		{at: 55 * time.Second, want: 3},
+		{at: time.Minute, want: 2},
+		{at: 90 * time.Second, want: 1},
+		{at: 2 * time.Minute, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := w.count("user:1", start.Add(tt.at)); got != tt.want {
+			t.Errorf("count() at %s = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+	if _, ok := w.hits["user:1"]; ok {
+		t.Error("keys without recent requests must be removed")
+	}
+}
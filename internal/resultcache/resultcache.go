@@ -0,0 +1,85 @@
+// Package resultcache keeps results of computed subexpressions in memory of
+// the orchestrator, so identical work submitted again is not given to agents.
+package resultcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key       string
+	value     float64
+	expiresAt time.Time
+}
+
+// Cache is a least recently used cache with expiring entries, safe for concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+func New(maxEntries int, ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *Cache) Get(key string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	e := element.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		c.remove(element)
+		return 0, false
+	}
+	c.order.MoveToFront(element)
+
+	return e.value, true
+}
+
+// Put stores the value, a stored value of the key is replaced and its TTL starts anew.
+func (c *Cache) Put(key string, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*entry)
+		e.value = value
+		e.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// remove must be called with mu held.
+func (c *Cache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry).key)
+}
@@ -0,0 +1,45 @@
+package resultcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := New(2, time.Minute)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	// b is the least recently used entry
+	c.Put("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Get(b) found an evicted entry")
+	}
+	for key, want := range map[string]float64{"a": 1, "c": 3} {
+		if got, ok := c.Get(key); !ok || got != want {
+			t.Errorf("Get(%s) = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+
+	c.Put("a", 4)
+	if got, _ := c.Get("a"); got != 4 {
+		t.Errorf("Get(a) after Put = %v, want 4", got)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	c := New(2, time.Millisecond)
+	c.Put("a", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get(a) found an expired entry")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", c.Len())
+	}
+}
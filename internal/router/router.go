@@ -7,69 +7,92 @@ import (
 
 	"github.com/labstack/echo/v4"
 	echoMiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/raikh/calc_micro_final/controller"
+	"github.com/raikh/calc_micro_final/internal/app"
 	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/health"
 	"github.com/raikh/calc_micro_final/middleware"
-	"github.com/sirupsen/logrus"
+	pb "github.com/raikh/calc_micro_final/proto"
 	log "github.com/sirupsen/logrus"
 )
 
-func InitRouter(cfg *config.Config) error {
-	httpAddr := fmt.Sprintf("%s:%s", cfg.GetKey("APP_LISTENING_ADDRESS"), cfg.GetKey("APP_HTTP_LISTEN_PORT"))
+func InitRouter(application *app.App) error {
+	cfg := application.Cfg
+	httpAddr := fmt.Sprintf("%s:%d", cfg.ListenAddress, cfg.HTTPPort)
 	log.Printf("HTTP server listening on %s", httpAddr)
 	middleware.Init(cfg)
 
 	e := echo.New()
 	e.Debug = true
-	if cfg.GetKey("APP_ENV") == "production" {
+	if cfg.Env == "production" {
 		e.HideBanner = true
 		e.HidePort = true
 		e.Debug = false
 	}
 
-	e.Use(echoMiddleware.RequestLoggerWithConfig(echoMiddleware.RequestLoggerConfig{
-		LogURI:    true,
-		LogStatus: true,
-		LogValuesFunc: func(c echo.Context, values echoMiddleware.RequestLoggerValues) error {
-			log.WithFields(logrus.Fields{
-				"URI":    values.URI,
-				"Status": values.Status,
-			}).Info("request")
+	e.Use(echoMiddleware.RequestID())
+	e.Use(middleware.RequestLogger())
+	// a panicking handler answers 500 instead of dropping the connection
+	e.Use(echoMiddleware.Recover())
 
-			return nil
-		},
-	}))
+	e.Use(middleware.Metrics(application.Metrics))
+	e.Use(middleware.Tracing)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	e.GET("/healthz", controller.HandleHealthz)
+	e.GET("/readyz", controller.HandleReadyz(readinessChecks(application)))
 
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Hello, World!")
 	})
 
-	e.POST("/api/register", controller.Register())
-	e.POST("/api/login", controller.Login())
+	e.POST("/api/register", controller.Register(application.Users))
+	e.POST("/api/login", controller.Login(application.Users))
 
 	apiGroup := e.Group("/api")
-	apiGroup.Use(middleware.JwtAuthMiddleware)
-	apiGroup.Add(http.MethodPost, "/calculate", controller.HandleCalculate(buildDelayDict(cfg)))
-	apiGroup.Add(http.MethodGet, "/expressions", controller.HandleGetExpressions())
-	apiGroup.Add(http.MethodGet, "/expressions/:id", controller.HandleGetExpressionsById())
+	apiGroup.Use(middleware.JwtAuthMiddleware(application.Users, application.APIKeys))
+	apiGroup.Add(http.MethodPost, "/calculate", controller.HandleCalculate(application.Expressions, application.OperationTimes, application.CustomOperations, application.Quotas, cfg.ExpressionLimits, application.Planner),
+		middleware.RateLimit(application.Quotas), echoMiddleware.BodyLimit(calculateBodyLimit(cfg)))
+	apiGroup.Add(http.MethodGet, "/operations", controller.HandleGetOperations(application.CustomOperations))
+	apiGroup.Add(http.MethodGet, "/expressions", controller.HandleGetExpressions(application.Expressions))
+	apiGroup.Add(http.MethodGet, "/expressions/:id", controller.HandleGetExpressionsById(application.Expressions))
+	apiGroup.Add(http.MethodGet, "/expressions/:id/tasks", controller.HandleGetExpressionTasks(application.Expressions, application.Tasks))
+	apiGroup.Add(http.MethodGet, "/me/usage", controller.HandleGetUsage(application.Quotas))
+	apiGroup.Add(http.MethodGet, "/me/api-keys", controller.HandleGetAPIKeys(application.APIKeys))
+	apiGroup.Add(http.MethodPost, "/me/api-keys", controller.HandleCreateAPIKey(application.APIKeys))
+	apiGroup.Add(http.MethodDelete, "/me/api-keys/:id", controller.HandleDeleteAPIKey(application.APIKeys))
+
+	adminGroup := apiGroup.Group("/admin", middleware.AdminOnly)
+	adminGroup.GET("/operation-times", controller.HandleGetOperationTimes(application.OperationTimes))
+	adminGroup.PUT("/operation-times", controller.HandleSetOperationTimes(application.OperationTimes, application.Users))
+	adminGroup.DELETE("/operation-times/users/:id", controller.HandleDeleteUserOperationTimes(application.OperationTimes))
+	adminGroup.PUT("/users/:id/role", controller.HandleSetUserRole(application.Users))
+	adminGroup.GET("/quotas", controller.HandleGetQuotas(application.Quotas, application.UserQuotas))
+	adminGroup.PUT("/users/:id/quota", controller.HandleSetUserQuota(application.Quotas, application.UserQuotas, application.Users))
+	adminGroup.DELETE("/users/:id/quota", controller.HandleDeleteUserQuota(application.UserQuotas))
+	adminGroup.GET("/operations", controller.HandleListCustomOperations(application.CustomOperations))
+	adminGroup.PUT("/operations/:name", controller.HandleUploadCustomOperation(application.CustomOperations))
+	adminGroup.DELETE("/operations/:name", controller.HandleDeleteCustomOperation(application.CustomOperations, application.Tasks, application.Expressions))
+	adminGroup.GET("/dead-letter", controller.HandleGetDeadLetter(application.Tasks))
+	adminGroup.POST("/tasks/:id/requeue", controller.HandleRequeueTask(application.Tasks, application.Expressions))
+	adminGroup.GET("/agents", controller.HandleGetAgents(application.Agents))
+	adminGroup.DELETE("/agents/:id/quarantine", controller.HandleReleaseAgent(application.Agents))
 
 	return e.Start(httpAddr)
 }
 
-func buildDelayDict(cfg *config.Config) map[string]int64 {
-	delayDict := make(map[string]int64)
-	delayDict["+"] = strToInt64(cfg.GetKey("TIME_ADDITION_MS"))
-	delayDict["-"] = strToInt64(cfg.GetKey("TIME_SUBTRACTION_MS"))
-	delayDict["*"] = strToInt64(cfg.GetKey("TIME_MULTIPLICATIONS_MS"))
-	delayDict["/"] = strToInt64(cfg.GetKey("TIME_DIVISIONS_MS"))
-	return delayDict
+func readinessChecks(application *app.App) []health.Check {
+	checks := []health.Check{health.GRPC(application.GRPCHealth, pb.TaskService_ServiceDesc.ServiceName)}
+	if application.DB != nil {
+		checks = append(checks, health.Database(application.DB))
+	}
+
+	return checks
 }
 
-func strToInt64(str string) int64 {
-	value, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		fmt.Println("Error converting string to int64:", err)
-		return 0
-	}
-	return value
+// calculateBodyLimit rejects giant expressions before they are decoded. A character
+// takes up to 6 bytes in JSON, the rest is room for the other fields.
+func calculateBodyLimit(cfg *config.Config) string {
+	return strconv.Itoa(6*cfg.ExpressionLimits.MaxLength + 4096)
 }
@@ -4,9 +4,6 @@ import (
 	"errors"
 	"net/http"
 
-	log "github.com/sirupsen/logrus"
-
-	"strconv"
 	"strings"
 	"time"
 
@@ -23,57 +20,89 @@ type jwtCustomClaims struct {
 }
 
 var secret_key, refresh_secret_key string
-var expirationHours time.Duration
+var expiration time.Duration
 
 func Init(cfg *config.Config) {
-	secret_key = cfg.GetKey("APP_JWT_SECRET_KEY")
-	refresh_secret_key = cfg.GetKey("APP_JWT_REFRESH_SECRET_KEY")
-	value, err := strconv.ParseUint(cfg.GetKey("APP_JWT_EXPIRATION_HOURS"), 10, 64)
-	if err != nil {
-		log.Fatalf("Value for APP_JWT_EXPIRATION_HOURS is unsupported")
-	}
-	expirationHours = time.Duration(value)
+	secret_key = cfg.JWTSecretKey
+	refresh_secret_key = cfg.JWTRefreshSecretKey
+	expiration = cfg.JWTExpiration
 }
 
-func JwtAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		authHeader := ctx.Request().Header.Get("Authorization")
-
-		if len(authHeader) == 0 {
-			return ctx.JSON(http.StatusUnauthorized, "")
-		}
-
-		authFields := strings.Fields(authHeader)
-		if len(authFields) != 2 || strings.ToLower(authFields[0]) != "bearer" {
-			return errors.New("bad authorization header")
-		}
-		tokenString := authFields[1]
-
-		token, err := jwt.ParseWithClaims(tokenString, &jwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(secret_key), nil
-		})
+// APIKeyHeader authenticates scripts with an API key instead of a login token.
+const APIKeyHeader = "X-API-Key"
+
+// JwtAuthMiddleware sets the "user" of the request, and the "api_key" when
+// the request is authenticated with one.
+func JwtAuthMiddleware(users model.UserRepository, apiKeys model.APIKeyRepository) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if key := ctx.Request().Header.Get(APIKeyHeader); key != "" {
+				apiKey, err := apiKeys.GetByHash(model.HashAPIKey(key))
+				if err != nil {
+					return ctx.JSON(http.StatusUnauthorized, "")
+				}
+
+				user, err := users.GetById(apiKey.UserId)
+				if err != nil {
+					return ctx.JSON(http.StatusUnauthorized, "")
+				}
+				ctx.Set("user", user)
+				ctx.Set("api_key", apiKey)
+
+				return next(ctx)
+			}
 
-		if err != nil {
-			return ctx.JSON(http.StatusUnauthorized, "")
-		}
+			authHeader := ctx.Request().Header.Get("Authorization")
 
-		if claims, ok := token.Claims.(*jwtCustomClaims); ok && token.Valid {
-			if time.Now().Unix() > claims.ExpiresAt.Unix() {
+			if len(authHeader) == 0 {
 				return ctx.JSON(http.StatusUnauthorized, "")
 			}
 
-			user, err := model.GetById(claims.Id)
+			authFields := strings.Fields(authHeader)
+			if len(authFields) != 2 || strings.ToLower(authFields[0]) != "bearer" {
+				return errors.New("bad authorization header")
+			}
+			tokenString := authFields[1]
+
+			token, err := jwt.ParseWithClaims(tokenString, &jwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+				return []byte(secret_key), nil
+			})
 
 			if err != nil {
 				return ctx.JSON(http.StatusUnauthorized, "")
 			}
 
-			if user.Email == "" {
+			if claims, ok := token.Claims.(*jwtCustomClaims); ok && token.Valid {
+				if time.Now().Unix() > claims.ExpiresAt.Unix() {
+					return ctx.JSON(http.StatusUnauthorized, "")
+				}
+
+				user, err := users.GetById(claims.Id)
+
+				if err != nil {
+					return ctx.JSON(http.StatusUnauthorized, "")
+				}
+
+				if user.Email == "" {
+					return ctx.JSON(http.StatusUnauthorized, "")
+				}
+				ctx.Set("user", user)
+			} else {
 				return ctx.JSON(http.StatusUnauthorized, "")
 			}
-			ctx.Set("user", user)
-		} else {
-			return ctx.JSON(http.StatusUnauthorized, "")
+
+			return next(ctx)
+		}
+	}
+}
+
+// AdminOnly must be used after JwtAuthMiddleware. The role is taken from the
+// database, so revoking it takes effect without waiting for the token to expire.
+func AdminOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		user, ok := ctx.Get("user").(model.User)
+		if !ok || !user.IsAdmin() {
+			return ctx.JSON(http.StatusForbidden, "")
 		}
 
 		return next(ctx)
@@ -81,8 +110,8 @@ func JwtAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func GenerateAccessToken(user *model.User) (string, time.Time, error) {
-	// Declare the expiration time of the token (1h).
-	expirationTime := time.Now().Add(time.Hour * expirationHours)
+	// Declare the expiration time of the token.
+	expirationTime := time.Now().Add(expiration)
 
 	return generateToken(user, expirationTime)
 }
@@ -91,7 +120,7 @@ func GenerateAccessToken(user *model.User) (string, time.Time, error) {
 func generateToken(user *model.User, expirationTime time.Time) (string, time.Time, error) {
 	claims := &jwtCustomClaims{
 		Id:    user.Id,
-		Admin: false,
+		Admin: user.IsAdmin(),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"github.com/labstack/echo/v4"
+	echoMiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/raikh/calc_micro_final/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestLogger writes an access log entry for every request. It must be used
+// after echo's RequestID middleware, which accepts an incoming X-Request-ID.
+func RequestLogger() echo.MiddlewareFunc {
+	return echoMiddleware.RequestLoggerWithConfig(echoMiddleware.RequestLoggerConfig{
+		LogMethod:    true,
+		LogURI:       true,
+		LogStatus:    true,
+		LogLatency:   true,
+		LogRequestID: true,
+		LogRemoteIP:  true,
+		LogError:     true,
+		HandleError:  true,
+		LogValuesFunc: func(c echo.Context, values echoMiddleware.RequestLoggerValues) error {
+			fields := log.Fields{
+				"request_id": values.RequestID,
+				"method":     values.Method,
+				"uri":        values.URI,
+				"status":     values.Status,
+				"latency_ms": values.Latency.Milliseconds(),
+				"remote_ip":  values.RemoteIP,
+			}
+			// the user is set by JwtAuthMiddleware on authenticated routes
+			if user, ok := c.Get("user").(model.User); ok {
+				fields["user_id"] = user.Id
+			}
+
+			entry := log.WithFields(fields)
+			if values.Error != nil {
+				entry.WithError(values.Error).Error("request")
+			} else {
+				entry.Info("request")
+			}
+
+			return nil
+		},
+	})
+}
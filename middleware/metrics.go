@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/metrics"
+)
+
+// Metrics records request latency labelled by the route pattern, not the raw
+// path, so expression ids don't blow up the number of series.
+func Metrics(m *metrics.Orchestrator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			start := time.Now()
+			err := next(ctx)
+
+			status := ctx.Response().Status
+			if httpErr, ok := err.(*echo.HTTPError); ok && !ctx.Response().Committed {
+				status = httpErr.Code
+			}
+
+			route := ctx.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			m.HTTPRequestDuration.
+				WithLabelValues(ctx.Request().Method, route, strconv.Itoa(status)).
+				Observe(time.Since(start).Seconds())
+
+			return err
+		}
+	}
+}
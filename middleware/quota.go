@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/quota"
+	"github.com/raikh/calc_micro_final/model"
+)
+
+// APIKey returns the key the request is authenticated with, nil for a login token.
+func APIKey(ctx echo.Context) *model.APIKey {
+	key, ok := ctx.Get("api_key").(model.APIKey)
+	if !ok {
+		return nil
+	}
+
+	return &key
+}
+
+// QuotaError responds to a request rejected by a quota with 429, Retry-After
+// is left out when waiting does not help. Other errors are returned unchanged.
+func QuotaError(ctx echo.Context, err error) error {
+	var exceeded *quota.Exceeded
+	if !errors.As(err, &exceeded) {
+		return err
+	}
+
+	body := map[string]string{"message": exceeded.Error(), "limit": exceeded.Limit, "subject": exceeded.Subject}
+	if exceeded.RetryAfter > 0 {
+		seconds := max(1, int(math.Ceil(exceeded.RetryAfter.Seconds())))
+		ctx.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	return ctx.JSON(http.StatusTooManyRequests, body)
+}
+
+// RateLimit limits requests per minute of the user and the API key, it must be used after JwtAuthMiddleware.
+func RateLimit(quotas *quota.Service) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			user, ok := ctx.Get("user").(model.User)
+			if !ok {
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+
+			if err := quotas.AllowRequest(user, APIKey(ctx)); err != nil {
+				return QuotaError(ctx, err)
+			}
+
+			return next(ctx)
+		}
+	}
+}
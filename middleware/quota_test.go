@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/quota"
+)
+
+func TestQuotaError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantRetryAfter string
+		wantErr        bool
+	}{
+		{
+			name:           "retry later",
+			err:            &quota.Exceeded{Limit: quota.LimitRequestsPerMinute, Subject: "user", RetryAfter: 1500 * time.Millisecond},
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "2",
+		},
+		{
+			name:       "waiting does not help",
+			err:        &quota.Exceeded{Limit: quota.LimitMaxOperations, Subject: "api_key"},
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:    "other error",
+			err:     errors.New("database is gone"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ctx := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/calculate", nil), rec)
+
+			err := QuotaError(ctx, tt.err)
+			if tt.wantErr {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("QuotaError() = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus || rec.Header().Get("Retry-After") != tt.wantRetryAfter {
+				t.Errorf("response %d with Retry-After %q, want %d with %q",
+					rec.Code, rec.Header().Get("Retry-After"), tt.wantStatus, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+	"github.com/raikh/calc_micro_final/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing starts a server span for every request, continuing the trace of the
+// caller when it sends a traceparent header.
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		req := ctx.Request()
+		parent := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+		spanCtx, span := tracing.Tracer().Start(parent, fmt.Sprintf("%s %s", req.Method, ctx.Path()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", ctx.Path()),
+			),
+		)
+		defer span.End()
+
+		ctx.SetRequest(req.WithContext(spanCtx))
+		err := next(ctx)
+
+		status := ctx.Response().Status
+		if httpErr, ok := err.(*echo.HTTPError); ok && !ctx.Response().Committed {
+			status = httpErr.Code
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+
+		return err
+	}
+}
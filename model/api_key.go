@@ -0,0 +1,160 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const apiKeyPrefix = "ck_"
+
+// APIKey authenticates scripts of a user without a login. Only the hash of the
+// key is stored, the key itself is shown once on creation.
+type APIKey struct {
+	Id     int64  `json:"id" db:"id"`
+	UserId int64  `json:"-" db:"user_id"`
+	Name   string `json:"name" db:"name"`
+	// Prefix is the start of the key, to tell keys apart in the list
+	Prefix string `json:"prefix" db:"prefix"`
+	Hash   string `json:"-" db:"hash"`
+	// Quota of the key applies in addition to the quota of the user
+	Quota     `json:"quota"`
+	CreatedAt *time.Time `json:"created_at" db:"created_at"`
+}
+
+// NewAPIKey returns the key to give to the user once and its record.
+func NewAPIKey(userId int64, name string, quota Quota) (string, *APIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	now := time.Now()
+
+	return key, &APIKey{
+		UserId:    userId,
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Hash:      HashAPIKey(key),
+		Quota:     quota,
+		CreatedAt: &now,
+	}, nil
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type sqlAPIKeyRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLAPIKeyRepository(db *sqlx.DB, dialect database.Dialect) APIKeyRepository {
+	return &sqlAPIKeyRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlAPIKeyRepository) Create(key *APIKey) error {
+	query, args, err := r.builder.Insert("api_keys").
+		Columns("user_id", "name", "prefix", "hash", "requests_per_minute", "max_pending_expressions", "max_operations", "daily_tasks", "created_at").
+		Values(key.UserId, key.Name, key.Prefix, key.Hash, key.RequestsPerMinute, key.MaxPendingExpressions, key.MaxOperations, key.DailyTasks, key.CreatedAt).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := r.db.Exec(query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return err
+	}
+
+	key.Id = id
+
+	return nil
+}
+
+func (r *sqlAPIKeyRepository) GetByHash(hash string) (APIKey, error) {
+	var key APIKey
+
+	query, args, err := r.builder.Select("*").
+		From("api_keys").
+		Where(sq.Eq{"hash": hash}).
+		Limit(1).
+		ToSql()
+
+	if err != nil {
+		return APIKey{}, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Get(&key, query, args...)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, errors.New("api key not found")
+		}
+		return APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	return key, nil
+}
+
+func (r *sqlAPIKeyRepository) GetByUserId(userId int64) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	query, args, err := r.builder.Select("*").
+		From("api_keys").
+		Where(sq.Eq{"user_id": userId}).
+		OrderBy("id").
+		ToSql()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Select(&keys, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (r *sqlAPIKeyRepository) Delete(id int64, userId int64) (bool, error) {
+	query, args, err := r.builder.Delete("api_keys").
+		Where(sq.Eq{"id": id, "user_id": userId}).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := r.db.Exec(query, args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+
+	return deleted > 0, err
+}
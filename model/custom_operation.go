@@ -0,0 +1,154 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+type CustomOperation struct {
+	Name string `json:"name" db:"name"`
+	// Hash is the hex sha256 of the module, agents reload the operation when it changes
+	Hash      string     `json:"hash" db:"hash"`
+	Size      int        `json:"size" db:"size"`
+	Module    []byte     `json:"-" db:"module"`
+	CreatedAt *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type sqlCustomOperationRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLCustomOperationRepository(db *sqlx.DB, dialect database.Dialect) CustomOperationRepository {
+	return &sqlCustomOperationRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlCustomOperationRepository) List() ([]CustomOperation, error) {
+	var operations []CustomOperation
+
+	query, args, err := r.builder.Select("name", "hash", "size", "created_at", "updated_at").
+		From("custom_operations").
+		OrderBy("name").
+		ToSql()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Select(&operations, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get operations: %w", err)
+	}
+
+	return operations, nil
+}
+
+func (r *sqlCustomOperationRepository) Get(name string) (CustomOperation, error) {
+	var operation CustomOperation
+
+	query, args, err := r.builder.Select("*").
+		From("custom_operations").
+		Where(sq.Eq{"name": name}).
+		Limit(1).
+		ToSql()
+
+	if err != nil {
+		return CustomOperation{}, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Get(&operation, query, args...)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CustomOperation{}, fmt.Errorf("operation %s not found", name)
+		}
+		return CustomOperation{}, fmt.Errorf("failed to get operation: %w", err)
+	}
+
+	return operation, nil
+}
+
+func (r *sqlCustomOperationRepository) Save(operation *CustomOperation) (err error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := time.Now()
+	createdAt := &now
+
+	var existing []CustomOperation
+	query, args, err := r.builder.Select("name", "hash", "size", "created_at", "updated_at").
+		From("custom_operations").
+		Where(sq.Eq{"name": operation.Name}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if err = tx.Select(&existing, query, args...); err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		createdAt = existing[0].CreatedAt
+	}
+
+	// delete and insert instead of upsert, as its syntax differs between databases
+	query, args, err = r.builder.Delete("custom_operations").
+		Where(sq.Eq{"name": operation.Name}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	query, args, err = r.builder.Insert("custom_operations").
+		Columns("name", "hash", "size", "module", "created_at", "updated_at").
+		Values(operation.Name, operation.Hash, operation.Size, operation.Module, createdAt, &now).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	operation.CreatedAt = createdAt
+	operation.UpdatedAt = &now
+
+	return nil
+}
+
+func (r *sqlCustomOperationRepository) Delete(name string) error {
+	query, args, err := r.builder.Delete("custom_operations").
+		Where(sq.Eq{"name": name}).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(query, args...)
+
+	return err
+}
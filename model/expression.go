@@ -7,82 +7,102 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/api"
 	"github.com/raikh/calc_micro_final/internal/database"
 
 	sq "github.com/Masterminds/squirrel"
 )
 
+const (
+	StatusPending   = api.StatusPending
+	StatusCompleted = api.StatusCompleted
+	StatusFailed    = api.StatusFailed
+	StatusTimedOut  = api.StatusTimedOut
+)
+
 type Expression struct {
-	Id         string     `json:"id" db:"id"`
-	UserId     int64      `json:"-" db:"user_id"`
-	Expression string     `json:"expression" db:"expression"`
-	Status     string     `json:"status" db:"status"`
-	Result     *float64   `json:"result" db:"result"`
-	CreatedAt  *time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  *time.Time `json:"updated_at" db:"updated_at"`
-	DeletedAt  *time.Time `json:"-" db:"deleted_at"`
+	Id         string   `json:"id" db:"id"`
+	UserId     int64    `json:"-" db:"user_id"`
+	Expression string   `json:"expression" db:"expression"`
+	Status     string   `json:"status" db:"status"`
+	Result     *float64 `json:"result" db:"result"`
+	// FailureReason tells why a failed expression was not computed
+	FailureReason string `json:"failure_reason,omitempty" db:"failure_reason"`
+	// Priority from 0 to 9 gives tasks of the expression precedence among tasks of the same user
+	// and a larger share of the agents to the user
+	Priority int `json:"priority" db:"priority"`
+	// APIKeyId is the key the expression was submitted with, nil for a login token
+	APIKeyId *int64 `json:"-" db:"api_key_id"`
+	// TaskCount is the number of operations, it is counted against the daily task budget
+	TaskCount int `json:"-" db:"task_count"`
+	// Deadline is the time the expression times out at, nil when it has none
+	Deadline  *time.Time `json:"deadline,omitempty" db:"deadline"`
+	CreatedAt *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
+	DeletedAt *time.Time `json:"-" db:"deleted_at"`
 }
 
-func BeginTx() (*sqlx.Tx, error) {
-	return database.GetDB().Beginx()
+// Usage is what the quota of a user or an API key is counted against.
+type Usage struct {
+	PendingExpressions int `json:"pending_expressions" db:"pending"`
+	// Tasks are the operations of expressions created since the given time
+	Tasks int `json:"tasks" db:"tasks"`
 }
 
-func (e *Expression) buildInsertExpression() (string, []interface{}, error) {
-	sql, args, err := sq.Insert("expressions").
-		Columns("id", "user_id", "expression", "status", "result", "created_at", "updated_at").
-		Values(e.Id, e.UserId, e.Expression, e.Status, e.Result, e.CreatedAt, e.UpdatedAt).
-		ToSql()
-
-	if err != nil {
-		return "", nil, err
-	}
-
-	return sql, args, nil
+type sqlExpressionRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+	dialect database.Dialect
 }
 
-func (e *Expression) InsertTx(tx *sqlx.Tx) error {
-	sql, args, err := e.buildInsertExpression()
+func NewSQLExpressionRepository(db *sqlx.DB, dialect database.Dialect) ExpressionRepository {
+	return &sqlExpressionRepository{db: db, builder: dialect.Builder(), dialect: dialect}
+}
 
+func (r *sqlExpressionRepository) Create(e *Expression, tasks []*Task) (err error) {
+	tx, err := r.db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	res, err := tx.Exec(sql, args...)
-	if err != nil {
-		return err
-	}
-	_, err = res.LastInsertId()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (e *Expression) Insert() error {
-	sql, args, err := e.buildInsertExpression()
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	res, err := database.GetDB().Exec(sql, args...)
+	sql, args, err := r.builder.Insert("expressions").
+		Columns("id", "user_id", "expression", "status", "result", "priority", "api_key_id", "task_count", "deadline", "created_at", "updated_at").
+		Values(e.Id, e.UserId, e.Expression, e.Status, e.Result, e.Priority, e.APIKeyId, e.TaskCount, e.Deadline, e.CreatedAt, e.UpdatedAt).
+		ToSql()
 
 	if err != nil {
 		return err
 	}
 
-	_, err = res.LastInsertId()
-
-	if err != nil {
+	if _, err = tx.Exec(sql, args...); err != nil {
 		return err
 	}
 
-	return nil
+	for _, task := range tasks {
+		if err = insertTaskTx(tx, r.builder, task); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func (e *Expression) Update() error {
+func (r *sqlExpressionRepository) Update(e *Expression) error {
 	now := time.Now()
-	sql, args, err := sq.Update("expressions").
+	sql, args, err := r.builder.Update("expressions").
 		Set("expression", e.Expression).
 		Set("status", e.Status).
 		Set("result", e.Result).
+		Set("failure_reason", e.FailureReason).
 		Set("updated_at", &now).
 		Where(sq.Eq{"id": e.Id}).
 		ToSql()
@@ -91,19 +111,13 @@ func (e *Expression) Update() error {
 		return err
 	}
 
-	_, err = database.GetDB().Exec(sql, args...)
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return execUpdate(r.db, sql, args)
 }
 
-func GetExpressionById(id string) (Expression, error) {
+func (r *sqlExpressionRepository) GetById(id string) (Expression, error) {
 	var expression Expression
 
-	query, args, err := sq.Select("*").
+	query, args, err := r.builder.Select("*").
 		From("expressions").
 		Where(sq.Eq{"id": id}).
 		Limit(1).
@@ -113,7 +127,7 @@ func GetExpressionById(id string) (Expression, error) {
 		return Expression{}, fmt.Errorf("failed to build query: %w", err)
 	}
 
-	err = database.GetDB().Get(&expression, query, args...)
+	err = r.db.Get(&expression, query, args...)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -125,10 +139,31 @@ func GetExpressionById(id string) (Expression, error) {
 	return expression, nil
 }
 
-func GetExpressionByIdForUser(id string, userId int64) (Expression, error) {
+func (r *sqlExpressionRepository) GetByIds(ids []string) ([]Expression, error) {
+	var expressions []Expression
+
+	query, args, err := r.builder.Select("*").
+		From("expressions").
+		Where(sq.Eq{"id": ids}).
+		ToSql()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Select(&expressions, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expressions: %w", err)
+	}
+
+	return expressions, nil
+}
+
+func (r *sqlExpressionRepository) GetByIdForUser(id string, userId int64) (Expression, error) {
 	var expression Expression
 
-	query, args, err := sq.Select("*").
+	query, args, err := r.builder.Select("*").
 		From("expressions").
 		Where(sq.Eq{"id": id}).
 		Where(sq.Eq{"user_id": userId}).
@@ -139,7 +174,7 @@ func GetExpressionByIdForUser(id string, userId int64) (Expression, error) {
 		return Expression{}, fmt.Errorf("failed to build query: %w", err)
 	}
 
-	err = database.GetDB().Get(&expression, query, args...)
+	err = r.db.Get(&expression, query, args...)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -151,10 +186,10 @@ func GetExpressionByIdForUser(id string, userId int64) (Expression, error) {
 	return expression, nil
 }
 
-func GetExpressionsByUserId(userId int64) ([]Expression, error) {
+func (r *sqlExpressionRepository) GetByUserId(userId int64) ([]Expression, error) {
 	var expressions []Expression
 
-	query, args, err := sq.Select("*").
+	query, args, err := r.builder.Select("*").
 		From("expressions").
 		Where(sq.Eq{"user_id": userId}).
 		ToSql()
@@ -163,7 +198,7 @@ func GetExpressionsByUserId(userId int64) ([]Expression, error) {
 		return nil, fmt.Errorf("failed to build query: %w", err)
 	}
 
-	err = database.GetDB().Select(&expressions, query, args...)
+	err = r.db.Select(&expressions, query, args...)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to get expressions: %w", err)
@@ -171,3 +206,86 @@ func GetExpressionsByUserId(userId int64) ([]Expression, error) {
 
 	return expressions, nil
 }
+
+func (r *sqlExpressionRepository) CountByStatus() (map[string]int, error) {
+	var rows []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}
+
+	query, args, err := r.builder.Select("status", "count(*) AS count").
+		From("expressions").
+		GroupBy("status").
+		ToSql()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Select(&rows, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to count expressions: %w", err)
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+
+	return counts, nil
+}
+
+func (r *sqlExpressionRepository) Usage(userId int64, apiKeyId *int64, since time.Time) (Usage, error) {
+	var usage Usage
+
+	where := sq.And{sq.Eq{"user_id": userId}}
+	if apiKeyId != nil {
+		where = append(where, sq.Eq{"api_key_id": *apiKeyId})
+	}
+
+	// the database compares with its own clock, like GetForProcessing of tasks does
+	query, args, err := r.builder.Select().
+		Column(sq.Expr("COUNT(CASE WHEN status = ? THEN 1 END) AS pending", StatusPending)).
+		Column(sq.Expr("COALESCE(SUM(CASE WHEN "+r.dialect.SecondsSince("created_at")+" < ? THEN task_count ELSE 0 END), 0) AS tasks",
+			int64(time.Since(since).Seconds()))).
+		From("expressions").
+		Where(where).
+		ToSql()
+
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Get(&usage, query, args...)
+
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to count usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+func (r *sqlExpressionRepository) TimeOutExpired() (int64, error) {
+	now := time.Now()
+	query, args, err := r.builder.Update("expressions").
+		Set("status", StatusTimedOut).
+		Set("updated_at", &now).
+		Where(sq.Eq{"status": StatusPending}).
+		Where(sq.NotEq{"deadline": nil}).
+		// deadlines are stored in UTC, SecondsSince would be late by up to a second
+		Where(sq.LtOrEq{"deadline": now.UTC()}).
+		ToSql()
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	result, err := r.db.Exec(query, args...)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to time out expressions: %w", err)
+	}
+
+	return result.RowsAffected()
+}
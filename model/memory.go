@@ -0,0 +1,853 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps all the records in process memory. It is used for tests
+// and for the ephemeral APP_DB_TYPE=memory mode, nothing survives a restart.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	users      map[int64]User
+	lastUserId int64
+
+	expressions     map[string]Expression
+	expressionOrder []string
+
+	tasks     map[string]Task
+	taskOrder []string
+
+	operationTimes map[int64]map[string]int64
+
+	customOperations map[string]CustomOperation
+
+	quotas map[int64]Quota
+
+	apiKeys      map[int64]APIKey
+	lastAPIKeyId int64
+
+	// replicas are keyed by task id and agent id
+	replicas map[string]map[string]Replica
+	agents   map[string]AgentRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:            make(map[int64]User),
+		expressions:      make(map[string]Expression),
+		tasks:            make(map[string]Task),
+		operationTimes:   make(map[int64]map[string]int64),
+		customOperations: make(map[string]CustomOperation),
+		quotas:           make(map[int64]Quota),
+		apiKeys:          make(map[int64]APIKey),
+		replicas:         make(map[string]map[string]Replica),
+		agents:           make(map[string]AgentRecord),
+	}
+}
+
+func cloneFloat(value *float64) *float64 {
+	if value == nil {
+		return nil
+	}
+	v := *value
+	return &v
+}
+
+func cloneTask(task Task) Task {
+	task.Arg1 = cloneFloat(task.Arg1)
+	task.Arg2 = cloneFloat(task.Arg2)
+	task.Result = cloneFloat(task.Result)
+	if task.Dependencies != nil {
+		task.Dependencies = append(StringArray{}, task.Dependencies...)
+	}
+	return task
+}
+
+func cloneExpression(expression Expression) Expression {
+	expression.Result = cloneFloat(expression.Result)
+	if expression.APIKeyId != nil {
+		id := *expression.APIKeyId
+		expression.APIKeyId = &id
+	}
+	return expression
+}
+
+type memoryUserRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryUserRepository) GetByEmail(email string) (User, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	for _, user := range r.store.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+
+	return User{}, sql.ErrNoRows
+}
+
+func (r *memoryUserRepository) GetById(id int64) (User, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	user, ok := r.store.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+
+	return user, nil
+}
+
+func (r *memoryUserRepository) Create(email string, password string, role string) (*User, error) {
+	// hashing is slow, so it is done before taking the lock
+	user := newUser(email, password, role)
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	for _, existing := range r.store.users {
+		if existing.Email == email {
+			return nil, errors.New("email already exists")
+		}
+	}
+
+	r.store.lastUserId++
+	user.Id = r.store.lastUserId
+	r.store.users[user.Id] = *user
+
+	return user, nil
+}
+
+func (r *memoryUserRepository) SetRole(id int64, role string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	user, ok := r.store.users[id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	user.Role = role
+	user.UpdatedAt = &now
+	r.store.users[id] = user
+
+	return nil
+}
+
+func (r *memoryUserRepository) GetRoles(ids []int64) (map[int64]string, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	roles := make(map[int64]string, len(ids))
+	for _, id := range ids {
+		if user, ok := r.store.users[id]; ok {
+			roles[id] = user.Role
+		}
+	}
+
+	return roles, nil
+}
+
+type memoryExpressionRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryExpressionRepository) Create(e *Expression, tasks []*Task) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if _, ok := r.store.expressions[e.Id]; ok {
+		return fmt.Errorf("expression with id %s already exists", e.Id)
+	}
+	for _, task := range tasks {
+		if _, ok := r.store.tasks[task.Id]; ok {
+			return fmt.Errorf("task with id %s already exists", task.Id)
+		}
+	}
+
+	r.store.expressions[e.Id] = cloneExpression(*e)
+	r.store.expressionOrder = append(r.store.expressionOrder, e.Id)
+	for _, task := range tasks {
+		r.store.tasks[task.Id] = cloneTask(*task)
+		r.store.taskOrder = append(r.store.taskOrder, task.Id)
+	}
+
+	return nil
+}
+
+func (r *memoryExpressionRepository) Update(e *Expression) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.expressions[e.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	stored.Expression = e.Expression
+	stored.Status = e.Status
+	stored.Result = cloneFloat(e.Result)
+	stored.FailureReason = e.FailureReason
+	stored.UpdatedAt = &now
+	r.store.expressions[e.Id] = stored
+
+	return nil
+}
+
+func (r *memoryExpressionRepository) GetById(id string) (Expression, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	expression, ok := r.store.expressions[id]
+	if !ok {
+		return Expression{}, fmt.Errorf("expression with id %s not found", id)
+	}
+
+	return cloneExpression(expression), nil
+}
+
+func (r *memoryExpressionRepository) GetByIds(ids []string) ([]Expression, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	expressions := []Expression{}
+	for _, id := range ids {
+		if expression, ok := r.store.expressions[id]; ok {
+			expressions = append(expressions, cloneExpression(expression))
+		}
+	}
+
+	return expressions, nil
+}
+
+func (r *memoryExpressionRepository) GetByIdForUser(id string, userId int64) (Expression, error) {
+	expression, err := r.GetById(id)
+	if err != nil {
+		return Expression{}, err
+	}
+
+	if expression.UserId != userId {
+		return Expression{}, fmt.Errorf("expression with id %s not found", id)
+	}
+
+	return expression, nil
+}
+
+func (r *memoryExpressionRepository) CountByStatus() (map[string]int, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, expression := range r.store.expressions {
+		counts[expression.Status]++
+	}
+
+	return counts, nil
+}
+
+func (r *memoryExpressionRepository) Usage(userId int64, apiKeyId *int64, since time.Time) (Usage, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var usage Usage
+	for _, expression := range r.store.expressions {
+		if expression.UserId != userId {
+			continue
+		}
+		if apiKeyId != nil && (expression.APIKeyId == nil || *expression.APIKeyId != *apiKeyId) {
+			continue
+		}
+		if expression.Status == StatusPending {
+			usage.PendingExpressions++
+		}
+		if expression.CreatedAt != nil && !expression.CreatedAt.Before(since) {
+			usage.Tasks += expression.TaskCount
+		}
+	}
+
+	return usage, nil
+}
+
+func (r *memoryExpressionRepository) TimeOutExpired() (int64, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+	var count int64
+	for id, expression := range r.store.expressions {
+		if expression.Status != StatusPending || expression.Deadline == nil || now.Before(*expression.Deadline) {
+			continue
+		}
+		expression.Status = StatusTimedOut
+		expression.UpdatedAt = &now
+		r.store.expressions[id] = expression
+		count++
+	}
+
+	return count, nil
+}
+
+func (r *memoryExpressionRepository) GetByUserId(userId int64) ([]Expression, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var expressions []Expression
+	for _, id := range r.store.expressionOrder {
+		expression := r.store.expressions[id]
+		if expression.UserId == userId {
+			expressions = append(expressions, cloneExpression(expression))
+		}
+	}
+
+	return expressions, nil
+}
+
+type memoryTaskRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryTaskRepository) Update(e *Task) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.tasks[e.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	stored.Arg1 = cloneFloat(e.Arg1)
+	stored.Arg2 = cloneFloat(e.Arg2)
+	stored.Result = cloneFloat(e.Result)
+	stored.Completed = e.Completed
+	stored.IsProcessing = e.IsProcessing
+	stored.DispatchedAt = e.DispatchedAt
+	stored.Attempts = e.Attempts
+	stored.DeadLetter = e.DeadLetter
+	stored.FailureReason = e.FailureReason
+	stored.UpdatedAt = &now
+	r.store.tasks[e.Id] = stored
+
+	return nil
+}
+
+func (r *memoryTaskRepository) Claim(e *Task, loadedAttempts int) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	stored, ok := r.store.tasks[e.Id]
+	if !ok || stored.Attempts != loadedAttempts || stored.Completed || stored.DeadLetter {
+		return false, nil
+	}
+
+	now := time.Now()
+	stored.IsProcessing = e.IsProcessing
+	stored.DispatchedAt = e.DispatchedAt
+	stored.Attempts = e.Attempts
+	stored.UpdatedAt = &now
+	r.store.tasks[e.Id] = stored
+
+	return true, nil
+}
+
+func (r *memoryTaskRepository) GetById(id string) (*Task, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	task, ok := r.store.tasks[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	task = cloneTask(task)
+	return &task, nil
+}
+
+func (r *memoryTaskRepository) GetByIds(ids []string) ([]Task, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var tasks []Task
+	for _, id := range ids {
+		if task, ok := r.store.tasks[id]; ok {
+			tasks = append(tasks, cloneTask(task))
+		}
+	}
+
+	return tasks, nil
+}
+
+func (r *memoryTaskRepository) GetByExpressionId(expressionId string) ([]Task, error) {
+	return r.filter(func(task *Task) bool {
+		return task.ExpressionId == expressionId
+	}), nil
+}
+
+func (r *memoryTaskRepository) IsAllCompleted(expressionId string) bool {
+	pending := r.filter(func(task *Task) bool {
+		return task.ExpressionId == expressionId && !task.Completed
+	})
+
+	return len(pending) == 0
+}
+
+func (r *memoryTaskRepository) CountIncomplete(expressionIds []string) (map[string]int, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	counts := make(map[string]int, len(expressionIds))
+	for _, task := range r.store.tasks {
+		if !task.Completed && slices.Contains(expressionIds, task.ExpressionId) {
+			counts[task.ExpressionId]++
+		}
+	}
+
+	return counts, nil
+}
+
+func (r *memoryTaskRepository) Complete(e *Task) error {
+	if err := r.Update(e); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+	for id, task := range r.store.tasks {
+		if task.ExpressionId != e.ExpressionId || task.Completed {
+			continue
+		}
+		task = cloneTask(task)
+		if passResult(&task, e.Id, e.Result) {
+			task.UpdatedAt = &now
+			r.store.tasks[id] = task
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryTaskRepository) GetForProcessing(redistributionDelay int) ([]Task, error) {
+	now := time.Now()
+	delay := time.Duration(redistributionDelay) * time.Second
+
+	return r.filter(func(task *Task) bool {
+		if task.Completed || task.DeadLetter || task.Arg1 == nil || task.Arg2 == nil {
+			return false
+		}
+		// filter holds the lock of the store
+		if r.store.expressions[task.ExpressionId].Status != StatusPending {
+			return false
+		}
+		return !task.IsProcessing || task.UpdatedAt == nil || now.Sub(*task.UpdatedAt) > delay
+	}), nil
+}
+
+func (r *memoryTaskRepository) CountForProcessing(redistributionDelay int) (int, error) {
+	tasks, err := r.GetForProcessing(redistributionDelay)
+	return len(tasks), err
+}
+
+func (r *memoryTaskRepository) FillArguments() (int, error) {
+	waiting := r.filter(func(task *Task) bool {
+		return !task.Completed && (task.Arg1 == nil || task.Arg2 == nil)
+	})
+
+	var dependencyIds []string
+	for _, task := range waiting {
+		dependencyIds = append(dependencyIds, task.Dependencies...)
+	}
+	dependencies, err := r.GetByIds(dependencyIds)
+	if err != nil {
+		return 0, err
+	}
+
+	filled := 0
+	for _, task := range fillArguments(waiting, dependencies) {
+		if err := r.Update(&task); err != nil {
+			return filled, err
+		}
+		filled++
+	}
+
+	return filled, nil
+}
+
+func (r *memoryTaskRepository) GetDeadLettered() ([]Task, error) {
+	tasks := r.filter(func(task *Task) bool {
+		return task.DeadLetter
+	})
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].UpdatedAt != nil && tasks[j].UpdatedAt != nil && tasks[i].UpdatedAt.Before(*tasks[j].UpdatedAt)
+	})
+	if tasks == nil {
+		tasks = []Task{}
+	}
+
+	return tasks, nil
+}
+
+func (r *memoryTaskRepository) GetPendingByOperation(operation string) ([]Task, error) {
+	return r.filter(func(task *Task) bool {
+		return task.Operation == operation && !task.Completed
+	}), nil
+}
+
+func (r *memoryTaskRepository) filter(match func(task *Task) bool) []Task {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	var tasks []Task
+	for _, id := range r.store.taskOrder {
+		task := r.store.tasks[id]
+		if match(&task) {
+			tasks = append(tasks, cloneTask(task))
+		}
+	}
+
+	return tasks
+}
+
+type memoryOperationTimeRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryOperationTimeRepository) GetDefaults() (map[string]int64, error) {
+	return r.GetForUser(DefaultsUserId)
+}
+
+func (r *memoryOperationTimeRepository) GetOverrides() (map[int64]map[string]int64, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	overrides := make(map[int64]map[string]int64)
+	for userId, times := range r.store.operationTimes {
+		if userId == DefaultsUserId || len(times) == 0 {
+			continue
+		}
+		overrides[userId] = maps.Clone(times)
+	}
+
+	return overrides, nil
+}
+
+func (r *memoryOperationTimeRepository) GetForUser(userId int64) (map[string]int64, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	result := maps.Clone(r.store.operationTimes[DefaultsUserId])
+	if result == nil {
+		result = make(map[string]int64)
+	}
+	maps.Copy(result, r.store.operationTimes[userId])
+
+	return result, nil
+}
+
+func (r *memoryOperationTimeRepository) Set(userId int64, times map[string]int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if r.store.operationTimes[userId] == nil {
+		r.store.operationTimes[userId] = make(map[string]int64)
+	}
+	maps.Copy(r.store.operationTimes[userId], times)
+
+	return nil
+}
+
+func (r *memoryOperationTimeRepository) DeleteForUser(userId int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	delete(r.store.operationTimes, userId)
+
+	return nil
+}
+
+func (r *memoryOperationTimeRepository) SeedDefaults(times map[string]int64) error {
+	defaults, err := r.GetDefaults()
+	if err != nil {
+		return err
+	}
+
+	return r.Set(DefaultsUserId, missingOperationTimes(defaults, times))
+}
+
+type memoryCustomOperationRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryCustomOperationRepository) List() ([]CustomOperation, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	operations := make([]CustomOperation, 0, len(r.store.customOperations))
+	for _, operation := range r.store.customOperations {
+		operation.Module = nil
+		operations = append(operations, operation)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Name < operations[j].Name })
+
+	return operations, nil
+}
+
+func (r *memoryCustomOperationRepository) Get(name string) (CustomOperation, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	operation, ok := r.store.customOperations[name]
+	if !ok {
+		return CustomOperation{}, fmt.Errorf("operation %s not found", name)
+	}
+	operation.Module = slices.Clone(operation.Module)
+
+	return operation, nil
+}
+
+func (r *memoryCustomOperationRepository) Save(operation *CustomOperation) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	now := time.Now()
+	stored := *operation
+	stored.Module = slices.Clone(operation.Module)
+	stored.CreatedAt = &now
+	if existing, ok := r.store.customOperations[operation.Name]; ok {
+		stored.CreatedAt = existing.CreatedAt
+	}
+	stored.UpdatedAt = &now
+	r.store.customOperations[operation.Name] = stored
+
+	operation.CreatedAt = stored.CreatedAt
+	operation.UpdatedAt = stored.UpdatedAt
+
+	return nil
+}
+
+func (r *memoryCustomOperationRepository) Delete(name string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	delete(r.store.customOperations, name)
+
+	return nil
+}
+
+type memoryQuotaRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryQuotaRepository) GetOverrides() (map[int64]Quota, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	return maps.Clone(r.store.quotas), nil
+}
+
+func (r *memoryQuotaRepository) GetForUser(userId int64) (Quota, bool, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	quota, ok := r.store.quotas[userId]
+
+	return quota, ok, nil
+}
+
+func (r *memoryQuotaRepository) Set(userId int64, quota Quota) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.quotas[userId] = quota
+
+	return nil
+}
+
+func (r *memoryQuotaRepository) Delete(userId int64) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	delete(r.store.quotas, userId)
+
+	return nil
+}
+
+type memoryAPIKeyRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryAPIKeyRepository) Create(key *APIKey) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	r.store.lastAPIKeyId++
+	key.Id = r.store.lastAPIKeyId
+	r.store.apiKeys[key.Id] = *key
+
+	return nil
+}
+
+func (r *memoryAPIKeyRepository) GetByHash(hash string) (APIKey, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	for _, key := range r.store.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+
+	return APIKey{}, errors.New("api key not found")
+}
+
+func (r *memoryAPIKeyRepository) GetByUserId(userId int64) ([]APIKey, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range r.store.apiKeys {
+		if key.UserId == userId {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+
+	return keys, nil
+}
+
+func (r *memoryAPIKeyRepository) Delete(id int64, userId int64) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	key, ok := r.store.apiKeys[id]
+	if !ok || key.UserId != userId {
+		return false, nil
+	}
+	delete(r.store.apiKeys, id)
+
+	return true, nil
+}
+
+type memoryReplicaRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryReplicaRepository) GetByTaskIds(taskIds []string) ([]Replica, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	replicas := []Replica{}
+	for _, taskId := range taskIds {
+		for _, replica := range r.store.replicas[taskId] {
+			replica.Result = cloneFloat(replica.Result)
+			replicas = append(replicas, replica)
+		}
+	}
+
+	return replicas, nil
+}
+
+func (r *memoryReplicaRepository) Dispatch(taskId string, agentId string) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if r.store.replicas[taskId] == nil {
+		r.store.replicas[taskId] = make(map[string]Replica)
+	}
+	now := time.Now()
+	r.store.replicas[taskId][agentId] = Replica{TaskId: taskId, AgentId: agentId, DispatchedAt: &now}
+
+	return nil
+}
+
+func (r *memoryReplicaRepository) SetResult(taskId string, agentId string, result float64) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	replica, ok := r.store.replicas[taskId][agentId]
+	if !ok || replica.AnsweredAt != nil {
+		return false, nil
+	}
+
+	now := time.Now()
+	replica.Result = &result
+	replica.AnsweredAt = &now
+	r.store.replicas[taskId][agentId] = replica
+
+	return true, nil
+}
+
+type memoryAgentRepository struct {
+	store *memoryStore
+}
+
+func (r *memoryAgentRepository) Get(id string) (AgentRecord, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	record, ok := r.store.agents[id]
+	if !ok {
+		return AgentRecord{Id: id}, nil
+	}
+
+	return record, nil
+}
+
+func (r *memoryAgentRepository) List() ([]AgentRecord, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	records := slices.Collect(maps.Values(r.store.agents))
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	if records == nil {
+		records = []AgentRecord{}
+	}
+
+	return records, nil
+}
+
+func (r *memoryAgentRepository) Record(id string, agreed bool, quarantineAfter int) (AgentRecord, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	record := r.store.agents[id]
+	record.Id = id
+	record.count(agreed, quarantineAfter)
+	r.store.agents[id] = record
+
+	return record, nil
+}
+
+func (r *memoryAgentRepository) Release(id string) (bool, error) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	record, ok := r.store.agents[id]
+	if !ok {
+		return false, nil
+	}
+
+	now := time.Now()
+	record.Disagreements = 0
+	record.Quarantined = false
+	record.UpdatedAt = &now
+	r.store.agents[id] = record
+
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// DefaultsUserId marks operation delays which apply to every user.
+const DefaultsUserId int64 = 0
+
+type OperationTime struct {
+	Operation string     `db:"operation"`
+	UserId    int64      `db:"user_id"`
+	TimeMs    int64      `db:"time_ms"`
+	UpdatedAt *time.Time `db:"updated_at"`
+}
+
+type sqlOperationTimeRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLOperationTimeRepository(db *sqlx.DB, dialect database.Dialect) OperationTimeRepository {
+	return &sqlOperationTimeRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlOperationTimeRepository) selectTimes(where sq.Sqlizer) ([]OperationTime, error) {
+	var times []OperationTime
+
+	sql, args, err := r.builder.Select("*").
+		From("operation_times").
+		Where(where).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Select(&times, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return times, nil
+}
+
+func (r *sqlOperationTimeRepository) GetDefaults() (map[string]int64, error) {
+	return r.GetForUser(DefaultsUserId)
+}
+
+func (r *sqlOperationTimeRepository) GetOverrides() (map[int64]map[string]int64, error) {
+	times, err := r.selectTimes(sq.NotEq{"user_id": DefaultsUserId})
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[int64]map[string]int64)
+	for _, t := range times {
+		if overrides[t.UserId] == nil {
+			overrides[t.UserId] = make(map[string]int64)
+		}
+		overrides[t.UserId][t.Operation] = t.TimeMs
+	}
+
+	return overrides, nil
+}
+
+func (r *sqlOperationTimeRepository) GetForUser(userId int64) (map[string]int64, error) {
+	times, err := r.selectTimes(sq.Eq{"user_id": []int64{DefaultsUserId, userId}})
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeOperationTimes(times, userId), nil
+}
+
+func (r *sqlOperationTimeRepository) Set(userId int64, times map[string]int64) (err error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// delete and insert instead of upsert, as its syntax differs between databases
+	now := time.Now()
+	for operation, timeMs := range times {
+		sql, args, err := r.builder.Delete("operation_times").
+			Where(sq.Eq{"operation": operation, "user_id": userId}).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sql, args...); err != nil {
+			return err
+		}
+
+		sql, args, err = r.builder.Insert("operation_times").
+			Columns("operation", "user_id", "time_ms", "updated_at").
+			Values(operation, userId, timeMs, &now).
+			ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sql, args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlOperationTimeRepository) DeleteForUser(userId int64) error {
+	sql, args, err := r.builder.Delete("operation_times").
+		Where(sq.Eq{"user_id": userId}).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(sql, args...)
+
+	return err
+}
+
+func (r *sqlOperationTimeRepository) SeedDefaults(times map[string]int64) error {
+	defaults, err := r.GetDefaults()
+	if err != nil {
+		return err
+	}
+
+	return r.Set(DefaultsUserId, missingOperationTimes(defaults, times))
+}
+
+// mergeOperationTimes applies the overrides of the user on top of the defaults.
+func mergeOperationTimes(times []OperationTime, userId int64) map[string]int64 {
+	result := make(map[string]int64)
+	for _, t := range times {
+		if t.UserId == DefaultsUserId {
+			if _, ok := result[t.Operation]; !ok {
+				result[t.Operation] = t.TimeMs
+			}
+		}
+	}
+	if userId == DefaultsUserId {
+		return result
+	}
+	for _, t := range times {
+		if t.UserId == userId {
+			result[t.Operation] = t.TimeMs
+		}
+	}
+
+	return result
+}
+
+func missingOperationTimes(existing map[string]int64, times map[string]int64) map[string]int64 {
+	missing := make(map[string]int64)
+	for operation, timeMs := range times {
+		if _, ok := existing[operation]; !ok {
+			missing[operation] = timeMs
+		}
+	}
+
+	return missing
+}
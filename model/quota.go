@@ -0,0 +1,139 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// Quota limits a user or an API key, zero means unlimited.
+type Quota struct {
+	RequestsPerMinute     int `json:"requests_per_minute" db:"requests_per_minute"`
+	MaxPendingExpressions int `json:"max_pending_expressions" db:"max_pending_expressions"`
+	MaxOperations         int `json:"max_operations" db:"max_operations"`
+	DailyTasks            int `json:"daily_tasks" db:"daily_tasks"`
+}
+
+func (q Quota) IsValid() bool {
+	return q.RequestsPerMinute >= 0 && q.MaxPendingExpressions >= 0 && q.MaxOperations >= 0 && q.DailyTasks >= 0
+}
+
+type userQuota struct {
+	UserId int64 `db:"user_id"`
+	Quota
+	UpdatedAt *time.Time `db:"updated_at"`
+}
+
+type sqlQuotaRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLQuotaRepository(db *sqlx.DB, dialect database.Dialect) QuotaRepository {
+	return &sqlQuotaRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlQuotaRepository) GetOverrides() (map[int64]Quota, error) {
+	var rows []userQuota
+
+	query, args, err := r.builder.Select("*").
+		From("user_quotas").
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.db.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[int64]Quota, len(rows))
+	for _, row := range rows {
+		overrides[row.UserId] = row.Quota
+	}
+
+	return overrides, nil
+}
+
+func (r *sqlQuotaRepository) GetForUser(userId int64) (Quota, bool, error) {
+	var row userQuota
+
+	query, args, err := r.builder.Select("*").
+		From("user_quotas").
+		Where(sq.Eq{"user_id": userId}).
+		Limit(1).
+		ToSql()
+
+	if err != nil {
+		return Quota{}, false, err
+	}
+
+	err = r.db.Get(&row, query, args...)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Quota{}, false, nil
+		}
+		return Quota{}, false, err
+	}
+
+	return row.Quota, true, nil
+}
+
+func (r *sqlQuotaRepository) Set(userId int64, quota Quota) (err error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// delete and insert instead of upsert, as its syntax differs between databases
+	query, args, err := r.builder.Delete("user_quotas").
+		Where(sq.Eq{"user_id": userId}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query, args, err = r.builder.Insert("user_quotas").
+		Columns("user_id", "requests_per_minute", "max_pending_expressions", "max_operations", "daily_tasks", "updated_at").
+		Values(userId, quota.RequestsPerMinute, quota.MaxPendingExpressions, quota.MaxOperations, quota.DailyTasks, &now).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlQuotaRepository) Delete(userId int64) error {
+	query, args, err := r.builder.Delete("user_quotas").
+		Where(sq.Eq{"user_id": userId}).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(query, args...)
+
+	return err
+}
@@ -0,0 +1,188 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+)
+
+type UserRepository interface {
+	GetByEmail(email string) (User, error)
+	GetById(id int64) (User, error)
+	Create(email string, password string, role string) (*User, error)
+	SetRole(id int64, role string) error
+	// GetRoles returns the roles of the users by user id.
+	GetRoles(ids []int64) (map[int64]string, error)
+}
+
+type ExpressionRepository interface {
+	// Create stores the expression together with its tasks atomically.
+	Create(expression *Expression, tasks []*Task) error
+	// Update returns sql.ErrNoRows for an unknown expression.
+	Update(expression *Expression) error
+	GetById(id string) (Expression, error)
+	GetByIds(ids []string) ([]Expression, error)
+	GetByIdForUser(id string, userId int64) (Expression, error)
+	GetByUserId(userId int64) ([]Expression, error)
+	CountByStatus() (map[string]int, error)
+	// Usage counts expressions of the user, only those submitted with the API key when it is set.
+	Usage(userId int64, apiKeyId *int64, since time.Time) (Usage, error)
+	// TimeOutExpired marks pending expressions past their deadline as timed out and returns their number.
+	TimeOutExpired() (int64, error)
+}
+
+type TaskRepository interface {
+	// Update returns sql.ErrNoRows for an unknown task.
+	Update(task *Task) error
+	// Claim stores the dispatch of the task unless it was given out or
+	// completed since it was loaded with loadedAttempts attempts. Orchestrators
+	// sharing a database claim a task before handing it to an agent.
+	Claim(task *Task, loadedAttempts int) (bool, error)
+	GetById(id string) (*Task, error)
+	GetByIds(ids []string) ([]Task, error)
+	GetByExpressionId(expressionId string) ([]Task, error)
+	// Complete stores the computed task and passes its result to the tasks
+	// waiting for it atomically.
+	Complete(task *Task) error
+	// GetForProcessing returns not completed tasks of pending expressions with
+	// both arguments known which are free or were taken by a worker more than
+	// redistributionDelay seconds ago.
+	GetForProcessing(redistributionDelay int) ([]Task, error)
+	CountForProcessing(redistributionDelay int) (int, error)
+	// FillArguments passes the results of completed tasks to the tasks waiting
+	// for them which lack them, e.g. tasks stored by an older version. It
+	// returns the number of tasks which got an argument.
+	FillArguments() (int, error)
+	IsAllCompleted(expressionId string) bool
+	// CountIncomplete returns the number of not completed tasks by expression id.
+	CountIncomplete(expressionIds []string) (map[string]int, error)
+	// GetDeadLettered returns tasks which ran out of attempts, the oldest first.
+	GetDeadLettered() ([]Task, error)
+	// GetPendingByOperation returns not completed tasks of the operation.
+	GetPendingByOperation(operation string) ([]Task, error)
+}
+
+// OperationTimeRepository keeps operation delays in ms. Delays with user id 0
+// are defaults, others override the defaults for a single user.
+type OperationTimeRepository interface {
+	GetDefaults() (map[string]int64, error)
+	// GetOverrides returns user overrides grouped by user id.
+	GetOverrides() (map[int64]map[string]int64, error)
+	// GetForUser returns defaults with the overrides of the user applied.
+	GetForUser(userId int64) (map[string]int64, error)
+	// Set creates or replaces the given delays, other operations stay untouched.
+	Set(userId int64, times map[string]int64) error
+	DeleteForUser(userId int64) error
+	// SeedDefaults sets default delays of operations which have none yet.
+	SeedDefaults(times map[string]int64) error
+}
+
+// CustomOperationRepository keeps WASM modules of operations uploaded by admins.
+type CustomOperationRepository interface {
+	// List returns all operations without their modules.
+	List() ([]CustomOperation, error)
+	Get(name string) (CustomOperation, error)
+	// Save creates or replaces the operation.
+	Save(operation *CustomOperation) error
+	Delete(name string) error
+}
+
+// QuotaRepository keeps quotas of users which replace the configured defaults.
+type QuotaRepository interface {
+	GetOverrides() (map[int64]Quota, error)
+	// GetForUser reports false when the user has no quota of its own.
+	GetForUser(userId int64) (Quota, bool, error)
+	Set(userId int64, quota Quota) error
+	Delete(userId int64) error
+}
+
+type APIKeyRepository interface {
+	Create(key *APIKey) error
+	GetByHash(hash string) (APIKey, error)
+	GetByUserId(userId int64) ([]APIKey, error)
+	// Delete reports false when the user has no such key.
+	Delete(id int64, userId int64) (bool, error)
+}
+
+// ReplicaRepository keeps copies of tasks given to several agents when results are verified.
+type ReplicaRepository interface {
+	GetByTaskIds(taskIds []string) ([]Replica, error)
+	// Dispatch records the agent got the task, a lost copy given again starts anew.
+	Dispatch(taskId string, agentId string) error
+	// SetResult reports false when the agent has no unanswered copy of the task.
+	SetResult(taskId string, agentId string, result float64) (bool, error)
+}
+
+// AgentRepository keeps how often results of agents match the accepted ones.
+type AgentRepository interface {
+	// Get returns an empty record for an unknown agent.
+	Get(id string) (AgentRecord, error)
+	List() ([]AgentRecord, error)
+	// Record counts an agreement or a disagreement of the agent and quarantines
+	// it once it disagreed quarantineAfter times.
+	Record(id string, agreed bool, quarantineAfter int) (AgentRecord, error)
+	// Release lifts the quarantine and forgets the disagreements, it reports false for an unknown agent.
+	Release(id string) (bool, error)
+}
+
+type Repositories struct {
+	Users            UserRepository
+	Expressions      ExpressionRepository
+	Tasks            TaskRepository
+	OperationTimes   OperationTimeRepository
+	CustomOperations CustomOperationRepository
+	Quotas           QuotaRepository
+	APIKeys          APIKeyRepository
+	Replicas         ReplicaRepository
+	Agents           AgentRepository
+}
+
+func NewSQLRepositories(db *sqlx.DB, dialect database.Dialect) Repositories {
+	return Repositories{
+		Users:            NewSQLUserRepository(db, dialect),
+		Expressions:      NewSQLExpressionRepository(db, dialect),
+		Tasks:            NewSQLTaskRepository(db, dialect),
+		OperationTimes:   NewSQLOperationTimeRepository(db, dialect),
+		CustomOperations: NewSQLCustomOperationRepository(db, dialect),
+		Quotas:           NewSQLQuotaRepository(db, dialect),
+		APIKeys:          NewSQLAPIKeyRepository(db, dialect),
+		Replicas:         NewSQLReplicaRepository(db, dialect),
+		Agents:           NewSQLAgentRepository(db, dialect),
+	}
+}
+
+func NewMemoryRepositories() Repositories {
+	store := newMemoryStore()
+	return Repositories{
+		Users:            &memoryUserRepository{store},
+		Expressions:      &memoryExpressionRepository{store},
+		Tasks:            &memoryTaskRepository{store},
+		OperationTimes:   &memoryOperationTimeRepository{store},
+		CustomOperations: &memoryCustomOperationRepository{store},
+		Quotas:           &memoryQuotaRepository{store},
+		APIKeys:          &memoryAPIKeyRepository{store},
+		Replicas:         &memoryReplicaRepository{store},
+		Agents:           &memoryAgentRepository{store},
+	}
+}
+
+// execUpdate runs an update of a single row and returns sql.ErrNoRows when no
+// row matched, like the memory store does for an unknown id.
+func execUpdate(db sqlx.Execer, query string, args []interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
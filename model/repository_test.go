@@ -0,0 +1,157 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raikh/calc_micro_final/internal/config"
+	"github.com/raikh/calc_micro_final/internal/database"
+)
+
+// testBackends returns the memory store and a fresh sqlite database, both
+// have to behave the same.
+func testBackends(t *testing.T) map[string]Repositories {
+	t.Helper()
+	cfg := &config.Config{RootDir: t.TempDir(), DB: config.DBConfig{Type: "sqlite", Name: "test.sqlite"}}
+	db := database.InitDB(context.Background(), cfg)
+	t.Cleanup(func() { db.Close() })
+
+	return map[string]Repositories{
+		"memory": NewMemoryRepositories(),
+		"sqlite": NewSQLRepositories(db, database.GetDialect()),
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	for backend, repositories := range testBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			now := time.Now()
+			one, two := 1.0, 2.0
+			expression := &Expression{Id: "expression", UserId: 1, Status: StatusPending, CreatedAt: &now}
+			task := &Task{Id: "task", ExpressionId: "expression", Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, CreatedAt: &now}
+			if err := repositories.Expressions.Create(expression, []*Task{task}); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name    string
+				update  func() error
+				wantErr error
+			}{
+				{
+					name: "expression",
+					update: func() error {
+						return repositories.Expressions.Update(&Expression{Id: "expression", Status: StatusCompleted})
+					},
+				},
+				{
+					name: "expression without changes",
+					update: func() error {
+						return repositories.Expressions.Update(&Expression{Id: "expression", Status: StatusCompleted})
+					},
+				},
+				{
+					name: "unknown expression",
+					update: func() error {
+						return repositories.Expressions.Update(&Expression{Id: "unknown", Status: StatusCompleted})
+					},
+					wantErr: sql.ErrNoRows,
+				},
+				{
+					name:   "task",
+					update: func() error { return repositories.Tasks.Update(&Task{Id: "task", Completed: true}) },
+				},
+				{
+					name:    "unknown task",
+					update:  func() error { return repositories.Tasks.Update(&Task{Id: "unknown", Completed: true}) },
+					wantErr: sql.ErrNoRows,
+				},
+			}
+
+			for _, tt := range tests {
+				if err := tt.update(); !errors.Is(err, tt.wantErr) {
+					t.Errorf("%s: Update() error = %v, want %v", tt.name, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+	for backend, repositories := range testBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			now := time.Now()
+			one, two := 1.0, 2.0
+			expression := &Expression{Id: "expression", UserId: 1, Status: StatusPending, CreatedAt: &now}
+			free := &Task{Id: "free", ExpressionId: "expression", Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, CreatedAt: &now}
+			done := &Task{Id: "done", ExpressionId: "expression", Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, Completed: true, CreatedAt: &now}
+			if err := repositories.Expressions.Create(expression, []*Task{free, done}); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name           string
+				task           string
+				loadedAttempts int
+				want           bool
+			}{
+				{name: "free task", task: "free", loadedAttempts: 0, want: true},
+				{name: "claimed by another orchestrator", task: "free", loadedAttempts: 0, want: false},
+				{name: "redistributed", task: "free", loadedAttempts: 1, want: true},
+				{name: "completed task", task: "done", loadedAttempts: 0, want: false},
+				{name: "unknown task", task: "unknown", loadedAttempts: 0, want: false},
+			}
+
+			for _, tt := range tests {
+				task := &Task{Id: tt.task, IsProcessing: true, DispatchedAt: &now, Attempts: tt.loadedAttempts + 1}
+				claimed, err := repositories.Tasks.Claim(task, tt.loadedAttempts)
+				if err != nil || claimed != tt.want {
+					t.Errorf("%s: Claim() = %v, %v, want %v", tt.name, claimed, err, tt.want)
+				}
+			}
+
+			task, err := repositories.Tasks.GetById("free")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !task.IsProcessing || task.Attempts != 2 {
+				t.Errorf("claimed task processing = %v with %d attempts, want true with 2", task.IsProcessing, task.Attempts)
+			}
+		})
+	}
+}
+
+func TestGetForProcessing(t *testing.T) {
+	for backend, repositories := range testBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			now := time.Now()
+			one, two := 1.0, 2.0
+			for _, status := range []string{StatusPending, StatusCompleted, StatusFailed, StatusTimedOut} {
+				expression := &Expression{Id: status, UserId: 1, Status: status, CreatedAt: &now}
+				tasks := []*Task{
+					{Id: status + "-ready", ExpressionId: status, Arg1: &one, Arg2: &two, Operation: "+", Dependencies: []string{}, CreatedAt: &now},
+					{Id: status + "-waiting", ExpressionId: status, Arg2: &two, Operation: "+", Dependencies: []string{status + "-ready"}, CreatedAt: &now},
+				}
+				if err := repositories.Expressions.Create(expression, tasks); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tasks, err := repositories.Tasks.GetForProcessing(60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) != 1 || tasks[0].Id != "pending-ready" {
+				t.Errorf("GetForProcessing() = %v, want only the ready task of the pending expression", tasks)
+			}
+
+			count, err := repositories.Tasks.CountForProcessing(60)
+			if err != nil || count != 1 {
+				t.Errorf("CountForProcessing() = %d, %v, want 1", count, err)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -39,98 +40,249 @@ func (a StringArray) Value() (driver.Value, error) {
 }
 
 type Task struct {
-	Id            string      `json:"id" db:"id"`
-	ExpressionId  string      `json:"expression_id" db:"expression_id"`
-	Arg1          *float64    `json:"arg1" db:"arg1"`
-	Arg2          *float64    `json:"arg2" db:"arg2"`
-	Operation     string      `json:"operation" db:"operation"`
-	OperationTime int64       `json:"operation_time" db:"operation_time"`
-	Dependencies  StringArray `json:"-" db:"dependencies"`
-	Result        *float64    `json:"result" db:"result"`
-	Completed     bool        `json:"-" db:"completed"`
-	IsProcessing  bool        `json:"-" db:"is_processing"`
-	CreatedAt     *time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt     *time.Time  `json:"updated_at" db:"updated_at"`
-	DeletedAt     *time.Time  `json:"-" db:"deleted_at"`
-}
-
-func (e *Task) buildInsertExpression() (string, []interface{}, error) {
-	sql, args, err := sq.Insert("tasks").
-		Columns("id", "expression_id", "arg1", "arg2", "operation", "completed", "is_processing", "operation_time", "dependencies", "created_at", "updated_at").
-		Values(e.Id, e.ExpressionId, e.Arg1, e.Arg2, e.Operation, e.Completed, e.IsProcessing, e.OperationTime, e.Dependencies, e.CreatedAt, e.UpdatedAt).
+	Id            string   `json:"id" db:"id"`
+	ExpressionId  string   `json:"expression_id" db:"expression_id"`
+	Arg1          *float64 `json:"arg1" db:"arg1"`
+	Arg2          *float64 `json:"arg2" db:"arg2"`
+	Operation     string   `json:"operation" db:"operation"`
+	OperationTime int64    `json:"operation_time" db:"operation_time"`
+	// Dependencies are tasks computing the arguments which are nil, the first
+	// one gives the first missing argument. A task may be listed twice.
+	Dependencies StringArray `json:"-" db:"dependencies"`
+	Result       *float64    `json:"result" db:"result"`
+	Completed    bool        `json:"-" db:"completed"`
+	IsProcessing bool        `json:"-" db:"is_processing"`
+	DispatchedAt *time.Time  `json:"-" db:"dispatched_at"`
+	// Attempts counts how many times the task was given to an agent
+	Attempts int `json:"attempts" db:"attempts"`
+	// DeadLetter tasks ran out of attempts, they are not given to agents until an admin requeues them
+	DeadLetter    bool   `json:"dead_letter" db:"dead_letter"`
+	FailureReason string `json:"failure_reason,omitempty" db:"failure_reason"`
+	// TraceParent links the task to the trace of the request which created it
+	TraceParent string `json:"-" db:"trace_parent"`
+	// CacheKey stores the result in the result cache once it is computed
+	CacheKey  string     `json:"-" db:"cache_key"`
+	CreatedAt *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
+	DeletedAt *time.Time `json:"-" db:"deleted_at"`
+}
+
+func insertTaskTx(tx *sqlx.Tx, builder sq.StatementBuilderType, e *Task) error {
+	sql, args, err := builder.Insert("tasks").
+		Columns("id", "expression_id", "arg1", "arg2", "operation", "completed", "is_processing", "operation_time", "dependencies", "trace_parent", "cache_key", "created_at", "updated_at").
+		Values(e.Id, e.ExpressionId, e.Arg1, e.Arg2, e.Operation, e.Completed, e.IsProcessing, e.OperationTime, e.Dependencies, e.TraceParent, e.CacheKey, e.CreatedAt, e.UpdatedAt).
 		ToSql()
 	if err != nil {
-		return "", nil, err
+		return err
 	}
 
-	return sql, args, nil
+	_, err = tx.Exec(sql, args...)
+
+	return err
 }
 
-func (e *Task) InsertTx(tx *sqlx.Tx) error {
-	sql, args, err := e.buildInsertExpression()
+type sqlTaskRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+	dialect database.Dialect
+}
 
+func NewSQLTaskRepository(db *sqlx.DB, dialect database.Dialect) TaskRepository {
+	return &sqlTaskRepository{db: db, builder: dialect.Builder(), dialect: dialect}
+}
+
+func (r *sqlTaskRepository) Update(e *Task) error {
+	return updateTask(r.db, r.builder, e)
+}
+
+func updateTask(db sqlx.Execer, builder sq.StatementBuilderType, e *Task) error {
+	now := time.Now()
+	sql, args, err := builder.Update("tasks").
+		Set("arg1", e.Arg1).
+		Set("arg2", e.Arg2).
+		Set("result", e.Result).
+		Set("completed", e.Completed).
+		Set("is_processing", e.IsProcessing).
+		Set("dispatched_at", e.DispatchedAt).
+		Set("attempts", e.Attempts).
+		Set("dead_letter", e.DeadLetter).
+		Set("failure_reason", e.FailureReason).
+		Set("updated_at", &now).
+		Where(sq.Eq{"id": e.Id}).
+		ToSql()
 	if err != nil {
 		return err
 	}
 
-	res, err := tx.Exec(sql, args...)
+	return execUpdate(db, sql, args)
+}
+
+func (r *sqlTaskRepository) Claim(e *Task, loadedAttempts int) (bool, error) {
+	now := time.Now()
+	sql, args, err := r.builder.Update("tasks").
+		Set("is_processing", e.IsProcessing).
+		Set("dispatched_at", e.DispatchedAt).
+		Set("attempts", e.Attempts).
+		Set("updated_at", &now).
+		Where(sq.Eq{
+			"id":          e.Id,
+			"attempts":    loadedAttempts,
+			"completed":   false,
+			"dead_letter": false,
+		}).
+		ToSql()
 	if err != nil {
-		return err
+		return false, err
 	}
-	_, err = res.LastInsertId()
+
+	result, err := r.db.Exec(sql, args...)
 	if err != nil {
-		return err
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	return rows > 0, nil
 }
 
-func (e *Task) Insert() error {
-	sql, args, err := e.buildInsertExpression()
+// passResult sets the arguments of the task computed by the dependency and
+// tells whether any was set. Two dependencies compute the two arguments in
+// order, a single one computes the argument which was unknown.
+func passResult(task *Task, dependencyId string, result *float64) bool {
+	if result == nil {
+		return false
+	}
+
+	passed := false
+	for i, id := range task.Dependencies {
+		if id != dependencyId {
+			continue
+		}
+		arg := &task.Arg1
+		if i == 1 || (len(task.Dependencies) == 1 && task.Arg1 != nil) {
+			arg = &task.Arg2
+		}
+		if *arg == nil {
+			value := *result
+			*arg = &value
+			passed = true
+		}
+	}
 
-	res, err := database.GetDB().Exec(sql, args...)
+	return passed
+}
 
+func (r *sqlTaskRepository) Complete(e *Task) (err error) {
+	tx, err := r.db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	_, err = res.LastInsertId()
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = updateTask(tx, r.builder, e); err != nil {
+		return err
+	}
 
+	var dependents []Task
+	sql, args, err := r.builder.Select("*").
+		From("tasks").
+		Where(sq.And{
+			sq.Eq{"expression_id": e.ExpressionId},
+			sq.Eq{"completed": false},
+			sq.Like{"dependencies": "%\"" + e.Id + "\"%"},
+		}).
+		ToSql()
 	if err != nil {
 		return err
 	}
+	if err = tx.Select(&dependents, sql, args...); err != nil {
+		return err
+	}
+
+	for _, dependent := range dependents {
+		if !passResult(&dependent, e.Id, e.Result) {
+			continue
+		}
+		if err = updateTask(tx, r.builder, &dependent); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (e *Task) Update() error {
-	now := time.Now()
-	sql, args, err := sq.Update("tasks").
-		Set("arg1", e.Arg1).
-		Set("arg2", e.Arg2).
-		Set("result", e.Result).
-		Set("completed", e.Completed).
-		Set("is_processing", e.IsProcessing).
-		Set("updated_at", &now).
-		Where(sq.Eq{"id": e.Id}).
+func (r *sqlTaskRepository) FillArguments() (int, error) {
+	var waiting []Task
+	sql, args, err := r.builder.Select("*").
+		From("tasks").
+		Where(sq.And{
+			sq.Or{sq.Eq{"arg1": nil}, sq.Eq{"arg2": nil}},
+			sq.Eq{"completed": false},
+		}).
 		ToSql()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if err := r.db.Select(&waiting, sql, args...); err != nil {
+		return 0, err
 	}
 
-	_, err = database.GetDB().Exec(sql, args...)
-
+	var dependencyIds []string
+	for _, task := range waiting {
+		dependencyIds = append(dependencyIds, task.Dependencies...)
+	}
+	if len(dependencyIds) == 0 {
+		return 0, nil
+	}
+	dependencies, err := r.GetByIds(dependencyIds)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	filled := 0
+	for _, task := range fillArguments(waiting, dependencies) {
+		if err := r.Update(&task); err != nil {
+			return filled, err
+		}
+		filled++
 	}
 
-	return nil
+	return filled, nil
 }
 
-func GetTaskById(id string) (*Task, error) {
+// fillArguments passes the results of the completed dependencies to the
+// waiting tasks and returns the tasks which got an argument.
+func fillArguments(waiting []Task, dependencies []Task) []Task {
+	var filled []Task
+	for _, task := range waiting {
+		passed := false
+		for _, dependency := range dependencies {
+			if dependency.Completed && passResult(&task, dependency.Id, dependency.Result) {
+				passed = true
+			}
+		}
+		if passed {
+			filled = append(filled, task)
+		}
+	}
+
+	return filled
+}
+
+func (r *sqlTaskRepository) GetById(id string) (*Task, error) {
 	var task Task
 
-	sql, args, err := sq.Select("*").
+	sql, args, err := r.builder.Select("*").
 		From("tasks").
 		Where(sq.Eq{"id": id}).
 		Limit(1).
@@ -140,7 +292,7 @@ func GetTaskById(id string) (*Task, error) {
 		return nil, err
 	}
 
-	err = database.GetDB().Get(&task, sql, args...)
+	err = r.db.Get(&task, sql, args...)
 
 	if err != nil {
 		return nil, err
@@ -149,10 +301,10 @@ func GetTaskById(id string) (*Task, error) {
 	return &task, nil
 }
 
-func GetTasksByExpressionId(expressionId string) ([]Task, error) {
+func (r *sqlTaskRepository) GetByExpressionId(expressionId string) ([]Task, error) {
 	var tasks []Task
 
-	sql, args, err := sq.Select("*").
+	sql, args, err := r.builder.Select("*").
 		From("tasks").
 		Where(sq.Eq{"expression_id": expressionId}).
 		ToSql()
@@ -161,7 +313,7 @@ func GetTasksByExpressionId(expressionId string) ([]Task, error) {
 		return nil, err
 	}
 
-	err = database.GetDB().Select(&tasks, sql, args...)
+	err = r.db.Select(&tasks, sql, args...)
 
 	if err != nil {
 		return nil, err
@@ -170,8 +322,8 @@ func GetTasksByExpressionId(expressionId string) ([]Task, error) {
 	return tasks, nil
 }
 
-func IsAllTasksCompleted(expressionId string) bool {
-	sql, args, err := sq.Select("count(*)").
+func (r *sqlTaskRepository) IsAllCompleted(expressionId string) bool {
+	sql, args, err := r.builder.Select("count(*)").
 		From("tasks").
 		Where(sq.And{
 			sq.Eq{"expression_id": expressionId},
@@ -183,7 +335,7 @@ func IsAllTasksCompleted(expressionId string) bool {
 		return false
 	}
 	var count int
-	err = database.GetDB().Get(&count, sql, args...)
+	err = r.db.Get(&count, sql, args...)
 
 	if err != nil {
 		return false
@@ -192,25 +344,71 @@ func IsAllTasksCompleted(expressionId string) bool {
 	return count == 0
 }
 
-func GetTasksForProcessing(redistributionDelay int) ([]Task, error) {
-	var tasks []Task
+func (r *sqlTaskRepository) CountIncomplete(expressionIds []string) (map[string]int, error) {
+	counts := make(map[string]int, len(expressionIds))
+	if len(expressionIds) == 0 {
+		return counts, nil
+	}
 
-	sql, args, err := sq.Select("*").
+	var rows []struct {
+		ExpressionId string `db:"expression_id"`
+		Count        int    `db:"count"`
+	}
+	query, args, err := r.builder.Select("expression_id", "count(*) AS count").
 		From("tasks").
 		Where(sq.And{
-			sq.Or{
-				sq.Eq{"is_processing": false},
-				sq.Expr("strftime('%s','now') - strftime('%s', updated_at) > ?", redistributionDelay),
-			},
+			sq.Eq{"expression_id": expressionIds},
 			sq.Eq{"completed": false},
 		}).
+		GroupBy("expression_id").
+		ToSql()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	err = r.db.Select(&rows, query, args...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tasks: %w", err)
+	}
+
+	for _, row := range rows {
+		counts[row.ExpressionId] = row.Count
+	}
+
+	return counts, nil
+}
+
+// forProcessing matches tasks with both arguments known which are free or were
+// taken too long ago. Tasks of failed and timed out expressions are skipped.
+func (r *sqlTaskRepository) forProcessing(redistributionDelay int) sq.And {
+	return sq.And{
+		sq.Or{
+			sq.Eq{"is_processing": false},
+			sq.Expr(r.dialect.SecondsSince("updated_at")+" > ?", redistributionDelay),
+		},
+		sq.NotEq{"arg1": nil},
+		sq.NotEq{"arg2": nil},
+		sq.Eq{"completed": false},
+		sq.Eq{"dead_letter": false},
+		sq.Expr("expression_id IN (SELECT id FROM expressions WHERE status = ?)", StatusPending),
+	}
+}
+
+func (r *sqlTaskRepository) GetForProcessing(redistributionDelay int) ([]Task, error) {
+	var tasks []Task
+
+	sql, args, err := r.builder.Select("*").
+		From("tasks").
+		Where(r.forProcessing(redistributionDelay)).
 		ToSql()
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = database.GetDB().Select(&tasks, sql, args...)
+	err = r.db.Select(&tasks, sql, args...)
 
 	if err != nil {
 		return nil, err
@@ -219,10 +417,26 @@ func GetTasksForProcessing(redistributionDelay int) ([]Task, error) {
 	return tasks, nil
 }
 
-func GetTasksByIds(ids []string) ([]Task, error) {
+func (r *sqlTaskRepository) CountForProcessing(redistributionDelay int) (int, error) {
+	sql, args, err := r.builder.Select("count(*)").
+		From("tasks").
+		Where(r.forProcessing(redistributionDelay)).
+		ToSql()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = r.db.Get(&count, sql, args...)
+
+	return count, err
+}
+
+func (r *sqlTaskRepository) GetByIds(ids []string) ([]Task, error) {
 	var tasks []Task
 
-	sql, args, err := sq.Select("*").
+	sql, args, err := r.builder.Select("*").
 		From("tasks").
 		Where(sq.Eq{"id": ids}).
 		ToSql()
@@ -231,7 +445,50 @@ func GetTasksByIds(ids []string) ([]Task, error) {
 		return nil, err
 	}
 
-	err = database.GetDB().Select(&tasks, sql, args...)
+	err = r.db.Select(&tasks, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+func (r *sqlTaskRepository) GetDeadLettered() ([]Task, error) {
+	tasks := []Task{}
+
+	sql, args, err := r.builder.Select("*").
+		From("tasks").
+		Where(sq.Eq{"dead_letter": true}).
+		OrderBy("updated_at").
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Select(&tasks, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+func (r *sqlTaskRepository) GetPendingByOperation(operation string) ([]Task, error) {
+	var tasks []Task
+
+	sql, args, err := r.builder.Select("*").
+		From("tasks").
+		Where(sq.Eq{"operation": operation, "completed": false}).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Select(&tasks, sql, args...)
 
 	if err != nil {
 		return nil, err
@@ -239,3 +496,74 @@ func GetTasksByIds(ids []string) ([]Task, error) {
 
 	return tasks, nil
 }
+
+// FailOperation dead-letters the not completed tasks of an operation nobody
+// computes anymore and fails their expressions. Requeueing a task resumes its
+// expression once the operation is back. It returns the number of failed expressions.
+func FailOperation(expressions ExpressionRepository, tasks TaskRepository, operation string, reason string) (int, error) {
+	pending, err := tasks.GetPendingByOperation(operation)
+	if err != nil {
+		return 0, err
+	}
+
+	var expressionIds []string
+	for _, task := range pending {
+		task.IsProcessing = false
+		task.DeadLetter = true
+		task.FailureReason = reason
+		if err := tasks.Update(&task); err != nil {
+			return 0, err
+		}
+		if !slices.Contains(expressionIds, task.ExpressionId) {
+			expressionIds = append(expressionIds, task.ExpressionId)
+		}
+	}
+
+	failed, err := expressions.GetByIds(expressionIds)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, expression := range failed {
+		if expression.Status != StatusPending {
+			continue
+		}
+		expression.Status = StatusFailed
+		expression.FailureReason = reason
+		if err := expressions.Update(&expression); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// ResumeExpression returns a failed expression to pending once none of its tasks is dead-lettered.
+func ResumeExpression(expressions ExpressionRepository, tasks TaskRepository, expressionId string) error {
+	expression, err := expressions.GetById(expressionId)
+	if err != nil {
+		return err
+	}
+
+	if expression.Status != StatusFailed {
+		return nil
+	}
+
+	expressionTasks, err := tasks.GetByExpressionId(expressionId)
+	if err != nil {
+		return err
+	}
+
+	for _, task := range expressionTasks {
+		if task.DeadLetter {
+			return nil
+		}
+	}
+
+	expression.Status = StatusPending
+	expression.FailureReason = ""
+
+	return expressions.Update(&expression)
+}
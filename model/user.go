@@ -5,16 +5,40 @@ import (
 	"errors"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/raikh/calc_micro_final/internal/database"
 
 	sq "github.com/Masterminds/squirrel"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	RoleUser    = "user"
+	RolePremium = "premium"
+	RoleAdmin   = "admin"
+)
+
+func IsValidRole(role string) bool {
+	return role == RoleUser || role == RolePremium || role == RoleAdmin
+}
+
+// MaxPriority is the highest expression priority users of the role may request.
+func MaxPriority(role string) int {
+	switch role {
+	case RoleAdmin:
+		return 9
+	case RolePremium:
+		return 6
+	default:
+		return 3
+	}
+}
+
 type User struct {
 	Id        int64      `json:"id" db:"id"`
 	Email     string     `json:"email" db:"email"`
 	Password  string     `json:"-" db:"password"`
+	Role      string     `json:"role" db:"role"`
 	CreatedAt *time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at" db:"updated_at"`
 	DeletedAt *time.Time `json:"-" db:"deleted_at"`
@@ -31,10 +55,37 @@ func (u *User) CheckPasswordHarsh(password string) bool {
 	return err == nil
 }
 
-func GetByEmail(email string) (User, error) {
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+func newUser(email string, password string, role string) *User {
+	now := time.Now()
+	user := &User{
+		Email:     email,
+		Password:  password,
+		Role:      role,
+		CreatedAt: &now,
+		UpdatedAt: &now,
+	}
+	user.GeneratePasswordHarsh()
+
+	return user
+}
+
+type sqlUserRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLUserRepository(db *sqlx.DB, dialect database.Dialect) UserRepository {
+	return &sqlUserRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlUserRepository) GetByEmail(email string) (User, error) {
 	var user User
 
-	sql, args, err := sq.Select("*").
+	sql, args, err := r.builder.Select("*").
 		From("users").
 		Where(sq.Eq{"email": email}).
 		Limit(1).
@@ -44,7 +95,7 @@ func GetByEmail(email string) (User, error) {
 		return User{}, err
 	}
 
-	err = database.GetDB().Get(&user, sql, args...)
+	err = r.db.Get(&user, sql, args...)
 
 	if err != nil {
 		return User{}, err
@@ -53,10 +104,10 @@ func GetByEmail(email string) (User, error) {
 	return user, nil
 }
 
-func GetById(id int64) (User, error) {
+func (r *sqlUserRepository) GetById(id int64) (User, error) {
 	var user User
 
-	sql, args, err := sq.Select("*").
+	sql, args, err := r.builder.Select("*").
 		From("users").
 		Where(sq.Eq{"id": id}).
 		Limit(1).
@@ -66,7 +117,7 @@ func GetById(id int64) (User, error) {
 		return User{}, err
 	}
 
-	err = database.GetDB().Get(&user, sql, args...)
+	err = r.db.Get(&user, sql, args...)
 
 	if err != nil {
 		return User{}, err
@@ -75,8 +126,8 @@ func GetById(id int64) (User, error) {
 	return user, nil
 }
 
-func Create(email string, password string) (*User, error) {
-	user, err := GetByEmail(email)
+func (r *sqlUserRepository) Create(email string, password string, role string) (*User, error) {
+	user, err := r.GetByEmail(email)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, err
 	}
@@ -85,16 +136,8 @@ func Create(email string, password string) (*User, error) {
 		return nil, errors.New("email already exists")
 	}
 
-	now := time.Now()
-	newUser := &User{
-		Email:     email,
-		Password:  password,
-		CreatedAt: &now,
-		UpdatedAt: &now,
-	}
-	newUser.GeneratePasswordHarsh()
-
-	err = newUser.insert()
+	newUser := newUser(email, password, role)
+	err = r.insert(newUser)
 
 	if err != nil {
 		return nil, err
@@ -103,17 +146,17 @@ func Create(email string, password string) (*User, error) {
 	return newUser, nil
 }
 
-func (u *User) insert() error {
-	sql, args, err := sq.Insert("users").
-		Columns("email", "password", "created_at", "updated_at", "deleted_at").
-		Values(u.Email, u.Password, u.CreatedAt, u.UpdatedAt, u.DeletedAt).
+func (r *sqlUserRepository) insert(u *User) error {
+	sql, args, err := r.builder.Insert("users").
+		Columns("email", "password", "role", "created_at", "updated_at", "deleted_at").
+		Values(u.Email, u.Password, u.Role, u.CreatedAt, u.UpdatedAt, u.DeletedAt).
 		ToSql()
 
 	if err != nil {
 		return err
 	}
 
-	res, err := database.GetDB().Exec(sql, args...)
+	res, err := r.db.Exec(sql, args...)
 
 	if err != nil {
 		return err
@@ -129,3 +172,46 @@ func (u *User) insert() error {
 
 	return nil
 }
+
+func (r *sqlUserRepository) SetRole(id int64, role string) error {
+	now := time.Now()
+	sql, args, err := r.builder.Update("users").
+		Set("role", role).
+		Set("updated_at", &now).
+		Where(sq.Eq{"id": id}).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(sql, args...)
+
+	return err
+}
+
+func (r *sqlUserRepository) GetRoles(ids []int64) (map[int64]string, error) {
+	var users []User
+
+	sql, args, err := r.builder.Select("id", "role").
+		From("users").
+		Where(sq.Eq{"id": ids}).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Select(&users, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make(map[int64]string, len(users))
+	for _, user := range users {
+		roles[user.Id] = user.Role
+	}
+
+	return roles, nil
+}
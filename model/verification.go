@@ -0,0 +1,265 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/raikh/calc_micro_final/internal/database"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// Replica is a copy of a task given to one agent when results are verified.
+type Replica struct {
+	TaskId  string `json:"task_id" db:"task_id"`
+	AgentId string `json:"agent_id" db:"agent_id"`
+	// Result is nil until the agent answers
+	Result       *float64   `json:"result" db:"result"`
+	DispatchedAt *time.Time `json:"dispatched_at" db:"dispatched_at"`
+	AnsweredAt   *time.Time `json:"answered_at" db:"answered_at"`
+}
+
+// AgentRecord counts how often results of an agent matched the accepted ones.
+type AgentRecord struct {
+	Id            string `json:"id" db:"id"`
+	Agreements    int    `json:"agreements" db:"agreements"`
+	Disagreements int    `json:"disagreements" db:"disagreements"`
+	// Quarantined agents get no tasks and their results are rejected
+	Quarantined bool       `json:"quarantined" db:"quarantined"`
+	UpdatedAt   *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type sqlReplicaRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLReplicaRepository(db *sqlx.DB, dialect database.Dialect) ReplicaRepository {
+	return &sqlReplicaRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlReplicaRepository) GetByTaskIds(taskIds []string) ([]Replica, error) {
+	replicas := []Replica{}
+	if len(taskIds) == 0 {
+		return replicas, nil
+	}
+
+	query, args, err := r.builder.Select("*").
+		From("task_replicas").
+		Where(sq.Eq{"task_id": taskIds}).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.db.Select(&replicas, query, args...); err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
+
+func (r *sqlReplicaRepository) Dispatch(taskId string, agentId string) (err error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// delete and insert instead of upsert, as its syntax differs between databases
+	query, args, err := r.builder.Delete("task_replicas").
+		Where(sq.Eq{"task_id": taskId, "agent_id": agentId}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query, args, err = r.builder.Insert("task_replicas").
+		Columns("task_id", "agent_id", "dispatched_at").
+		Values(taskId, agentId, &now).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlReplicaRepository) SetResult(taskId string, agentId string, result float64) (bool, error) {
+	now := time.Now()
+	query, args, err := r.builder.Update("task_replicas").
+		Set("result", result).
+		Set("answered_at", &now).
+		Where(sq.Eq{"task_id": taskId, "agent_id": agentId, "answered_at": nil}).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := r.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected > 0, err
+}
+
+type sqlAgentRepository struct {
+	db      *sqlx.DB
+	builder sq.StatementBuilderType
+}
+
+func NewSQLAgentRepository(db *sqlx.DB, dialect database.Dialect) AgentRepository {
+	return &sqlAgentRepository{db: db, builder: dialect.Builder()}
+}
+
+func (r *sqlAgentRepository) Get(id string) (AgentRecord, error) {
+	var record AgentRecord
+
+	query, args, err := r.builder.Select("*").
+		From("agents").
+		Where(sq.Eq{"id": id}).
+		Limit(1).
+		ToSql()
+
+	if err != nil {
+		return AgentRecord{}, err
+	}
+
+	err = r.db.Get(&record, query, args...)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return AgentRecord{Id: id}, nil
+	}
+
+	return record, err
+}
+
+func (r *sqlAgentRepository) List() ([]AgentRecord, error) {
+	records := []AgentRecord{}
+
+	query, args, err := r.builder.Select("*").
+		From("agents").
+		OrderBy("id").
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.db.Select(&records, query, args...); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *sqlAgentRepository) Record(id string, agreed bool, quarantineAfter int) (record AgentRecord, err error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return AgentRecord{}, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query, args, err := r.builder.Select("*").
+		From("agents").
+		Where(sq.Eq{"id": id}).
+		ToSql()
+	if err != nil {
+		return AgentRecord{}, err
+	}
+
+	err = tx.Get(&record, query, args...)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return AgentRecord{}, err
+	}
+
+	record.Id = id
+	record.count(agreed, quarantineAfter)
+
+	if exists {
+		query, args, err = r.builder.Update("agents").
+			Set("agreements", record.Agreements).
+			Set("disagreements", record.Disagreements).
+			Set("quarantined", record.Quarantined).
+			Set("updated_at", record.UpdatedAt).
+			Where(sq.Eq{"id": id}).
+			ToSql()
+	} else {
+		query, args, err = r.builder.Insert("agents").
+			Columns("id", "agreements", "disagreements", "quarantined", "updated_at").
+			Values(id, record.Agreements, record.Disagreements, record.Quarantined, record.UpdatedAt).
+			ToSql()
+	}
+	if err != nil {
+		return AgentRecord{}, err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return AgentRecord{}, err
+	}
+
+	return record, tx.Commit()
+}
+
+func (r *sqlAgentRepository) Release(id string) (bool, error) {
+	now := time.Now()
+	query, args, err := r.builder.Update("agents").
+		Set("disagreements", 0).
+		Set("quarantined", false).
+		Set("updated_at", &now).
+		Where(sq.Eq{"id": id}).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := r.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected > 0, err
+}
+
+// count adds an agreement or a disagreement, the agent is quarantined once
+// its disagreements reach quarantineAfter.
+func (a *AgentRecord) count(agreed bool, quarantineAfter int) {
+	now := time.Now()
+	a.UpdatedAt = &now
+	if agreed {
+		a.Agreements++
+		return
+	}
+
+	a.Disagreements++
+	if quarantineAfter > 0 && a.Disagreements >= quarantineAfter {
+		a.Quarantined = true
+	}
+}
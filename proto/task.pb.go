@@ -57,6 +57,59 @@ func (*Empty) Descriptor() ([]byte, []int) {
 	return file_proto_task_proto_rawDescGZIP(), []int{0}
 }
 
+// TaskRequest lists operations the agent can compute, it gets only such tasks
+type TaskRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Operations    []string               `protobuf:"bytes,1,rep,name=Operations,proto3" json:"Operations,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=AgentId,proto3" json:"AgentId,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TaskRequest) Reset() {
+	*x = TaskRequest{}
+	mi := &file_proto_task_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TaskRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TaskRequest) ProtoMessage() {}
+
+func (x *TaskRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_task_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TaskRequest.ProtoReflect.Descriptor instead.
+func (*TaskRequest) Descriptor() ([]byte, []int) {
+	return file_proto_task_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TaskRequest) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *TaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 type TaskResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
@@ -64,13 +117,15 @@ type TaskResponse struct {
 	Arg2          float64                `protobuf:"fixed64,3,opt,name=Arg2,proto3" json:"Arg2,omitempty"`
 	Operation     string                 `protobuf:"bytes,4,opt,name=Operation,proto3" json:"Operation,omitempty"`
 	OperationTime int64                  `protobuf:"varint,5,opt,name=OperationTime,proto3" json:"OperationTime,omitempty"`
+	// TimeoutMs is the time left until the deadline of the expression, 0 when it has none
+	TimeoutMs     int64 `protobuf:"varint,6,opt,name=TimeoutMs,proto3" json:"TimeoutMs,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *TaskResponse) Reset() {
 	*x = TaskResponse{}
-	mi := &file_proto_task_proto_msgTypes[1]
+	mi := &file_proto_task_proto_msgTypes[2]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -82,7 +137,7 @@ func (x *TaskResponse) String() string {
 func (*TaskResponse) ProtoMessage() {}
 
 func (x *TaskResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_task_proto_msgTypes[1]
+	mi := &file_proto_task_proto_msgTypes[2]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -95,7 +150,7 @@ func (x *TaskResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TaskResponse.ProtoReflect.Descriptor instead.
 func (*TaskResponse) Descriptor() ([]byte, []int) {
-	return file_proto_task_proto_rawDescGZIP(), []int{1}
+	return file_proto_task_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *TaskResponse) GetId() string {
@@ -133,6 +188,13 @@ func (x *TaskResponse) GetOperationTime() int64 {
 	return 0
 }
 
+func (x *TaskResponse) GetTimeoutMs() int64 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
 type TaskResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
@@ -143,7 +205,7 @@ type TaskResult struct {
 
 func (x *TaskResult) Reset() {
 	*x = TaskResult{}
-	mi := &file_proto_task_proto_msgTypes[2]
+	mi := &file_proto_task_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -155,7 +217,7 @@ func (x *TaskResult) String() string {
 func (*TaskResult) ProtoMessage() {}
 
 func (x *TaskResult) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_task_proto_msgTypes[2]
+	mi := &file_proto_task_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -168,7 +230,7 @@ func (x *TaskResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TaskResult.ProtoReflect.Descriptor instead.
 func (*TaskResult) Descriptor() ([]byte, []int) {
-	return file_proto_task_proto_rawDescGZIP(), []int{2}
+	return file_proto_task_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *TaskResult) GetId() string {
@@ -185,25 +247,248 @@ func (x *TaskResult) GetResult() float64 {
 	return 0
 }
 
+// OperationInfo names a custom operation and the hash of its module
+type OperationInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Hash          string                 `protobuf:"bytes,2,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OperationInfo) Reset() {
+	*x = OperationInfo{}
+	mi := &file_proto_task_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OperationInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationInfo) ProtoMessage() {}
+
+func (x *OperationInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_task_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationInfo.ProtoReflect.Descriptor instead.
+func (*OperationInfo) Descriptor() ([]byte, []int) {
+	return file_proto_task_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *OperationInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *OperationInfo) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+type OperationList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Operations    []*OperationInfo       `protobuf:"bytes,1,rep,name=Operations,proto3" json:"Operations,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OperationList) Reset() {
+	*x = OperationList{}
+	mi := &file_proto_task_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OperationList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationList) ProtoMessage() {}
+
+func (x *OperationList) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_task_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationList.ProtoReflect.Descriptor instead.
+func (*OperationList) Descriptor() ([]byte, []int) {
+	return file_proto_task_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *OperationList) GetOperations() []*OperationInfo {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+type OperationRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OperationRequest) Reset() {
+	*x = OperationRequest{}
+	mi := &file_proto_task_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OperationRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationRequest) ProtoMessage() {}
+
+func (x *OperationRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_task_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationRequest.ProtoReflect.Descriptor instead.
+func (*OperationRequest) Descriptor() ([]byte, []int) {
+	return file_proto_task_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *OperationRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+// OperationModule is the WASM module of a custom operation
+type OperationModule struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Hash          string                 `protobuf:"bytes,2,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	Module        []byte                 `protobuf:"bytes,3,opt,name=Module,proto3" json:"Module,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OperationModule) Reset() {
+	*x = OperationModule{}
+	mi := &file_proto_task_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OperationModule) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OperationModule) ProtoMessage() {}
+
+func (x *OperationModule) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_task_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OperationModule.ProtoReflect.Descriptor instead.
+func (*OperationModule) Descriptor() ([]byte, []int) {
+	return file_proto_task_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *OperationModule) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *OperationModule) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *OperationModule) GetModule() []byte {
+	if x != nil {
+		return x.Module
+	}
+	return nil
+}
+
 var File_proto_task_proto protoreflect.FileDescriptor
 
 const file_proto_task_proto_rawDesc = "" +
 	"\n" +
 	"\x10proto/task.proto\x12\x04task\"\a\n" +
-	"\x05Empty\"\x8a\x01\n" +
+	"\x05Empty\"G\n" +
+	"\vTaskRequest\x12\x1e\n" +
+	"\n" +
+	"Operations\x18\x01 \x03(\tR\n" +
+	"Operations\x12\x18\n" +
+	"\aAgentId\x18\x02 \x01(\tR\aAgentId\"\xa8\x01\n" +
 	"\fTaskResponse\x12\x0e\n" +
 	"\x02Id\x18\x01 \x01(\tR\x02Id\x12\x12\n" +
 	"\x04Arg1\x18\x02 \x01(\x01R\x04Arg1\x12\x12\n" +
 	"\x04Arg2\x18\x03 \x01(\x01R\x04Arg2\x12\x1c\n" +
 	"\tOperation\x18\x04 \x01(\tR\tOperation\x12$\n" +
-	"\rOperationTime\x18\x05 \x01(\x03R\rOperationTime\"4\n" +
+	"\rOperationTime\x18\x05 \x01(\x03R\rOperationTime\x12\x1c\n" +
+	"\tTimeoutMs\x18\x06 \x01(\x03R\tTimeoutMs\"4\n" +
 	"\n" +
 	"TaskResult\x12\x0e\n" +
 	"\x02Id\x18\x01 \x01(\tR\x02Id\x12\x16\n" +
-	"\x06Result\x18\x02 \x01(\x01R\x06Result2g\n" +
-	"\vTaskService\x12'\n" +
-	"\x04Task\x12\v.task.Empty\x1a\x12.task.TaskResponse\x12/\n" +
-	"\x0eCalculatedTask\x12\x10.task.TaskResult\x1a\v.task.EmptyB)Z'github.com/raikh/calc_micro_final/protob\x06proto3"
+	"\x06Result\x18\x02 \x01(\x01R\x06Result\"7\n" +
+	"\rOperationInfo\x12\x12\n" +
+	"\x04Name\x18\x01 \x01(\tR\x04Name\x12\x12\n" +
+	"\x04Hash\x18\x02 \x01(\tR\x04Hash\"D\n" +
+	"\rOperationList\x123\n" +
+	"\n" +
+	"Operations\x18\x01 \x03(\v2\x13.task.OperationInfoR\n" +
+	"Operations\"&\n" +
+	"\x10OperationRequest\x12\x12\n" +
+	"\x04Name\x18\x01 \x01(\tR\x04Name\"Q\n" +
+	"\x0fOperationModule\x12\x12\n" +
+	"\x04Name\x18\x01 \x01(\tR\x04Name\x12\x12\n" +
+	"\x04Hash\x18\x02 \x01(\tR\x04Hash\x12\x16\n" +
+	"\x06Module\x18\x03 \x01(\fR\x06Module2\xec\x01\n" +
+	"\vTaskService\x12-\n" +
+	"\x04Task\x12\x11.task.TaskRequest\x1a\x12.task.TaskResponse\x12/\n" +
+	"\x0eCalculatedTask\x12\x10.task.TaskResult\x1a\v.task.Empty\x128\n" +
+	"\x14ListCustomOperations\x12\v.task.Empty\x1a\x13.task.OperationList\x12C\n" +
+	"\x12GetCustomOperation\x12\x16.task.OperationRequest\x1a\x15.task.OperationModuleB)Z'github.com/raikh/calc_micro_final/protob\x06proto3"
 
 var (
 	file_proto_task_proto_rawDescOnce sync.Once
@@ -217,22 +502,32 @@ func file_proto_task_proto_rawDescGZIP() []byte {
 	return file_proto_task_proto_rawDescData
 }
 
-var file_proto_task_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_proto_task_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
 var file_proto_task_proto_goTypes = []any{
-	(*Empty)(nil),        // 0: task.Empty
-	(*TaskResponse)(nil), // 1: task.TaskResponse
-	(*TaskResult)(nil),   // 2: task.TaskResult
+	(*Empty)(nil),            // 0: task.Empty
+	(*TaskRequest)(nil),      // 1: task.TaskRequest
+	(*TaskResponse)(nil),     // 2: task.TaskResponse
+	(*TaskResult)(nil),       // 3: task.TaskResult
+	(*OperationInfo)(nil),    // 4: task.OperationInfo
+	(*OperationList)(nil),    // 5: task.OperationList
+	(*OperationRequest)(nil), // 6: task.OperationRequest
+	(*OperationModule)(nil),  // 7: task.OperationModule
 }
 var file_proto_task_proto_depIdxs = []int32{
-	0, // 0: task.TaskService.Task:input_type -> task.Empty
-	2, // 1: task.TaskService.CalculatedTask:input_type -> task.TaskResult
-	1, // 2: task.TaskService.Task:output_type -> task.TaskResponse
-	0, // 3: task.TaskService.CalculatedTask:output_type -> task.Empty
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	4, // 0: task.OperationList.Operations:type_name -> task.OperationInfo
+	1, // 1: task.TaskService.Task:input_type -> task.TaskRequest
+	3, // 2: task.TaskService.CalculatedTask:input_type -> task.TaskResult
+	0, // 3: task.TaskService.ListCustomOperations:input_type -> task.Empty
+	6, // 4: task.TaskService.GetCustomOperation:input_type -> task.OperationRequest
+	2, // 5: task.TaskService.Task:output_type -> task.TaskResponse
+	0, // 6: task.TaskService.CalculatedTask:output_type -> task.Empty
+	5, // 7: task.TaskService.ListCustomOperations:output_type -> task.OperationList
+	7, // 8: task.TaskService.GetCustomOperation:output_type -> task.OperationModule
+	5, // [5:9] is the sub-list for method output_type
+	1, // [1:5] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_proto_task_proto_init() }
@@ -246,7 +541,7 @@ func file_proto_task_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_task_proto_rawDesc), len(file_proto_task_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   8,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
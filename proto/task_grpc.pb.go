@@ -19,16 +19,20 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	TaskService_Task_FullMethodName           = "/task.TaskService/Task"
-	TaskService_CalculatedTask_FullMethodName = "/task.TaskService/CalculatedTask"
+	TaskService_Task_FullMethodName                 = "/task.TaskService/Task"
+	TaskService_CalculatedTask_FullMethodName       = "/task.TaskService/CalculatedTask"
+	TaskService_ListCustomOperations_FullMethodName = "/task.TaskService/ListCustomOperations"
+	TaskService_GetCustomOperation_FullMethodName   = "/task.TaskService/GetCustomOperation"
 )
 
 // TaskServiceClient is the client API for TaskService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TaskServiceClient interface {
-	Task(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*TaskResponse, error)
+	Task(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskResponse, error)
 	CalculatedTask(ctx context.Context, in *TaskResult, opts ...grpc.CallOption) (*Empty, error)
+	ListCustomOperations(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*OperationList, error)
+	GetCustomOperation(ctx context.Context, in *OperationRequest, opts ...grpc.CallOption) (*OperationModule, error)
 }
 
 type taskServiceClient struct {
@@ -39,7 +43,7 @@ func NewTaskServiceClient(cc grpc.ClientConnInterface) TaskServiceClient {
 	return &taskServiceClient{cc}
 }
 
-func (c *taskServiceClient) Task(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*TaskResponse, error) {
+func (c *taskServiceClient) Task(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskResponse, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(TaskResponse)
 	err := c.cc.Invoke(ctx, TaskService_Task_FullMethodName, in, out, cOpts...)
@@ -59,12 +63,34 @@ func (c *taskServiceClient) CalculatedTask(ctx context.Context, in *TaskResult,
 	return out, nil
 }
 
+func (c *taskServiceClient) ListCustomOperations(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*OperationList, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OperationList)
+	err := c.cc.Invoke(ctx, TaskService_ListCustomOperations_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskServiceClient) GetCustomOperation(ctx context.Context, in *OperationRequest, opts ...grpc.CallOption) (*OperationModule, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(OperationModule)
+	err := c.cc.Invoke(ctx, TaskService_GetCustomOperation_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TaskServiceServer is the server API for TaskService service.
 // All implementations must embed UnimplementedTaskServiceServer
 // for forward compatibility.
 type TaskServiceServer interface {
-	Task(context.Context, *Empty) (*TaskResponse, error)
+	Task(context.Context, *TaskRequest) (*TaskResponse, error)
 	CalculatedTask(context.Context, *TaskResult) (*Empty, error)
+	ListCustomOperations(context.Context, *Empty) (*OperationList, error)
+	GetCustomOperation(context.Context, *OperationRequest) (*OperationModule, error)
 	mustEmbedUnimplementedTaskServiceServer()
 }
 
@@ -75,12 +101,18 @@ type TaskServiceServer interface {
 // pointer dereference when methods are called.
 type UnimplementedTaskServiceServer struct{}
 
-func (UnimplementedTaskServiceServer) Task(context.Context, *Empty) (*TaskResponse, error) {
+func (UnimplementedTaskServiceServer) Task(context.Context, *TaskRequest) (*TaskResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Task not implemented")
 }
 func (UnimplementedTaskServiceServer) CalculatedTask(context.Context, *TaskResult) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CalculatedTask not implemented")
 }
+func (UnimplementedTaskServiceServer) ListCustomOperations(context.Context, *Empty) (*OperationList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCustomOperations not implemented")
+}
+func (UnimplementedTaskServiceServer) GetCustomOperation(context.Context, *OperationRequest) (*OperationModule, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCustomOperation not implemented")
+}
 func (UnimplementedTaskServiceServer) mustEmbedUnimplementedTaskServiceServer() {}
 func (UnimplementedTaskServiceServer) testEmbeddedByValue()                     {}
 
@@ -103,7 +135,7 @@ func RegisterTaskServiceServer(s grpc.ServiceRegistrar, srv TaskServiceServer) {
 }
 
 func _TaskService_Task_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(Empty)
+	in := new(TaskRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -115,7 +147,7 @@ func _TaskService_Task_Handler(srv interface{}, ctx context.Context, dec func(in
 		FullMethod: TaskService_Task_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(TaskServiceServer).Task(ctx, req.(*Empty))
+		return srv.(TaskServiceServer).Task(ctx, req.(*TaskRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -138,6 +170,42 @@ func _TaskService_CalculatedTask_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TaskService_ListCustomOperations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskServiceServer).ListCustomOperations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TaskService_ListCustomOperations_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskServiceServer).ListCustomOperations(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TaskService_GetCustomOperation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OperationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskServiceServer).GetCustomOperation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TaskService_GetCustomOperation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskServiceServer).GetCustomOperation(ctx, req.(*OperationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TaskService_ServiceDesc is the grpc.ServiceDesc for TaskService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,6 +221,14 @@ var TaskService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "CalculatedTask",
 			Handler:    _TaskService_CalculatedTask_Handler,
 		},
+		{
+			MethodName: "ListCustomOperations",
+			Handler:    _TaskService_ListCustomOperations_Handler,
+		},
+		{
+			MethodName: "GetCustomOperation",
+			Handler:    _TaskService_GetCustomOperation_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/task.proto",